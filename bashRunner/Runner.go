@@ -4,9 +4,9 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 	"os/exec"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -19,9 +19,9 @@ type task struct {
 	cmd         *exec.Cmd
 	done        chan struct{}
 	timeStarted time.Time
-	wasCanceled bool
+	// wasCanceled is set by Stop and read once the command is done, which happen on different goroutines
+	wasCanceled atomic.Bool
 	logger      hclog.Logger
-	originalPwd string
 }
 
 func (t *task) Status() plugins.RunResponse {
@@ -29,16 +29,15 @@ func (t *task) Status() plugins.RunResponse {
 	timeElapsed := now.Unix() - t.timeStarted.Unix()
 	select {
 	case <-t.done:
-		// defer close(t.done)
 		t.logger.Trace("Task has completed")
 		status := proto.RunStatus_FINISHED
 		exitCode := t.cmd.ProcessState.ExitCode()
-		if exitCode != 0 && !t.wasCanceled {
+		canceled := t.wasCanceled.Load()
+		if exitCode != 0 && !canceled {
 			status = proto.RunStatus_CRASHED
-		} else if exitCode != 0 && t.wasCanceled {
+		} else if exitCode != 0 && canceled {
 			status = proto.RunStatus_CANCELED
 		}
-		os.Chdir(t.originalPwd)
 		return plugins.RunResponse{
 			Status:      status,
 			ExitCode:    int64(exitCode),
@@ -54,19 +53,32 @@ func (t *task) Status() plugins.RunResponse {
 	}
 }
 
-func (t *task) start() {
-	t.done = make(chan struct{})
-	t.timeStarted = time.Now()
-	err := t.cmd.Run()
+func (t *task) wait() {
+	err := t.cmd.Wait()
 	if err != nil {
 		t.logger.Trace(fmt.Sprintf("error running cmd: %s", err.Error()))
 	}
-	t.done <- struct{}{}
+	close(t.done)
 }
 
+// Stop signals the whole process group of the command, so anything the script started gets the
+// signal too. If the group is still running after timeoutMS it is killed.
 func (t *task) Stop(signal int64, timeoutMS int64) error {
-	t.wasCanceled = true
-	return t.cmd.Process.Signal(syscall.Signal(signal))
+	t.wasCanceled.Store(true)
+	pgid := -t.cmd.Process.Pid
+	err := syscall.Kill(pgid, syscall.Signal(signal))
+	if syscall.Signal(signal) == syscall.SIGKILL {
+		return err
+	}
+	go func() {
+		select {
+		case <-t.done:
+		case <-time.After(time.Duration(timeoutMS) * time.Millisecond):
+			t.logger.Warn(fmt.Sprintf("command did not exit within %dms of signal %d, killing it", timeoutMS, signal))
+			syscall.Kill(pgid, syscall.SIGKILL)
+		}
+	}()
+	return err
 }
 
 type stream struct {
@@ -99,15 +111,19 @@ func run(req plugins.RunRequest, ctx context.Context) (t plugins.Task, err error
 			logger.Error(fmt.Sprintf("error in running: %s", err.Error()))
 		}
 	}()
-	body, _ := json.Marshal(req)
+	// The environment is left out of the log, it is likely to contain secrets
+	env := req.Environ()
+	body, _ := json.Marshal(map[string]interface{}{
+		"runCommand":     req.RunCommand,
+		"args":           req.Args,
+		"path":           req.Path,
+		"packageName":    req.PackageName,
+		"commandName":    req.CommandName,
+		"stepIdentifier": req.StepIdentifier,
+		"settings":       req.Settings.AsMap(),
+	})
 
-	logger.Debug(fmt.Sprintf("Running command %s", string(body)))
-	curPWD, err := os.Getwd()
-	if err != nil {
-		logger.Error(fmt.Sprintf("failed to get PWD: %s", err))
-		return nil, err
-	}
-	os.Chdir(req.Path)
+	logger.Debug(fmt.Sprintf("Running command %s with %d environment variables", string(body), len(env)))
 	shellFunc := fmt.Sprintf(`
 	anon() {
 		%s
@@ -117,13 +133,23 @@ func run(req plugins.RunRequest, ctx context.Context) (t plugins.Task, err error
 	cmd := exec.Command("/bin/bash", "-ce", shellFunc)
 	cmd.Stdout = stdOut
 	cmd.Stderr = stdErr
+	cmd.Dir = req.Path
+	cmd.Env = env
+	// Run in its own process group so signals reach everything the script starts, and so a Ctrl-C
+	// in harbor's terminal doesn't reach the script before harbor can forward it
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	t2 := &task{
-		cmd:         cmd,
-		logger:      logger,
-		originalPwd: curPWD,
+		cmd:    cmd,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+	t2.timeStarted = time.Now()
+	if err = cmd.Start(); err != nil {
+		logger.Error(fmt.Sprintf("failed to start command: %s", err))
+		return nil, err
 	}
 
-	go t2.start()
+	go t2.wait()
 	t = t2
 	return
 
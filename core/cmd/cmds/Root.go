@@ -3,14 +3,17 @@ package cmds
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
 	"github.com/radding/harbor/internal/config"
+	"github.com/radding/harbor/internal/plugins"
 	"github.com/radding/harbor/internal/workspaces"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 )
 
 type LogLevel zerolog.Level
@@ -67,10 +70,12 @@ func LogLevelPtr(logLevel LogLevel) *LogLevel {
 }
 
 var machineReadableLogs *bool
+var strictConfig *bool
 var logLevel *LogLevel = LogLevelPtr(LogLevel(zerolog.InfoLevel))
 
 func init() {
 	machineReadableLogs = rootCmd.PersistentFlags().BoolP("machine-readable", "m", false, "Produce machine readable JSON logs?")
+	strictConfig = rootCmd.PersistentFlags().Bool("strict", false, "Fail on unknown fields and anything else that doesn't match the schema of workspace.conf and harbor.conf")
 	rootCmd.PersistentFlags().VarP(logLevel, "log-level", "v", "The Log level to set the logger to. Can be: Panic, Fatal, Error, Warn, Info, Debug, and Trace")
 }
 
@@ -96,33 +101,15 @@ var rootCmd = &cobra.Command{
 
 		// log.Info().Msgf("can handle: %s with err %s", canHandle, err)
 
-		zerolog.SetGlobalLevel(zerolog.Level(*logLevel))
-		if !*machineReadableLogs {
-			out := zerolog.ConsoleWriter{Out: os.Stdout}
-			out.PartsOrder = []string{
-				"Identifier",
-				"time",
-				"level",
-				"message",
-			}
-			out.FieldsExclude = []string{
-				"Identifier",
-			}
-			out.FormatFieldValue = func(i interface{}) string {
-				if i == nil {
-					return ""
-				}
-				return fmt.Sprintf("%s", i)
-			}
-
-			log.Logger = log.Output(out)
-		}
+		configureLogging()
 
 		log.Trace().Msgf("starting logging with level: %s", logLevel.String())
+		// workspace check reports every problem itself, loading strictly would stop at the first one
+		workspaces.Strict = *strictConfig && cmd != checkWsCMD
 		if _, err := workspaces.GetConfig(); err != nil {
 			log.Fatal().Err(err).Msg("error getting config")
 		}
-		c := config.LoadConfig(".", os.ExpandEnv("${APPDATA}/harbor/"), os.ExpandEnv("${ProgramFiles}/harbor"), "/etc/harbor/", os.ExpandEnv("${HOMEPATH}/.harbor"), os.ExpandEnv("${HOME}/.harbor"))
+		c := config.Get()
 		err := c.Save()
 		if err != err {
 			log.Warn().Err(err).Msg("error saving configuration. This is fine, but could impact performance this time around")
@@ -140,7 +127,56 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// configureLogging sets up the global logger from the persistent flags
+func configureLogging() {
+	zerolog.SetGlobalLevel(zerolog.Level(*logLevel))
+	if !*machineReadableLogs {
+		out := zerolog.ConsoleWriter{Out: os.Stdout}
+		out.PartsOrder = []string{
+			"Identifier",
+			"time",
+			"level",
+			"message",
+		}
+		out.FieldsExclude = []string{
+			"Identifier",
+		}
+		out.FormatFieldValue = func(i interface{}) string {
+			if i == nil {
+				return ""
+			}
+			return fmt.Sprintf("%s", i)
+		}
+
+		log.Logger = log.Output(out)
+	}
+}
+
+func loadGlobalConfig() *config.GlobalConfig {
+	return config.LoadConfig(".", os.ExpandEnv("${APPDATA}/harbor/"), os.ExpandEnv("${ProgramFiles}/harbor"), "/etc/harbor/", os.ExpandEnv("${HOMEPATH}/.harbor"), os.ExpandEnv("${HOME}/.harbor"))
+}
+
+// needsPluginCommands tells whether args name a subcommand that isn't builtin, so it may come from a plugin
+func needsPluginCommands(args []string) bool {
+	_, _, err := rootCmd.Find(args)
+	return err != nil
+}
+
 func Execute() {
+	// Cobra only parses the flags once it runs a command, parse the logging flags early so loading the config
+	// and plugins logs at the right level
+	flags := pflag.NewFlagSet("logging", pflag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.SetOutput(io.Discard)
+	flags.AddFlagSet(rootCmd.PersistentFlags())
+	flags.Parse(os.Args[1:])
+	configureLogging()
+
+	loadGlobalConfig()
+	// Starting plugins is slow, only ask them for their commands when the arguments aren't a builtin command
+	if needsPluginCommands(os.Args[1:]) {
+		plugins.MountPluginCommands(rootCmd)
+	}
 	if err := rootCmd.Execute(); err != nil {
 		config.Get().KillAllPlugins()
 		os.Exit(1)
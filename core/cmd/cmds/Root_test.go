@@ -0,0 +1,24 @@
+package cmds
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnlyUnknownCommandsNeedPluginCommands(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected bool
+	}{
+		{args: []string{}, expected: false},
+		{args: []string{"--help"}, expected: false},
+		{args: []string{"--log-level", "debug"}, expected: false},
+		{args: []string{"run", "build"}, expected: false},
+		{args: []string{"cache", "ls"}, expected: false},
+		{args: []string{"deploy"}, expected: true},
+		{args: []string{"--log-level", "debug", "deploy", "--env", "prod"}, expected: true},
+	} {
+		assert.Equal(t, tc.expected, needsPluginCommands(tc.args), tc.args)
+	}
+}
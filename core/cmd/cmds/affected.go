@@ -0,0 +1,35 @@
+package cmds
+
+import (
+	"fmt"
+
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/spf13/cobra"
+)
+
+var affectedSince *string
+
+func init() {
+	rootCmd.AddCommand(affectedCmd)
+	affectedSince = affectedCmd.Flags().String("since", "main", "The git ref to compare against")
+}
+
+var affectedCmd = &cobra.Command{
+	Use:   "affected",
+	Short: "List the packages changed since a git ref and the packages that depend on them",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := workspaces.GetConfig()
+		if err != nil {
+			return err
+		}
+		packages, err := conf.AffectedPackages(*affectedSince)
+		if err != nil {
+			return err
+		}
+		for _, pkg := range packages {
+			fmt.Fprintln(cmd.OutOrStdout(), pkg)
+		}
+		return nil
+	},
+}
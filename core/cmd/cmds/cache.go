@@ -0,0 +1,83 @@
+package cmds
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/radding/harbor/internal/runners"
+	"github.com/spf13/cobra"
+)
+
+var pruneOlderThan *string
+var pruneMaxSize *string
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheShowCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cacheCmd.AddCommand(cacheCleanCmd)
+	pruneOlderThan = cachePruneCmd.Flags().String("older-than", "", "Remove entries not used for this long, like 7d or 12h")
+	pruneMaxSize = cachePruneCmd.Flags().String("max-size", "", "Remove the least recently used entries until the cache is at most this big, like 5GB")
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Inspect and clean up the caches of the workspace",
+	Run: func(cmd *cobra.Command, args []string) {
+		cmd.Help()
+	},
+}
+
+var cacheListCmd = &cobra.Command{
+	Use:     "ls",
+	Aliases: []string{"list"},
+	Short:   "List the cached entries with their package, command, size and age",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runners.ListCache(os.Stdout)
+	},
+}
+
+var cacheShowCmd = &cobra.Command{
+	Use:   "show <key>",
+	Short: "Replay the logs of a cached entry and list its artifacts",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runners.ShowCache(args[0], os.Stdout)
+	},
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove old entries, least recently used first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if *pruneOlderThan == "" && *pruneMaxSize == "" {
+			return fmt.Errorf("nothing to prune by, pass --older-than and/or --max-size")
+		}
+		var olderThan time.Duration
+		var maxSize int64
+		var err error
+		if *pruneOlderThan != "" {
+			olderThan, err = runners.ParseAge(*pruneOlderThan)
+			if err != nil {
+				return err
+			}
+		}
+		if *pruneMaxSize != "" {
+			maxSize, err = runners.ParseSize(*pruneMaxSize)
+			if err != nil {
+				return err
+			}
+		}
+		return runners.PruneCache(olderThan, maxSize, os.Stdout)
+	},
+}
+
+var cacheCleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove every cached entry",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return runners.CleanCache(os.Stdout)
+	},
+}
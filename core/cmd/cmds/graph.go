@@ -0,0 +1,38 @@
+package cmds
+
+import (
+	"os"
+
+	"github.com/radding/harbor/internal/runners"
+	"github.com/spf13/cobra"
+)
+
+var graphFormat *string
+var graphPackages *bool
+var graphFrom *string
+var graphTo *string
+
+func init() {
+	rootCmd.AddCommand(graphCmd)
+	graphFormat = graphCmd.Flags().StringP("format", "f", "dot", "Output format, can be: dot, mermaid or json")
+	graphPackages = graphCmd.Flags().Bool("packages", false, "Collapse the steps of every package into a single node")
+	graphFrom = graphCmd.Flags().String("from", "", "Highlight the path from this step, or package with --packages")
+	graphTo = graphCmd.Flags().String("to", "", "Highlight the path to this step, or package with --packages")
+}
+
+var graphCmd = &cobra.Command{
+	Use:   "graph [command|package:command]",
+	Short: "Export the dependency graph of the workspace as dot, mermaid or json",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := runners.GraphOptions{
+			Packages: *graphPackages,
+			From:     *graphFrom,
+			To:       *graphTo,
+		}
+		if len(args) > 0 {
+			opts.Target = args[0]
+		}
+		return runners.GraphCommand(opts, *graphFormat, os.Stdout)
+	},
+}
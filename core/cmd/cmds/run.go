@@ -1,22 +1,71 @@
 package cmds
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/radding/harbor/internal/runners"
-	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
+var dryRun *bool
+var planFormat *string
+var jobs *int
+var keepGoing *bool
+var graceTimeout *time.Duration
+var since *string
+var affected *bool
+var filters *[]string
+var excludes *[]string
+var only *bool
+
 func init() {
 	rootCmd.AddCommand(runCmd)
+	dryRun = runCmd.Flags().Bool("dry-run", false, "Print the resolved run graph without running anything")
+	planFormat = runCmd.Flags().String("format", "text", "Output format of --dry-run, can be: text or json")
+	jobs = runCmd.Flags().IntP("jobs", "j", 0, "Maximum number of steps to run at once, defaults to max_parallel in workspace.conf or the number of CPUs")
+	keepGoing = runCmd.Flags().BoolP("keep-going", "k", false, "Keep running independent steps when a step fails, only skipping the steps that depend on it")
+	since = runCmd.Flags().String("since", "", "Only run the packages changed since this git ref, and the packages that depend on them")
+	affected = runCmd.Flags().Bool("affected", false, "Only run the affected packages, short for --since main")
+	filters = runCmd.Flags().StringArray("filter", []string{}, "Only run the command in the packages whose name matches this glob, can be repeated")
+	excludes = runCmd.Flags().StringArray("exclude", []string{}, "Don't run the command in the packages whose name matches this glob, unless a package that runs needs them, can be repeated")
+	only = runCmd.Flags().Bool("only", false, "Only run the selected steps, without the steps they depend on")
+	graceTimeout = runCmd.Flags().Duration("grace-timeout", 10*time.Second, "How long running steps get to stop after an interrupt before they are killed")
 }
 
 var runCmd = &cobra.Command{
-	Use:   "run",
+	Use:   "run <command|package:command>",
 	Short: "Run a command in the workspace/project",
-	Run: func(cmd *cobra.Command, args []string) {
-		err := runners.RunCommand(args[0], args[1:])
-		if err != nil {
-			log.Error().Err(err).Msg("couldn't run command")
+	Args:  cobra.MinimumNArgs(1),
+	// Failed steps are already in the summary, usage wouldn't help
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sel := runners.Selection{
+			Since:    *since,
+			Filters:  *filters,
+			Excludes: *excludes,
+			Only:     *only,
+		}
+		if *affected && sel.Since == "" {
+			sel.Since = "main"
+		}
+		if *dryRun {
+			return errors.Wrap(runners.PlanCommand(args[0], args[1:], *planFormat, sel, os.Stdout), "couldn't plan command")
 		}
+		interrupts := make(chan os.Signal, 2)
+		signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(interrupts)
+		err := runners.RunCommand(args[0], args[1:], runners.RunOptions{
+			Jobs:         *jobs,
+			KeepGoing:    *keepGoing,
+			Summary:      os.Stdout,
+			Interrupts:   interrupts,
+			GraceTimeout: *graceTimeout,
+			Selection:    sel,
+		})
+		return errors.Wrap(err, "couldn't run command")
 	},
 }
@@ -0,0 +1,24 @@
+package cmds
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunFailsWhenAStepFails(t *testing.T) {
+	useWorkspace(t, map[string]string{
+		"workspace.conf": "workspace_name: ws\npackages:\n  - path: app\n",
+		// no runner plugin is installed, so the step fails
+		"app/harbor.conf": `workspace_name: app
+commands:
+  build:
+    type: shell
+    command: go build
+`,
+	})
+
+	_, err := execute("run", "build", "--keep-going")
+	assert.ErrorContains(t, err, "couldn't run command")
+	assert.ErrorContains(t, err, "shell")
+}
@@ -1,16 +1,34 @@
 package cmds
 
 import (
+	"fmt"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor/internal/runners"
 	"github.com/radding/harbor/internal/workspaces"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
 
 var initDir *string
+var addPath *string
+var addRef *string
+var addDepth *int64
+var addSubmodules *bool
+var syncFrozen *bool
 
 func init() {
 	rootCmd.AddCommand(workspaceCMD)
 	workspaceCMD.AddCommand(initWsCMD)
+	workspaceCMD.AddCommand(addWsCMD)
+	addPath = addWsCMD.Flags().StringP("path", "p", "", "The directory to clone the package into, defaults to a directory in the workspace root named after the source")
+	addRef = addWsCMD.Flags().String("ref", "", "The branch, tag or commit to check out, defaults to the default branch")
+	addDepth = addWsCMD.Flags().Int64("depth", 0, "Only clone this many commits of history, 0 clones all of it")
+	addSubmodules = addWsCMD.Flags().Bool("submodules", false, "Also clone the submodules of the package")
+	workspaceCMD.AddCommand(syncWsCMD)
+	syncFrozen = syncWsCMD.Flags().Bool("frozen", false, "Fail instead of updating workspace.lock when it doesn't match the packages")
+	workspaceCMD.AddCommand(checkWsCMD)
+	workspaceCMD.AddCommand(schemaWsCMD)
 	initDir = initWsCMD.Flags().StringP("dir", "d", "", "Specify a directory to start a workspace in, defaults to [name]")
 }
 
@@ -38,3 +56,76 @@ var initWsCMD = &cobra.Command{
 		return workspaces.Initialize(args[0], *initDir, "workspace.conf")
 	},
 }
+
+var addWsCMD = &cobra.Command{
+	Use:   "add <source>",
+	Short: "clone a package into the workspace and add it to the workspace's packages",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := workspaces.GetConfig()
+		if err != nil {
+			return err
+		}
+		pkg, err := conf.AddPackage(&plugins.CloneRequest{
+			Source:      args[0],
+			Destination: *addPath,
+			Ref:         *addRef,
+			Depth:       *addDepth,
+			Submodules:  *addSubmodules,
+		})
+		if err != nil {
+			return err
+		}
+		log.Info().Msgf("added %s to the workspace at %s", args[0], pkg.Path)
+		return nil
+	},
+}
+
+var syncWsCMD = &cobra.Command{
+	Use:   "sync",
+	Short: "check out every package at the revision pinned in workspace.lock",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := workspaces.GetConfig()
+		if err != nil {
+			return err
+		}
+		return conf.Sync(*syncFrozen)
+	},
+}
+
+var checkWsCMD = &cobra.Command{
+	Use:          "check",
+	Short:        "validate the configuration files and the dependencies of every command in the workspace without running anything",
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		conf, err := workspaces.GetConfig()
+		if err != nil {
+			return err
+		}
+		problems := append(conf.Check(), runners.CheckGraph(conf)...)
+		for _, problem := range problems {
+			fmt.Fprintln(cmd.ErrOrStderr(), problem)
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("found %d problems in the workspace", len(problems))
+		}
+		log.Info().Msg("the workspace is valid")
+		return nil
+	},
+}
+
+var schemaWsCMD = &cobra.Command{
+	Use:   "schema",
+	Short: "print the JSON Schema of workspace.conf and harbor.conf, for editors to validate them with",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schema, err := workspaces.JSONSchema()
+		if err != nil {
+			return err
+		}
+		_, err = cmd.OutOrStdout().Write(schema)
+		return err
+	},
+}
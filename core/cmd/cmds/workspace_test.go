@@ -0,0 +1,80 @@
+package cmds
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/radding/harbor/internal/config"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/stretchr/testify/assert"
+)
+
+// useWorkspace writes files into a new workspace and makes it the working directory, without any plugins
+// installed
+func useWorkspace(t *testing.T, files map[string]string) {
+	root := t.TempDir()
+	for name, contents := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(root, name)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(root, name), []byte(contents), 0644))
+	}
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(root))
+	config.LoadConfig(t.TempDir())
+	t.Cleanup(func() {
+		os.Chdir(wd)
+		workspaces.Config = nil
+		workspaces.Strict = false
+		*strictConfig = false
+		*keepGoing = false
+	})
+}
+
+// execute runs harbor with args, returning what it wrote to stderr
+func execute(args ...string) (string, error) {
+	stderr := &bytes.Buffer{}
+	rootCmd.SetErr(stderr)
+	rootCmd.SetOut(&bytes.Buffer{})
+	rootCmd.SetArgs(append(args, "--log-level", "error"))
+	err := rootCmd.Execute()
+	return stderr.String(), err
+}
+
+func TestStrictCheckReportsEveryProblem(t *testing.T) {
+	assert := assert.New(t)
+	useWorkspace(t, map[string]string{
+		"workspace.conf": "workspace_name: ws\non_install: []\npackages:\n  - path: app\n",
+		"app/harbor.conf": `workspace_name: app
+commands:
+  build:
+    type: shell
+    command: go build
+    depends_on:
+      - test
+    conditions:
+      - docker.running
+  test:
+    type: shell
+    command: go test
+    retries: 3
+    depends_on:
+      - build
+`,
+	})
+
+	stderr, err := execute("workspace", "check", "--strict")
+
+	assert.ErrorContains(err, "found 6 problems in the workspace")
+	for _, problem := range []string{
+		`workspace.conf:2:1: unknown field "on_install"`,
+		`app/harbor.conf:13:5: unknown field "retries"`,
+		`app/harbor.conf:4:11: no installed runner plugin provides type "shell"`,
+		`app/harbor.conf:11:11: no installed runner plugin provides type "shell"`,
+		`app/harbor.conf:9:9: condition "docker.running" of build: unknown variable provider docker`,
+		"cycle detected: app:build -> app:test -> app:build",
+	} {
+		assert.Contains(stderr, problem)
+	}
+}
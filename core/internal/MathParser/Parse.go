@@ -34,6 +34,12 @@ func (o Operator) String() string {
 		return "<"
 	case OpOr:
 		return "||"
+	case OpNot:
+		return "!"
+	case OpIn:
+		return "in"
+	case OpMatch:
+		return "=~"
 	default:
 		return "not recognized"
 	}
@@ -49,6 +55,8 @@ const (
 	OpAnd
 	OpOr
 	OpNot
+	OpIn
+	OpMatch
 )
 
 var operatorMap = map[string]Operator{
@@ -61,6 +69,8 @@ var operatorMap = map[string]Operator{
 	"&&": OpAnd,
 	"||": OpOr,
 	"!":  OpNot,
+	"in": OpIn,
+	"=~": OpMatch,
 }
 
 type ComparisonError struct {
@@ -79,8 +89,8 @@ func (o *Operator) Capture(s []string) error {
 }
 
 type OpTerm struct {
-	LogicalOperator *Operator   `@( "&" "&" | "|" "|" )*`
-	RightExpr       *Expression `@@*`
+	LogicalOperator *Operator   `@( "&" "&" | "|" "|" )`
+	RightExpr       *Expression `@@`
 }
 
 func (o *OpTerm) Evaluate(lookup VariableLookUp, leftValue bool) (bool, error) {
@@ -101,10 +111,16 @@ type VariableLookUp interface {
 	GetValue(providerName, variableName string) (*Value, error)
 }
 
+// ArgumentLookUp is implemented by lookups that resolve variables taking an argument, like file.exists("go.sum")
+type ArgumentLookUp interface {
+	GetValueOf(providerName, variableName, argument string) (*Value, error)
+}
+
+// ComparisonExpression compares two values, without an operator it is a single value that has to be true or false
 type ComparisonExpression struct {
 	Left               *Value    `@@`
-	ComparisonOperator *Operator `@( "<" "=" | "=" "=" | ">" "=" | ">" | "<" | "!" "=" )`
-	Right              *Value    `@@`
+	ComparisonOperator *Operator `( @( "<" "=" | "=" "=" | ">" "=" | "=" "~" | ">" | "<" | "!" "=" | "in" )`
+	Right              *Value    `  @@ )?`
 }
 
 func (c *ComparisonExpression) Evaluate(lookup VariableLookUp) (bool, error) {
@@ -112,6 +128,9 @@ func (c *ComparisonExpression) Evaluate(lookup VariableLookUp) (bool, error) {
 	if err != nil {
 		return false, err
 	}
+	if c.ComparisonOperator == nil {
+		return leftVal.asBool()
+	}
 	rightVal, err := c.Right.Evaluate(lookup)
 	if err != nil {
 		return false, err
@@ -119,25 +138,54 @@ func (c *ComparisonExpression) Evaluate(lookup VariableLookUp) (bool, error) {
 	return leftVal.Compare(rightVal, *c.ComparisonOperator)
 }
 
+// Expression is a chain of comparisons joined by && and ||, && binds tighter than ||
 type Expression struct {
 	Left   *ComparisonExpression `@@`
 	OpTerm *OpTerm               `@@?`
 }
 
 func (e *Expression) Evaluate(lookup VariableLookUp) (bool, error) {
-	leftVal, err := e.Left.Evaluate(lookup)
-	if err != nil {
-		return false, err
+	terms := []*ComparisonExpression{e.Left}
+	operators := []Operator{}
+	for term := e.OpTerm; term != nil && term.LogicalOperator != nil && term.RightExpr != nil; term = term.RightExpr.OpTerm {
+		operators = append(operators, *term.LogicalOperator)
+		terms = append(terms, term.RightExpr.Left)
 	}
-	if e.OpTerm == nil {
-		return leftVal, nil
+	// the chain is evaluated as groups of && separated by ||, skipping what can't change the result
+	groupTrue := true
+	for i, term := range terms {
+		if groupTrue {
+			res, err := term.Evaluate(lookup)
+			if err != nil {
+				return false, err
+			}
+			groupTrue = res
+		}
+		if i == len(operators) || operators[i] == OpOr {
+			if groupTrue {
+				return true, nil
+			}
+			groupTrue = true
+		}
 	}
-	return e.OpTerm.Evaluate(lookup, leftVal)
-
+	return false, nil
 }
 
-var parser = participle.MustBuild[Expression]()
+var parser = participle.MustBuild[Expression](
+	participle.Unquote("String"),
+	participle.UseLookahead(3),
+)
+
+var valueParser = participle.MustBuild[Value](
+	participle.Unquote("String"),
+	participle.UseLookahead(3),
+)
 
 func Parse(str string) (*Expression, error) {
 	return parser.ParseString("", str)
 }
+
+// ParseValue parses a single value, like the variable or function call inside ${{ }} in a command
+func ParseValue(str string) (*Value, error) {
+	return valueParser.ParseString("", str)
+}
@@ -1,6 +1,7 @@
 package mathparser
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -11,7 +12,7 @@ func TestCanParseFine(t *testing.T) {
 	expr, err := Parse("${{env.OS}} >= \"Test\"")
 	v := &ValueLookup{
 		returns: &Value{
-			StringValue: stringPtr("\"Test\""),
+			StringValue: stringPtr("Test"),
 		},
 	}
 	v.On("GetValue", "env", "OS").Once()
@@ -19,7 +20,7 @@ func TestCanParseFine(t *testing.T) {
 	assert.Equal("env", *expr.Left.Left.Variable.Provider)
 	assert.Equal("OS", *expr.Left.Left.Variable.Value)
 	assert.Equal(OpGte, *expr.Left.ComparisonOperator)
-	assert.Equal("\"Test\"", *expr.Left.Right.StringValue)
+	assert.Equal("Test", *expr.Left.Right.StringValue)
 
 	res, err := expr.Evaluate(v)
 	assert.NoError(err)
@@ -33,7 +34,7 @@ func TestCanParseComplex(t *testing.T) {
 	assert.NoError(err)
 	v := &ValueLookup{
 		returns: &Value{
-			StringValue: stringPtr("\"Test\""),
+			StringValue: stringPtr("Test"),
 		},
 	}
 	v.On("GetValue", "env", "OS").Once()
@@ -53,3 +54,158 @@ func stringPtr(val string) *string {
 func boolPtr(val bool) *bool {
 	return &val
 }
+
+// mapLookup resolves provider.name from a map, variables that aren't in it are undefined
+type mapLookup map[string]*Value
+
+func (m mapLookup) GetValue(providerName, variableName string) (*Value, error) {
+	val, ok := m[providerName+"."+variableName]
+	if !ok {
+		return nil, fmt.Errorf("%s.%s is not defined", providerName, variableName)
+	}
+	return val, nil
+}
+
+func TestGrammar(t *testing.T) {
+	lookup := mapLookup{
+		"env.CI":      boolValue(true),
+		"env.BRANCH":  &Value{StringValue: stringPtr("release/1.2")},
+		"env.VERSION": &Value{StringValue: stringPtr("v1.10.0")},
+	}
+	cases := map[string]bool{
+		"true || false && false":                         true,
+		"(true || false) && false":                       false,
+		"false && true || true":                          true,
+		"!false":                                         true,
+		"!(1 == 1 && 2 == 2)":                            false,
+		"${{ env.CI }}":                                  true,
+		"!${{ env.CI }} || 1 > 2":                        false,
+		`${{ env.BRANCH }} == "release/1.2"`:             true,
+		`${{ env.BRANCH }} in ["main", "release/1.2"]`:   true,
+		`3 in [1, 2]`:                                    false,
+		`${{ env.BRANCH }} =~ "^release/[0-9.]+$"`:       true,
+		"exists(env.CI) && !exists(env.MISSING)":         true,
+		`contains(env.BRANCH, "ease")`:                   true,
+		`contains(["a", "b"], "c")`:                      false,
+		`startsWith(env.BRANCH, "release/")`:             true,
+		`endsWith(${{ env.BRANCH }}, "1.3")`:             false,
+		`semver_gte(env.VERSION, "1.9.3")`:               true,
+		`semver_lt(env.VERSION, "v1.10.0")`:              false,
+		`semver_gt("1.0.0", "1.0.0-rc.1")`:               true,
+		`exists(env.CI) && (1 == 2 || 2 == 2) && !false`: true,
+	}
+	for source, expected := range cases {
+		t.Run(source, func(t *testing.T) {
+			assert := assert.New(t)
+			expr, err := Parse(source)
+			assert.NoError(err)
+			res, err := expr.Evaluate(lookup)
+			assert.NoError(err)
+			assert.Equal(expected, res)
+		})
+	}
+}
+
+func TestEvaluationErrors(t *testing.T) {
+	assert := assert.New(t)
+	for _, source := range []string{
+		`"text"`,
+		`nope(1)`,
+		`contains("a")`,
+		`1 in 2`,
+		`"a" =~ "("`,
+		`semver_gte("one", "1.0.0")`,
+	} {
+		expr, err := Parse(source)
+		assert.NoError(err, source)
+		_, err = expr.Evaluate(mapLookup{})
+		assert.Error(err, source)
+	}
+	_, err := Parse("(1 == 1")
+	assert.Error(err)
+}
+
+func TestShortCircuit(t *testing.T) {
+	assert := assert.New(t)
+	expr, err := Parse("true || ${{ env.MISSING }} == 1")
+	assert.NoError(err)
+	res, err := expr.Evaluate(mapLookup{})
+	assert.NoError(err, "the right side of || isn't evaluated when the left is true")
+	assert.True(res)
+}
+
+// argLookup is a mapLookup that also resolves variables with an argument, keyed as provider.name(arg)
+type argLookup struct {
+	mapLookup
+}
+
+func (a argLookup) GetValueOf(providerName, variableName, argument string) (*Value, error) {
+	return a.GetValue(providerName, fmt.Sprintf("%s(%s)", variableName, argument))
+}
+
+func TestVariableArguments(t *testing.T) {
+	assert := assert.New(t)
+	expr, err := Parse(`${{ file.exists("go.sum") }} && !file.exists("go.work")`)
+	assert.NoError(err)
+	res, err := expr.Evaluate(argLookup{mapLookup{
+		"file.exists(go.sum)":  boolValue(true),
+		"file.exists(go.work)": boolValue(false),
+	}})
+	assert.NoError(err)
+	assert.True(res)
+
+	_, err = expr.Evaluate(mapLookup{})
+	assert.Error(err, "lookups that don't take arguments can't resolve file.exists")
+}
+
+// typeLookup knows the types of env variables, everything else is an unknown provider
+type typeLookup map[string]string
+
+func (t typeLookup) TypeOf(providerName, variableName string, hasArgument bool) (string, error) {
+	if providerName == "env" {
+		return AnyType, nil
+	}
+	typ, ok := t[providerName+"."+variableName]
+	if !ok {
+		return "", fmt.Errorf("unknown variable %s.%s", providerName, variableName)
+	}
+	return typ, nil
+}
+
+func TestCheck(t *testing.T) {
+	types := typeLookup{"args.count": NumberType, "os.name": StringType, "git.dirty": BoolType}
+	for _, source := range []string{
+		`${{ env.CI }} == "true" && args.count > 0`,
+		`os.name in ["linux", "darwin"] || !git.dirty`,
+		`exists(env.CI) && (env.A == 1 || env.B)`,
+		`os.name =~ "^lin"`,
+	} {
+		expr, err := Parse(source)
+		assert.NoError(t, err, source)
+		assert.NoError(t, expr.Check(types), source)
+	}
+
+	for source, problem := range map[string]string{
+		`args.count == "2"`:           "Can't compare",
+		`true && os.name == 1`:        "Can't compare",
+		`nope.name == 1`:              "unknown variable nope.name",
+		`os.name`:                     "not true or false",
+		`!args.count`:                 "! only negates",
+		`os.name in "linux"`:          "not a list",
+		`[1] == [1]`:                  "lists can only",
+		`nope(env.CI)`:                "unknown function",
+		`exists("text")`:              "exists takes a variable",
+		`contains(missing.value, "")`: "unknown variable",
+	} {
+		expr, err := Parse(source)
+		assert.NoError(t, err, source)
+		err = expr.Check(types)
+		if assert.Error(t, err, source) {
+			assert.Contains(t, err.Error(), problem, source)
+		}
+		var comparison ComparisonError
+		if problem == "Can't compare" {
+			assert.ErrorAs(t, err, &comparison)
+		}
+	}
+}
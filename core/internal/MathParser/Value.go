@@ -1,35 +1,74 @@
 package mathparser
 
-import "fmt"
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 type VariableDef struct {
 	Provider *string `@Ident`
 	Value    *string `"." @Ident`
+	Argument *string `( "(" @String ")" )?`
 }
 
 func (v *VariableDef) String() string {
+	if v.Argument != nil {
+		return fmt.Sprintf("%s.%s(%q)", *v.Provider, *v.Value, *v.Argument)
+	}
 	return fmt.Sprintf("%s.%s", *v.Provider, *v.Value)
 }
 
+func (v *VariableDef) Evaluate(lookup VariableLookUp) (*Value, error) {
+	if v.Argument == nil {
+		return lookup.GetValue(*v.Provider, *v.Value)
+	}
+	argLookup, ok := lookup.(ArgumentLookUp)
+	if !ok {
+		return nil, fmt.Errorf("%s can't take an argument", v)
+	}
+	return argLookup.GetValueOf(*v.Provider, *v.Value, *v.Argument)
+}
+
 type Value struct {
-	Number      *float64     `  @(Float|Int)`
-	StringValue *string      `| @(String)`
-	BoolVal     *Boolean     `| @("true" | "false")`
-	Variable    *VariableDef `| "$" "{" "{" @@ "}" "}"`
+	Not         *Value        `  "!" @@`
+	Group       *Expression   `| "(" @@ ")"`
+	List        *List         `| @@`
+	Number      *float64      `| @(Float|Int)`
+	StringValue *string       `| @(String)`
+	BoolVal     *Boolean      `| @("true" | "false")`
+	Call        *FunctionCall `| @@`
+	Variable    *VariableDef  `| "$" "{" "{" @@ "}" "}" | @@`
+}
+
+// List is a list of values, like the right side of in
+type List struct {
+	Items []*Value `"[" ( @@ ( "," @@ )* )? "]"`
 }
 
 func (v *Value) String() string {
-	if v.Number != nil {
-		return fmt.Sprintf("N(%f)", *v.Number)
-	}
-	if v.StringValue != nil {
+	switch {
+	case v.Number != nil:
+		return fmt.Sprintf("N(%s)", strconv.FormatFloat(*v.Number, 'f', -1, 64))
+	case v.StringValue != nil:
 		return fmt.Sprintf("S(%s)", *v.StringValue)
-	}
-	if *v.BoolVal {
-		if *v.BoolVal {
-			return "B(true)"
+	case v.BoolVal != nil:
+		return fmt.Sprintf("B(%t)", bool(*v.BoolVal))
+	case v.List != nil:
+		items := []string{}
+		for _, item := range v.List.Items {
+			items = append(items, item.String())
 		}
-		return "B(false)"
+		return fmt.Sprintf("L(%s)", strings.Join(items, ", "))
+	case v.Not != nil:
+		return fmt.Sprintf("!%s", v.Not)
+	case v.Group != nil:
+		return "(...)"
+	case v.Call != nil:
+		return fmt.Sprintf("%s(...)", v.Call.Name)
 	}
 	return fmt.Sprintf("E(%s)", v.Variable.String())
 }
@@ -44,10 +83,66 @@ func (v *Value) valType() string {
 	if v.StringValue != nil {
 		return "string"
 	}
+	if v.List != nil {
+		return "list"
+	}
 	return "env_var"
 }
 
+func (v *Value) asBool() (bool, error) {
+	if v.BoolVal == nil {
+		return false, fmt.Errorf("%s is not true or false", v)
+	}
+	return bool(*v.BoolVal), nil
+}
+
+// AsString is the value as the text it was written as, numbers and booleans included
+func (v *Value) AsString() (string, error) {
+	switch v.valType() {
+	case "string":
+		return *v.StringValue, nil
+	case "number":
+		return strconv.FormatFloat(*v.Number, 'f', -1, 64), nil
+	case "bool":
+		return strconv.FormatBool(bool(*v.BoolVal)), nil
+	}
+	return "", fmt.Errorf("%s is not a string", v)
+}
+
+func boolValue(b bool) *Value {
+	return &Value{BoolVal: (*Boolean)(&b)}
+}
+
 func (v *Value) Compare(v2 *Value, op Operator) (bool, error) {
+	switch op {
+	case OpIn:
+		if v2.List == nil {
+			return false, fmt.Errorf("%s is not a list", v2)
+		}
+		for _, item := range v2.List.Items {
+			if equal, err := v.Compare(item, OpEq); err == nil && equal {
+				return true, nil
+			}
+		}
+		return false, nil
+	case OpMatch:
+		str, err := v.AsString()
+		if err != nil {
+			return false, err
+		}
+		pattern, err := v2.AsString()
+		if err != nil {
+			return false, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, errors.Wrapf(err, "invalid regular expression %q", pattern)
+		}
+		return re.MatchString(str), nil
+	}
+	if v.List != nil || v2.List != nil {
+		return false, fmt.Errorf("lists can only be on the right of in")
+	}
 	if v.valType() != v2.valType() {
 		return false, ComparisonError{v1: v, v2: v2}
 	}
@@ -112,8 +207,37 @@ func (v *Value) Compare(v2 *Value, op Operator) (bool, error) {
 }
 
 func (v *Value) Evaluate(lookup VariableLookUp) (*Value, error) {
-	if v.Variable != nil {
-		return lookup.GetValue(*v.Variable.Provider, *v.Variable.Value)
+	switch {
+	case v.Variable != nil:
+		return v.Variable.Evaluate(lookup)
+	case v.Not != nil:
+		val, err := v.Not.Evaluate(lookup)
+		if err != nil {
+			return nil, err
+		}
+		b, err := val.asBool()
+		if err != nil {
+			return nil, err
+		}
+		return boolValue(!b), nil
+	case v.Group != nil:
+		b, err := v.Group.Evaluate(lookup)
+		if err != nil {
+			return nil, err
+		}
+		return boolValue(b), nil
+	case v.List != nil:
+		list := &List{Items: []*Value{}}
+		for _, item := range v.List.Items {
+			val, err := item.Evaluate(lookup)
+			if err != nil {
+				return nil, err
+			}
+			list.Items = append(list.Items, val)
+		}
+		return &Value{List: list}, nil
+	case v.Call != nil:
+		return v.Call.Evaluate(lookup)
 	}
 	return v, nil
 }
@@ -0,0 +1,127 @@
+package mathparser
+
+import (
+	"fmt"
+)
+
+// The types Check knows values to have, AnyType is a variable whose type is only known once it is resolved
+const (
+	AnyType    = ""
+	NumberType = "number"
+	StringType = "string"
+	BoolType   = "bool"
+	ListType   = "list"
+)
+
+// TypeLookUp tells the type of variables without resolving them, it fails for providers and variables that don't
+// exist
+type TypeLookUp interface {
+	TypeOf(providerName, variableName string, hasArgument bool) (string, error)
+}
+
+// Check finds the problems evaluating the expression would run into whatever the values of its variables are:
+// unknown providers and functions, and values of types that can't be compared
+func (e *Expression) Check(types TypeLookUp) error {
+	for expr := e; expr != nil; {
+		if err := expr.Left.check(types); err != nil {
+			return err
+		}
+		if expr.OpTerm == nil {
+			return nil
+		}
+		expr = expr.OpTerm.RightExpr
+	}
+	return nil
+}
+
+func (c *ComparisonExpression) check(types TypeLookUp) error {
+	left, err := c.Left.typeOf(types)
+	if err != nil {
+		return err
+	}
+	if c.ComparisonOperator == nil {
+		if left != AnyType && left != BoolType {
+			return fmt.Errorf("%s is a %s, not true or false", c.Left, left)
+		}
+		return nil
+	}
+	right, err := c.Right.typeOf(types)
+	if err != nil {
+		return err
+	}
+	switch *c.ComparisonOperator {
+	case OpIn:
+		if left == ListType {
+			return fmt.Errorf("%s is a list, it can't be in another list", c.Left)
+		}
+		if right != AnyType && right != ListType {
+			return fmt.Errorf("%s is not a list", c.Right)
+		}
+		return nil
+	case OpMatch:
+		if left == ListType || right == ListType {
+			return fmt.Errorf("=~ matches text, not lists")
+		}
+		return nil
+	}
+	if left == ListType || right == ListType {
+		return fmt.Errorf("lists can only be on the right of in")
+	}
+	if left != AnyType && right != AnyType && left != right {
+		return ComparisonError{v1: c.Left, v2: c.Right}
+	}
+	return nil
+}
+
+func (v *Value) typeOf(types TypeLookUp) (string, error) {
+	switch {
+	case v.Number != nil:
+		return NumberType, nil
+	case v.StringValue != nil:
+		return StringType, nil
+	case v.BoolVal != nil:
+		return BoolType, nil
+	case v.List != nil:
+		for _, item := range v.List.Items {
+			if _, err := item.typeOf(types); err != nil {
+				return "", err
+			}
+		}
+		return ListType, nil
+	case v.Not != nil:
+		t, err := v.Not.typeOf(types)
+		if err != nil {
+			return "", err
+		}
+		if t != AnyType && t != BoolType {
+			return "", fmt.Errorf("%s is a %s, ! only negates true or false", v.Not, t)
+		}
+		return BoolType, nil
+	case v.Group != nil:
+		return BoolType, v.Group.Check(types)
+	case v.Call != nil:
+		return v.Call.typeOf(types)
+	}
+	return types.TypeOf(*v.Variable.Provider, *v.Variable.Value, v.Variable.Argument != nil)
+}
+
+// typeOf checks the function exists and is called with the right number of arguments, every function returns true
+// or false
+func (f *FunctionCall) typeOf(types TypeLookUp) (string, error) {
+	fn, ok := functions[f.Name]
+	if !ok {
+		return "", fmt.Errorf("unknown function %s", f.Name)
+	}
+	if len(f.Args) != fn.args {
+		return "", fmt.Errorf("%s takes %d arguments, got %d", f.Name, fn.args, len(f.Args))
+	}
+	if f.Name == "exists" && f.Args[0].Variable == nil {
+		return "", fmt.Errorf("exists takes a variable, got %s", f.Args[0])
+	}
+	for _, arg := range f.Args {
+		if _, err := arg.typeOf(types); err != nil {
+			return "", err
+		}
+	}
+	return BoolType, nil
+}
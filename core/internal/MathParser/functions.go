@@ -0,0 +1,160 @@
+package mathparser
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// FunctionCall is a call of one of the built in functions, like exists(env.CI)
+type FunctionCall struct {
+	Name string   `@Ident "("`
+	Args []*Value `( @@ ( "," @@ )* )? ")"`
+}
+
+type function struct {
+	args int
+	call func(lookup VariableLookUp, args []*Value) (*Value, error)
+}
+
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"exists":     {args: 1, call: exists},
+		"contains":   {args: 2, call: stringFunction(strings.Contains)},
+		"startsWith": {args: 2, call: stringFunction(strings.HasPrefix)},
+		"endsWith":   {args: 2, call: stringFunction(strings.HasSuffix)},
+		"semver_gte": {args: 2, call: semverFunction(func(c int) bool { return c >= 0 })},
+		"semver_gt":  {args: 2, call: semverFunction(func(c int) bool { return c > 0 })},
+		"semver_lte": {args: 2, call: semverFunction(func(c int) bool { return c <= 0 })},
+		"semver_lt":  {args: 2, call: semverFunction(func(c int) bool { return c < 0 })},
+	}
+}
+
+func (f *FunctionCall) Evaluate(lookup VariableLookUp) (*Value, error) {
+	fn, ok := functions[f.Name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", f.Name)
+	}
+	if len(f.Args) != fn.args {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", f.Name, fn.args, len(f.Args))
+	}
+	return fn.call(lookup, f.Args)
+}
+
+// exists is whether its argument, a variable, is defined
+func exists(lookup VariableLookUp, args []*Value) (*Value, error) {
+	if args[0].Variable == nil {
+		return nil, fmt.Errorf("exists takes a variable, got %s", args[0])
+	}
+	val, err := args[0].Evaluate(lookup)
+	return boolValue(err == nil && val != nil), nil
+}
+
+func evaluateStrings(lookup VariableLookUp, args []*Value) ([]string, error) {
+	strs := []string{}
+	for _, arg := range args {
+		val, err := arg.Evaluate(lookup)
+		if err != nil {
+			return nil, err
+		}
+		str, err := val.AsString()
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+// stringFunction calls test with its two arguments as strings, contains also looks for a value in a list
+func stringFunction(test func(s, substr string) bool) func(VariableLookUp, []*Value) (*Value, error) {
+	return func(lookup VariableLookUp, args []*Value) (*Value, error) {
+		haystack, err := args[0].Evaluate(lookup)
+		if err != nil {
+			return nil, err
+		}
+		if haystack.List != nil {
+			needle, err := args[1].Evaluate(lookup)
+			if err != nil {
+				return nil, err
+			}
+			found, err := needle.Compare(haystack, OpIn)
+			return boolValue(found), err
+		}
+		strs, err := evaluateStrings(lookup, args)
+		if err != nil {
+			return nil, err
+		}
+		return boolValue(test(strs[0], strs[1])), nil
+	}
+}
+
+func semverFunction(test func(comparison int) bool) func(VariableLookUp, []*Value) (*Value, error) {
+	return func(lookup VariableLookUp, args []*Value) (*Value, error) {
+		strs, err := evaluateStrings(lookup, args)
+		if err != nil {
+			return nil, err
+		}
+		comparison, err := compareSemver(strs[0], strs[1])
+		if err != nil {
+			return nil, err
+		}
+		return boolValue(test(comparison)), nil
+	}
+}
+
+// compareSemver returns -1, 0 or 1 when version a is older, the same or newer than version b. A leading v, missing
+// minor and patch versions and build metadata are allowed, pre-releases are older than the release and compared
+// as text.
+func compareSemver(a, b string) (int, error) {
+	parse := func(version string) ([3]int, string, error) {
+		parts := [3]int{}
+		version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+		version = strings.SplitN(version, "+", 2)[0]
+		release, pre := version, ""
+		if i := strings.Index(version, "-"); i >= 0 {
+			release, pre = version[:i], version[i+1:]
+		}
+		numbers := strings.Split(release, ".")
+		if len(numbers) > 3 {
+			return parts, "", errors.Errorf("%s is not a semantic version", version)
+		}
+		for i, number := range numbers {
+			n, err := strconv.Atoi(number)
+			if err != nil || n < 0 {
+				return parts, "", errors.Errorf("%s is not a semantic version", version)
+			}
+			parts[i] = n
+		}
+		return parts, pre, nil
+	}
+	aParts, aPre, err := parse(a)
+	if err != nil {
+		return 0, err
+	}
+	bParts, bPre, err := parse(b)
+	if err != nil {
+		return 0, err
+	}
+	for i := range aParts {
+		if aParts[i] != bParts[i] {
+			if aParts[i] < bParts[i] {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	}
+	switch {
+	case aPre == bPre:
+		return 0, nil
+	case aPre == "":
+		return 1, nil
+	case bPre == "":
+		return -1, nil
+	}
+	return strings.Compare(aPre, bPre), nil
+}
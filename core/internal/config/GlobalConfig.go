@@ -6,10 +6,12 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
 	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor-plugins/proto"
 	"github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v3"
 )
@@ -30,6 +32,17 @@ type Plugin struct {
 	PluginLocation string `yaml:"plugin_location"`
 	IsActive       bool   `yaml:"is_active"`
 	SettingsPath   string `yaml:"settings_path"`
+	// Capabilities are the names of what the plugin reported it can do when it was installed
+	Capabilities []string `yaml:"capabilities"`
+}
+
+func (p Plugin) Provides(capability proto.PluginCapabilities) bool {
+	for _, c := range p.Capabilities {
+		if c == capability.String() {
+			return true
+		}
+	}
+	return false
 }
 
 type AuthSchemes string
@@ -165,6 +178,53 @@ func (g *GlobalConfig) GetPlugin(name string) (plugins.PluginClient, error) {
 	return pl, nil
 }
 
+// ProvidersOf returns the sorted names of the active plugins with capability. Plugins installed before their
+// capabilities were recorded are asked for them once.
+func (g *GlobalConfig) ProvidersOf(capability proto.PluginCapabilities) []string {
+	names := []string{}
+	for name, plugin := range g.Plugins {
+		if !plugin.IsActive {
+			continue
+		}
+		if plugin.Capabilities == nil {
+			plugin = g.recordCapabilities(name)
+		}
+		if plugin.Provides(capability) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (g *GlobalConfig) recordCapabilities(name string) Plugin {
+	plugin := g.Plugins[name]
+	client, err := g.GetPlugin(name)
+	if err != nil {
+		log.Warn().Err(err).Msgf("can't load plugin %s", name)
+		return plugin
+	}
+	def, err := client.Install()
+	if err != nil {
+		log.Warn().Err(err).Msgf("can't get the capabilities of plugin %s", name)
+		return plugin
+	}
+	plugin.Capabilities = CapabilityNames(def.Capabilities)
+	g.Plugins[name] = plugin
+	if err := g.Save(); err != nil {
+		log.Debug().Err(err).Msg("can't save the capabilities of the plugins")
+	}
+	return plugin
+}
+
+func CapabilityNames(capabilities []proto.PluginCapabilities) []string {
+	names := []string{}
+	for _, c := range capabilities {
+		names = append(names, c.String())
+	}
+	return names
+}
+
 func (g *GlobalConfig) KillAllPlugins() {
 	for _, pl := range g.plugins {
 		pl.Kill()
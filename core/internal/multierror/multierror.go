@@ -0,0 +1,29 @@
+package multierror
+
+import "strings"
+
+// Errors are several errors reported together, in the order they happened
+type Errors []error
+
+func (e Errors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Append adds newErr after the errors already in err. A nil newErr is ignored and a single error is
+// returned as it is.
+func Append(err error, newErr error) error {
+	if newErr == nil {
+		return err
+	}
+	if err == nil {
+		return newErr
+	}
+	if errs, ok := err.(Errors); ok {
+		return append(errs[:len(errs):len(errs)], newErr)
+	}
+	return Errors{err, newErr}
+}
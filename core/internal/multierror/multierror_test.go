@@ -0,0 +1,29 @@
+package multierror
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendKeepsTheOrder(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(Append(nil, nil))
+	first := fmt.Errorf("first")
+	assert.Equal(first, Append(nil, first))
+	assert.Equal(first, Append(first, nil))
+
+	err := Append(Append(Append(nil, first), fmt.Errorf("second")), fmt.Errorf("third"))
+	assert.Equal("first\nsecond\nthird", err.Error())
+	assert.Len(err, 3)
+}
+
+func TestAppendDoesNotShareErrors(t *testing.T) {
+	assert := assert.New(t)
+	base := Append(fmt.Errorf("first"), fmt.Errorf("second"))
+	left := Append(base, fmt.Errorf("left"))
+	right := Append(base, fmt.Errorf("right"))
+	assert.Equal("first\nsecond\nleft", left.Error())
+	assert.Equal("first\nsecond\nright", right.Error())
+}
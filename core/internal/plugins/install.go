@@ -29,6 +29,7 @@ func InstallPlugin(pluginURL string) (config.Plugin, error) {
 		return pluginConf, errors.Wrap(err, "can't install plugin")
 	}
 	pluginConf.Name = conf.Name
+	pluginConf.Capabilities = config.CapabilityNames(conf.Capabilities)
 	return pluginConf, err
 }
 
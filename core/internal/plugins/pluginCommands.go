@@ -0,0 +1,148 @@
+package plugins
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor-plugins/proto"
+	"github.com/radding/harbor/internal/config"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+type commandRunner interface {
+	RunCommand(*plugins.HandleCommandRequest, plugins.CommandHandler) error
+}
+
+// MountPluginCommands adds the command tree of every active plugin that provides commands to root.
+// Plugins that fail to load are skipped so they can't break the rest of the CLI.
+func MountPluginCommands(root *cobra.Command) {
+	conf := config.Get()
+	for _, name := range conf.ProvidersOf(proto.PluginCapabilities_COMMAND_PROVIDER) {
+		client, err := conf.GetPlugin(name)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't load commands of plugin %s", name)
+			continue
+		}
+		def, err := client.RegisterCommand()
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't load commands of plugin %s", name)
+			continue
+		}
+		cmd := newPluginCommand(client, (*proto.RegisterCommandResponse)(def), nil)
+		if existing, _, err := root.Find([]string{cmd.Name()}); err == nil && existing != root {
+			log.Warn().Msgf("plugin %s provides the command %s, which already exists", name, cmd.Name())
+			continue
+		}
+		root.AddCommand(cmd)
+	}
+}
+
+func newPluginCommand(client commandRunner, def *proto.RegisterCommandResponse, parentPath []string) *cobra.Command {
+	main := def.GetMainCommand()
+	cmd := &cobra.Command{
+		Use:          main.GetUse(),
+		Aliases:      main.GetAliases(),
+		SuggestFor:   main.GetSuggestFor(),
+		Short:        main.GetShortDescription(),
+		Long:         main.GetLongDescription(),
+		Example:      main.GetExample(),
+		SilenceUsage: true,
+	}
+	commandPath := append(append([]string{}, parentPath...), cmd.Name())
+	flagNames := []string{}
+	for _, flag := range main.GetFlags() {
+		if addFlag(cmd, flag) {
+			flagNames = append(flagNames, flag.FlagName)
+		}
+	}
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		flags := map[string]string{}
+		for _, name := range flagNames {
+			flags[name] = cmd.Flags().Lookup(name).Value.String()
+		}
+		return client.RunCommand(&plugins.HandleCommandRequest{
+			Args:        args,
+			CommandPath: commandPath,
+			Flags:       flags,
+		}, &cliHandler{
+			cmd: cmd,
+			in:  bufio.NewReader(cmd.InOrStdin()),
+			out: cmd.OutOrStdout(),
+		})
+	}
+	for _, child := range def.GetChildren() {
+		cmd.AddCommand(newPluginCommand(client, child, commandPath))
+	}
+	return cmd
+}
+
+func addFlag(cmd *cobra.Command, flag *proto.Flag) bool {
+	if flag.FlagName == "" || cmd.Flags().Lookup(flag.FlagName) != nil {
+		log.Warn().Msgf("command %s has a flag without a name or with a duplicate name, ignoring it", cmd.Name())
+		return false
+	}
+	shorthand := flag.ShortFlagType
+	if len(shorthand) != 1 || cmd.Flags().ShorthandLookup(shorthand) != nil {
+		shorthand = ""
+	}
+	switch flag.Type {
+	case proto.FlagType_NUMBER:
+		cmd.Flags().Float64P(flag.FlagName, shorthand, float64(flag.DefaultNumber), flag.Usage)
+	case proto.FlagType_BOOLEAN:
+		cmd.Flags().BoolP(flag.FlagName, shorthand, flag.DefaultBool, flag.Usage)
+	default:
+		cmd.Flags().StringP(flag.FlagName, shorthand, flag.DefaultString, flag.Usage)
+	}
+	return true
+}
+
+// cliHandler shows what a plugin command sends back on the terminal
+type cliHandler struct {
+	cmd *cobra.Command
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (c *cliHandler) Log(level plugins.LogLevel, message string) {
+	log.WithLevel(zerologLevel(level)).Msg(message)
+}
+
+func (c *cliHandler) Input(prompt string) (string, error) {
+	fmt.Fprint(c.out, prompt)
+	answer, err := c.in.ReadString('\n')
+	if err == io.EOF && answer != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "can't read answer")
+	}
+	return strings.TrimRight(answer, "\r\n"), nil
+}
+
+func (c *cliHandler) Help() {
+	c.cmd.Help()
+}
+
+func zerologLevel(level plugins.LogLevel) zerolog.Level {
+	switch level {
+	case plugins.LogTrace:
+		return zerolog.TraceLevel
+	case plugins.LogDebug:
+		return zerolog.DebugLevel
+	case plugins.LogWarn:
+		return zerolog.WarnLevel
+	case plugins.LogError:
+		return zerolog.ErrorLevel
+	case plugins.LogFatal:
+		// a plugin can't end harbor, it reports the failure through the command's error instead
+		return zerolog.ErrorLevel
+	default:
+		return zerolog.InfoLevel
+	}
+}
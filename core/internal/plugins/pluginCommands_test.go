@@ -0,0 +1,60 @@
+package plugins
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor-plugins/proto"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// promptingRunner records the request and asks the user one question
+type promptingRunner struct {
+	req    *plugins.HandleCommandRequest
+	answer string
+}
+
+func (p *promptingRunner) RunCommand(req *plugins.HandleCommandRequest, handler plugins.CommandHandler) error {
+	p.req = req
+	answer, err := handler.Input("name? ")
+	p.answer = answer
+	return err
+}
+
+func TestPluginCommandsAreMounted(t *testing.T) {
+	assert := assert.New(t)
+	runner := &promptingRunner{}
+	def := &proto.RegisterCommandResponse{
+		MainCommand: &proto.CLICommand{
+			Use:              "deploy",
+			Aliases:          []string{"d"},
+			ShortDescription: "Deploy things",
+		},
+		Children: []*proto.RegisterCommandResponse{{
+			MainCommand: &proto.CLICommand{
+				Use: "app <name>",
+				Flags: []*proto.Flag{
+					{Type: proto.FlagType_STRING, FlagName: "env", ShortFlagType: "e", DefaultString: "dev"},
+					{Type: proto.FlagType_BOOLEAN, FlagName: "dry-run"},
+					{Type: proto.FlagType_NUMBER, FlagName: "replicas", DefaultNumber: 1},
+				},
+			},
+		}},
+	}
+	root := &cobra.Command{Use: "harbor"}
+	root.AddCommand(newPluginCommand(runner, def, nil))
+	out := &bytes.Buffer{}
+	root.SetOut(out)
+	root.SetIn(strings.NewReader("harbor\n"))
+	root.SetArgs([]string{"d", "app", "web", "-e", "prod", "--dry-run"})
+
+	assert.NoError(root.Execute())
+	assert.Equal([]string{"deploy", "app"}, runner.req.CommandPath)
+	assert.Equal([]string{"web"}, runner.req.Args)
+	assert.Equal(map[string]string{"env": "prod", "dry-run": "true", "replicas": "1"}, runner.req.Flags)
+	assert.Equal("harbor", runner.answer)
+	assert.Equal("name? ", out.String())
+}
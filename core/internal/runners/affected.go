@@ -0,0 +1,54 @@
+package runners
+
+// affectedSteps walks the reverse edges of the graph under root, starting at the steps of the changed packages, and
+// returns every step that belongs to a changed package or transitively needs one that does
+func affectedSteps(root *RunRecipe, changed map[string]bool) visitedSet {
+	neededBy := map[string][]*RunRecipe{}
+	start := []*RunRecipe{}
+	visited := make(visitedSet)
+	var collect func(r *RunRecipe)
+	collect = func(r *RunRecipe) {
+		if visited.Has(r) {
+			return
+		}
+		visited.Add(r)
+		if changed[r.Pkg] {
+			start = append(start, r)
+		}
+		for _, dep := range r.Needs {
+			neededBy[dep.HashKey()] = append(neededBy[dep.HashKey()], r)
+			collect(dep)
+		}
+	}
+	collect(root)
+
+	affected := make(visitedSet)
+	for len(start) > 0 {
+		r := start[0]
+		start = start[1:]
+		if affected.Has(r) {
+			continue
+		}
+		affected.Add(r)
+		start = append(start, neededBy[r.HashKey()]...)
+	}
+	return affected
+}
+
+// pruneUnaffected drops the steps of root that no change affects and reports whether anything is left to run.
+// The steps that are kept still run everything they need, cached or not.
+func pruneUnaffected(root *RunRecipe, changed map[string]bool) bool {
+	affected := affectedSteps(root, changed)
+	if root.runConfig != nil {
+		// root is a command of the workspace itself, it either runs with everything it needs or not at all
+		return affected.Has(root)
+	}
+	needs := []*RunRecipe{}
+	for _, dep := range root.Needs {
+		if affected.Has(dep) {
+			needs = append(needs, dep)
+		}
+	}
+	root.Needs = needs
+	return len(needs) > 0
+}
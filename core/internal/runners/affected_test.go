@@ -0,0 +1,32 @@
+package runners
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnlyAffectedStepsAreKept(t *testing.T) {
+	assert := assert.New(t)
+	needs := func(changed ...string) []string {
+		recipe, err := getRootRecipe("command1", defaultConf)
+		assert.NoError(err)
+		changedPackages := map[string]bool{}
+		for _, pkg := range changed {
+			changedPackages[pkg] = true
+		}
+		anythingToRun := pruneUnaffected(recipe, changedPackages)
+		keys := []string{}
+		for _, dep := range recipe.Needs {
+			keys = append(keys, dep.HashKey())
+		}
+		assert.Equal(len(keys) > 0, anythingToRun)
+		return keys
+	}
+
+	assert.Equal([]string{"subPackageB:command1"}, needs("subPackageC"))
+	assert.Equal([]string{"subPackageA:command1"}, needs("subPackageA"))
+	assert.ElementsMatch([]string{"subPackageA:command1", "subPackageB:command1"}, needs("subPackageA", "subPackageB"))
+	assert.Empty(needs())
+	assert.Empty(needs("Root"))
+}
@@ -0,0 +1,233 @@
+package runners
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor/internal/multierror"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/rs/zerolog/log"
+)
+
+// cacheListing is an entry of one of the cache tiers
+type cacheListing struct {
+	cache string
+	entry *plugins.CacheEntry
+}
+
+func getCachePlugins() ([]workspaces.CachePlugin, string, error) {
+	rootConf, err := workspaces.GetConfig()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "error getting workspace config")
+	}
+	cachers, err := rootConf.GetCachers()
+	if err != nil {
+		log.Warn().Msgf("error getting caching plugins: %s. Using the caches that loaded", err.Error())
+	}
+	if len(cachers) == 0 {
+		return nil, "", fmt.Errorf("no caching plugin loaded")
+	}
+	return cachers, rootConf.GetLocalCacheDir(), nil
+}
+
+// ListCache writes a table of the entries of every cache tier that supports listing
+func ListCache(out io.Writer) error {
+	cachers, localCacheDir, err := getCachePlugins()
+	if err != nil {
+		return err
+	}
+	listings := []cacheListing{}
+	for _, cache := range cachers {
+		entries, err := cache.Client.ListCache(localCacheDir)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't list cache %s", cache.Provider)
+			continue
+		}
+		for _, entry := range entries {
+			listings = append(listings, cacheListing{cache: cache.Provider, entry: entry})
+		}
+	}
+	return writeCacheListings(out, listings, time.Now())
+}
+
+func writeCacheListings(w io.Writer, listings []cacheListing, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CACHE\tKEY\tPACKAGE\tCOMMAND\tSIZE\tAGE\tLAST USED")
+	var total int64
+	for _, l := range listings {
+		total += l.entry.SizeBytes
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			l.cache,
+			l.entry.CacheKey,
+			l.entry.PackageName,
+			l.entry.CommandName,
+			formatSize(l.entry.SizeBytes),
+			formatAge(now.Sub(time.Unix(l.entry.CreatedAt, 0))),
+			formatAge(now.Sub(time.Unix(l.entry.LastUsedAt, 0))),
+		)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d entries, %s\n", len(listings), formatSize(total))
+	return err
+}
+
+// ShowCache replays the logs of the entry with cacheKey and lists its artifacts, using the first tier that has
+// it. The entry is only peeked at, so looking doesn't keep it from being pruned.
+func ShowCache(cacheKey string, out io.Writer) error {
+	cachers, localCacheDir, err := getCachePlugins()
+	if err != nil {
+		return err
+	}
+	return showCache(cachers, localCacheDir, cacheKey, out)
+}
+
+func showCache(cachers []workspaces.CachePlugin, localCacheDir string, cacheKey string, out io.Writer) error {
+	for _, cache := range cachers {
+		ch, hit, err := cache.Client.PeekCache(cacheKey, localCacheDir)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't read cache %s", cache.Provider)
+			continue
+		}
+		if !hit {
+			continue
+		}
+		artifacts := []string{}
+		fmt.Fprintf(out, "Logs of %s from %s:\n", cacheKey, cache.Provider)
+		for item := range ch {
+			if item.LogItem != "" {
+				fmt.Fprintln(out, item.LogItem)
+			}
+			if item.ArtifactName != "" {
+				artifacts = append(artifacts, item.ArtifactName)
+			}
+		}
+		fmt.Fprintf(out, "Artifacts (%d):\n", len(artifacts))
+		for _, artifact := range artifacts {
+			fmt.Fprintf(out, "  %s\n", artifact)
+		}
+		return nil
+	}
+	return fmt.Errorf("cache key %s not found", cacheKey)
+}
+
+// PruneCache removes entries unused for longer than olderThan, then the least recently used entries until
+// each cache is at most maxSize bytes. Zero disables either limit. Read only caches are left alone.
+func PruneCache(olderThan time.Duration, maxSize int64, out io.Writer) error {
+	if olderThan <= 0 && maxSize <= 0 {
+		return fmt.Errorf("nothing to prune by, the age and size limits are both zero")
+	}
+	return pruneCaches(&plugins.PruneRequest{
+		OlderThanSeconds: int64(olderThan.Seconds()),
+		MaxSizeBytes:     maxSize,
+	}, out)
+}
+
+// CleanCache removes every entry of every cache that isn't read only
+func CleanCache(out io.Writer) error {
+	return pruneCaches(&plugins.PruneRequest{All: true}, out)
+}
+
+func pruneCaches(req *plugins.PruneRequest, out io.Writer) error {
+	cachers, localCacheDir, err := getCachePlugins()
+	if err != nil {
+		return err
+	}
+	req.LocalCacheDirectory = localCacheDir
+	var pruneErr error
+	for _, cache := range cachers {
+		if cache.ReadOnly {
+			log.Info().Msgf("cache %s is read only, leaving it alone", cache.Provider)
+			continue
+		}
+		resp, err := cache.Client.PruneCache(req)
+		if err != nil {
+			pruneErr = multierror.Append(pruneErr, errors.Wrapf(err, "cache %s", cache.Provider))
+			continue
+		}
+		fmt.Fprintf(out, "%s: removed %d entries, freed %s\n", cache.Provider, len(resp.RemovedKeys), formatSize(resp.FreedBytes))
+	}
+	return pruneErr
+}
+
+var sizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses sizes like 5GB, 500MB or 1024, units are powers of 1024
+func ParseSize(size string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(size))
+	multiplier := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected something like 5GB or 500MB", size)
+	}
+	return int64(parsed * float64(multiplier)), nil
+}
+
+func formatSize(size int64) string {
+	for _, unit := range sizeUnits {
+		if size >= unit.bytes && unit.bytes > 1 {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(unit.bytes), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// ParseAge parses ages like 7d or 2w as well as anything time.ParseDuration understands
+func ParseAge(age string) (time.Duration, error) {
+	age = strings.TrimSpace(age)
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+	}
+	for suffix, unit := range units {
+		if !strings.HasSuffix(age, suffix) {
+			continue
+		}
+		count, err := strconv.ParseFloat(strings.TrimSuffix(age, suffix), 64)
+		if err != nil || count < 0 {
+			return 0, fmt.Errorf("invalid age %q, expected something like 7d or 12h", age)
+		}
+		return time.Duration(count * float64(unit)), nil
+	}
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid age %q, expected something like 7d or 12h", age)
+	}
+	return duration, nil
+}
+
+func formatAge(age time.Duration) string {
+	switch {
+	case age >= 24*time.Hour:
+		return fmt.Sprintf("%dd", int(age.Hours()/24))
+	case age >= time.Hour:
+		return fmt.Sprintf("%dh", int(age.Hours()))
+	case age >= time.Minute:
+		return fmt.Sprintf("%dm", int(age.Minutes()))
+	default:
+		return fmt.Sprintf("%ds", int(age.Seconds()))
+	}
+}
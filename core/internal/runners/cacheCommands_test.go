@@ -0,0 +1,97 @@
+package runners
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSize(t *testing.T) {
+	assert := assert.New(t)
+	for input, expected := range map[string]int64{
+		"5GB":    5 << 30,
+		"500MB":  500 << 20,
+		"1.5kb":  1536,
+		"1024":   1024,
+		"10 B":   10,
+		"0.5 TB": 1 << 39,
+	} {
+		size, err := ParseSize(input)
+		assert.NoError(err, input)
+		assert.Equal(expected, size, input)
+	}
+	_, err := ParseSize("lots")
+	assert.Error(err)
+	_, err = ParseSize("-5GB")
+	assert.Error(err)
+}
+
+func TestParseAge(t *testing.T) {
+	assert := assert.New(t)
+	for input, expected := range map[string]time.Duration{
+		"7d":  7 * 24 * time.Hour,
+		"2w":  14 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+		"90m": 90 * time.Minute,
+	} {
+		age, err := ParseAge(input)
+		assert.NoError(err, input)
+		assert.Equal(expected, age, input)
+	}
+	_, err := ParseAge("yesterday")
+	assert.Error(err)
+}
+
+func TestWriteCacheListings(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(1700000000, 0)
+	out := &bytes.Buffer{}
+	err := writeCacheListings(out, []cacheListing{
+		{cache: "local_cache", entry: &plugins.CacheEntry{
+			CacheKey:    "abc123",
+			PackageName: "core",
+			CommandName: "build",
+			SizeBytes:   3 << 20,
+			CreatedAt:   now.Add(-72 * time.Hour).Unix(),
+			LastUsedAt:  now.Add(-2 * time.Hour).Unix(),
+		}},
+	}, now)
+	assert.NoError(err)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(lines, 3)
+	assert.Equal([]string{"CACHE", "KEY", "PACKAGE", "COMMAND", "SIZE", "AGE", "LAST", "USED"}, strings.Fields(lines[0]))
+	assert.Equal([]string{"local_cache", "abc123", "core", "build", "3.0MB", "3d", "2h"}, strings.Fields(lines[1]))
+	assert.Equal("1 entries, 3.0MB", lines[2])
+}
+
+func TestShowCachePeeksAtTheFirstTierWithTheKey(t *testing.T) {
+	assert := assert.New(t)
+	empty := newMemoryCache(t)
+	full := newMemoryCache(t)
+	full.entries["key"] = []plugins.CacheItem{
+		{LogItem: "line one"},
+		{ArtifactPath: "/cache/abc", ArtifactName: "bin/plugin"},
+	}
+	cachers := []workspaces.CachePlugin{
+		{Provider: "local_cache", Client: empty},
+		{Provider: "http_cache", Client: full},
+	}
+
+	out := &bytes.Buffer{}
+	assert.NoError(showCache(cachers, t.TempDir(), "key", out))
+	assert.Equal("Logs of key from http_cache:\nline one\nArtifacts (1):\n  bin/plugin\n", out.String())
+	assert.Equal([]string{"key"}, empty.peeked)
+	assert.Equal([]string{"key"}, full.peeked)
+	assert.Empty(full.released, "peeks restore nothing")
+
+	assert.ErrorContains(showCache(cachers, t.TempDir(), "missing", out), "not found")
+}
+
+func TestPruneNeedsALimit(t *testing.T) {
+	assert.ErrorContains(t, PruneCache(0, 0, &bytes.Buffer{}), "nothing to prune by")
+}
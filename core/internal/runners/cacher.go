@@ -2,9 +2,14 @@ package runners
 
 import (
 	"bufio"
+	"encoding/json"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 	plugins "github.com/radding/harbor-plugins"
@@ -18,25 +23,35 @@ type Cacher interface {
 	// triggering a new run
 	CalculateCacheKey(r *RunRecipe, additionalData ...string) (string, error)
 	// ReplayCachedLogs looks in our cache for entries with cache key and attempts to write those log contents into
-	// w. Returns true if the logs were found in the cache, false otherwise.
-	ReplayCachedLogs(cacheKey string, w io.Writer) (bool, error)
-	// WriteLogsToCache takes a cacheKey and reads data from r to write the logs to a file in our cache directory
-	WriteLogsToCache(cacheKey string, r io.Reader) error
+	// w. Cached artifacts are restored relative to restoreTo, unless it is empty. Returns true if the logs were
+	// found in the cache, false otherwise.
+	ReplayCachedLogs(cacheKey string, w io.Writer, restoreTo string) (bool, error)
+	// IsCached tells whether the cache has an entry for cacheKey without replaying it, so looking doesn't change
+	// the cache
+	IsCached(cacheKey string) (bool, error)
+	// WriteLogsToCache takes a cacheKey and reads data from r to write the logs to a file in our cache directory,
+	// along with any artifacts the step produced
+	WriteLogsToCache(cacheKey string, r io.Reader, artifacts ...plugins.CacheItem) error
 }
 
 type cacher struct {
-	packageToHashKey map[string]string
-	cacherClient     plugins.PluginClient
-	localCacheDir    string
-	// dirToHashKey     map[string]string
+	// stepToHashKey memoizes cache keys by step and additional data, steps are keyed concurrently so it
+	// is guarded by lock
+	stepToHashKey map[string]string
+	// keyMetadata remembers the step each key was calculated for, so entries can be labeled when written
+	keyMetadata   map[string]plugins.CacheMetadata
+	lock          *sync.Mutex
+	cacherClient  plugins.PluginClient
+	localCacheDir string
 }
 
 func newCacher(plugin plugins.PluginClient, localCacheDir string) Cacher {
 	return &cacher{
-		packageToHashKey: map[string]string{},
-		cacherClient:     plugin,
-		localCacheDir:    localCacheDir,
-		// dirToHashKey:     map[string]string{},
+		stepToHashKey: map[string]string{},
+		keyMetadata:   map[string]plugins.CacheMetadata{},
+		lock:          &sync.Mutex{},
+		cacherClient:  plugin,
+		localCacheDir: localCacheDir,
 	}
 }
 
@@ -52,16 +67,17 @@ func (c *cacher) calculateCacheKey(r *RunRecipe, additionalData []string, fileOp
 	if c.cacherClient == nil {
 		return "", nil
 	}
-	hashKey, ok := c.packageToHashKey[r.pkgObject.Name]
+	memoKey := strings.Join(append([]string{r.HashKey()}, additionalData...), "\x00")
+	c.lock.Lock()
+	hashKey, ok := c.stepToHashKey[memoKey]
+	c.lock.Unlock()
 	if ok {
 		return hashKey, nil
 	}
-	deps := r.Needs[:]
-	// Sort the deps so its stable every time
+	// Sort a copy of the deps so its stable every time without reordering the graph
+	deps := append([]*RunRecipe{}, r.Needs...)
 	sort.Slice(deps, func(i, j int) bool {
-		depI := r.Needs[i]
-		depJ := r.Needs[j]
-		return depI.HashKey() > depJ.HashKey()
+		return deps[i].HashKey() > deps[j].HashKey()
 	})
 	childKeys := []string{}
 	for _, dep := range deps {
@@ -72,66 +88,219 @@ func (c *cacher) calculateCacheKey(r *RunRecipe, additionalData []string, fileOp
 		childKeys = append(childKeys, childKey)
 	}
 
-	hashKey, err := c.cacherClient.GetCacheKey(r.pkgObject.WorkspaceRoot(), childKeys, additionalData)
+	stepData, err := cacheKeyData(r, additionalData)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't get cache key data of %s", r.HashKey())
+	}
+	hashKey, err = c.cacherClient.GetCacheKey(c.cacheKeyRequest(r, childKeys, append(stepData, additionalData...)))
 	if err != nil {
 		return "", errors.Wrap(err, "can't get cache key")
 	}
+	c.lock.Lock()
+	c.stepToHashKey[memoKey] = hashKey
+	c.lock.Unlock()
+	c.remember(hashKey, r)
 	return hashKey, nil
 }
 
-func (c *cacher) ReplayCachedLogs(cacheKey string, w io.Writer) (bool, error) {
+func (c *cacher) remember(cacheKey string, r *RunRecipe) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.keyMetadata[cacheKey] = plugins.CacheMetadata{
+		PackageName: r.Pkg,
+		CommandName: r.CommandName,
+	}
+}
+
+// cacheKeyData is everything about the step itself that changes what it does: which step it is, the
+// command, the runner and its options with their variables resolved for args, the environment it declares
+// and the values of the environment variables it declares as inputs
+func cacheKeyData(r *RunRecipe, args []string) ([]string, error) {
+	data := []string{"step=" + r.HashKey()}
+	if r.runConfig == nil {
+		return data, nil
+	}
+	runConfig, err := r.resolvedConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := json.Marshal(runConfig.Settings)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't serialize options")
+	}
+	data = append(data,
+		"type="+runConfig.Type,
+		"command="+runConfig.Command,
+		"options="+string(settings),
+	)
+	declared := []string{}
+	for name, value := range runConfig.Env {
+		declared = append(declared, fmt.Sprintf("env %s=%s", name, value))
+	}
+	sort.Strings(declared)
+	data = append(data, declared...)
+	envInputs := append([]string{}, runConfig.EnvInputs...)
+	sort.Strings(envInputs)
+	for _, name := range envInputs {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			data = append(data, fmt.Sprintf("env %s unset", name))
+			continue
+		}
+		data = append(data, fmt.Sprintf("env %s=%s", name, value))
+	}
+	return data, nil
+}
+
+// cacheKeyRequest builds the request for the cache key of r. Unless the command says otherwise the inputs
+// respect .gitignore, and the local cache and the declared outputs are never inputs.
+func (c *cacher) cacheKeyRequest(r *RunRecipe, childKeys []string, additionalData []string) plugins.CacheKeyRequest {
+	root := r.pkgObject.WorkspaceRoot()
+	req := plugins.CacheKeyRequest{
+		LocalDirectory:     root,
+		DependantCacheKeys: childKeys,
+		AdditionalData:     additionalData,
+		RespectGitignore:   true,
+		Excludes:           []string{},
+	}
+	if rel, err := filepath.Rel(root, c.localCacheDir); err == nil && rel != "." && !strings.HasPrefix(rel, "..") {
+		req.Excludes = append(req.Excludes, filepath.ToSlash(rel))
+	}
+	if r.runConfig == nil {
+		return req
+	}
+	req.Excludes = append(req.Excludes, r.runConfig.Outputs...)
+	if inputs := r.runConfig.Inputs; inputs != nil {
+		req.Includes = inputs.Include
+		req.Excludes = append(req.Excludes, inputs.Exclude...)
+		if inputs.RespectGitignore != nil {
+			req.RespectGitignore = *inputs.RespectGitignore
+		}
+	}
+	return req
+}
+
+func (c *cacher) ReplayCachedLogs(cacheKey string, w io.Writer, restoreTo string) (bool, error) {
+	hit, _, err := c.replay(cacheKey, w, restoreTo)
+	return hit, err
+}
+
+func (c *cacher) IsCached(cacheKey string) (bool, error) {
 	if c.cacherClient == nil {
 		return false, nil
 	}
+	return c.cacherClient.HasCache(cacheKey, c.localCacheDir)
+}
+
+// replay replays the entry like ReplayCachedLogs, also returning the artifacts it restored
+func (c *cacher) replay(cacheKey string, w io.Writer, restoreTo string) (bool, []plugins.CacheItem, error) {
+	if c.cacherClient == nil {
+		return false, nil, nil
+	}
 	log.Debug().Msg("Waiting to replay")
 	ch, hit, err := c.cacherClient.ReplayCache(cacheKey, c.localCacheDir)
 	if err != nil {
-		return false, errors.Wrap(err, "can't replay cache")
+		return false, nil, errors.Wrap(err, "can't replay cache")
 	} else if !hit {
 		log.Debug().Msg("No cahce key found")
-		return hit, nil
+		return hit, nil, nil
 	}
 	log.Debug().Msg("Replay kicked off")
+	restored := []plugins.CacheItem{}
+	var restoreErr error
+	// Always drain the channel so the plugin client isn't left blocked
 	for item := range ch {
 		if item.LogItem != "" {
-			w.Write([]byte(item.LogItem))
+			fmt.Fprintln(w, item.LogItem)
+		}
+		if item.ArtifactPath != "" && restoreTo != "" && restoreErr == nil {
+			restoreErr = restoreArtifact(item, restoreTo)
+			restored = append(restored, plugins.CacheItem{
+				ArtifactPath: filepath.Join(restoreTo, filepath.FromSlash(item.ArtifactName)),
+				ArtifactName: item.ArtifactName,
+			})
 		}
 	}
-	return hit, nil
+	// Everything was copied out of the cache by now, so the plugin can clean up what it replayed from
+	if err := c.cacherClient.ReleaseReplay(cacheKey, c.localCacheDir); err != nil {
+		log.Warn().Err(err).Msgf("can't release cache entry %s", cacheKey)
+	}
+	if restoreErr != nil {
+		return false, nil, errors.Wrap(restoreErr, "can't restore cached artifacts")
+	}
+	return hit, restored, nil
+}
+
+// restoreArtifact copies a cached artifact to its place relative to dir, keeping the permissions of the cached copy
+func restoreArtifact(item plugins.CacheItem, dir string) error {
+	name := filepath.Clean(filepath.FromSlash(item.ArtifactName))
+	if item.ArtifactName == "" || filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("artifact %q is not inside the package", item.ArtifactName)
+	}
+	dest := filepath.Join(dir, name)
+	log.Trace().Msgf("restoring %s from %s", dest, item.ArtifactPath)
+	src, err := os.Open(item.ArtifactPath)
+	if err != nil {
+		return errors.Wrapf(err, "can't open cached artifact %s", item.ArtifactPath)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "can't stat cached artifact %s", item.ArtifactPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return errors.Wrapf(err, "can't create directory for %s", dest)
+	}
+	dst, err := os.OpenFile(dest, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, info.Mode().Perm())
+	if err != nil {
+		return errors.Wrapf(err, "can't create %s", dest)
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "can't write %s", dest)
+	}
+	// An existing file keeps its old permissions when truncated
+	return errors.Wrapf(os.Chmod(dest, info.Mode().Perm()), "can't set permissions of %s", dest)
 }
 
-func (c *cacher) WriteLogsToCache(cacheKey string, r io.Reader) error {
+func (c *cacher) WriteLogsToCache(cacheKey string, r io.Reader, artifacts ...plugins.CacheItem) error {
 	if c.cacherClient == nil {
 		return nil
 	}
 	ch := make(chan plugins.CacheItem)
-	defer close(ch)
-	done := make(chan struct{})
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 
 	go func() {
-		defer close(done)
-		defer close(errCh)
-		err := c.cacherClient.Cache(cacheKey, c.localCacheDir, ch)
-		if err != nil {
-			errCh <- errors.Wrap(err, "can't cache")
-			return
-		}
-		done <- struct{}{}
+		c.lock.Lock()
+		metadata := c.keyMetadata[cacheKey]
+		c.lock.Unlock()
+		errCh <- c.cacherClient.Cache(cacheKey, c.localCacheDir, metadata, ch)
 	}()
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
+	send := func(item plugins.CacheItem) error {
 		select {
-		case <-done:
+		case ch <- item:
 			return nil
 		case err := <-errCh:
-			return err
-		default:
-			logLine := scanner.Text()
-			ch <- plugins.CacheItem{
-				LogItem: logLine,
+			if err == nil {
+				return fmt.Errorf("cache plugin stopped before everything was cached")
 			}
+			return errors.Wrap(err, "can't cache")
+		}
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if err := send(plugins.CacheItem{LogItem: scanner.Text()}); err != nil {
+			return err
+		}
+	}
+	for _, artifact := range artifacts {
+		if err := send(artifact); err != nil {
+			return err
 		}
 	}
-	return nil
+	close(ch)
+	return errors.Wrap(<-errCh, "can't cache")
 }
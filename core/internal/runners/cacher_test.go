@@ -1 +1,265 @@
 package runners
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryCachePlugin keeps cached items in memory, copying artifacts into its own directory like a real
+// cache plugin would
+type memoryCachePlugin struct {
+	MockPlugin
+	dir      string
+	entries  map[string][]plugins.CacheItem
+	metadata map[string]plugins.CacheMetadata
+	released []string
+	peeked   []string
+}
+
+func (m *memoryCachePlugin) Cache(cacheKey string, localCacheDirectory string, metadata plugins.CacheMetadata, items chan plugins.CacheItem) error {
+	entry := []plugins.CacheItem{}
+	for item := range items {
+		if item.ArtifactPath != "" {
+			contents, err := os.ReadFile(item.ArtifactPath)
+			if err != nil {
+				return err
+			}
+			stored := filepath.Join(m.dir, strings.ReplaceAll(item.ArtifactName, "/", "_"))
+			if err := os.WriteFile(stored, contents, 0750); err != nil {
+				return err
+			}
+			item.ArtifactPath = stored
+		}
+		entry = append(entry, item)
+	}
+	m.entries[cacheKey] = entry
+	if m.metadata != nil {
+		m.metadata[cacheKey] = metadata
+	}
+	return nil
+}
+
+func (m *memoryCachePlugin) ReplayCache(cacheKey string, localCacheDir string) (chan plugins.CacheItem, bool, error) {
+	entry, ok := m.entries[cacheKey]
+	ch := make(chan plugins.CacheItem, len(entry))
+	defer close(ch)
+	for _, item := range entry {
+		ch <- item
+	}
+	return ch, ok, nil
+}
+
+func (m *memoryCachePlugin) PeekCache(cacheKey string, localCacheDir string) (chan plugins.CacheItem, bool, error) {
+	m.peeked = append(m.peeked, cacheKey)
+	return m.ReplayCache(cacheKey, localCacheDir)
+}
+
+func (m *memoryCachePlugin) HasCache(cacheKey string, localCacheDir string) (bool, error) {
+	_, ok := m.entries[cacheKey]
+	return ok, nil
+}
+
+func (m *memoryCachePlugin) ReleaseReplay(cacheKey string, localCacheDir string) error {
+	m.released = append(m.released, cacheKey)
+	return nil
+}
+
+func TestArtifactsAreRestoredOnReplay(t *testing.T) {
+	assert := assert.New(t)
+	pkgDir := t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(pkgDir, "bin"), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(pkgDir, "bin", "plugin"), []byte("binary"), 0750))
+
+	plugin := &memoryCachePlugin{dir: t.TempDir(), entries: map[string][]plugins.CacheItem{}}
+	c := newCacher(plugin, t.TempDir())
+	err := c.WriteLogsToCache("key", strings.NewReader("line one\nline two\n"), plugins.CacheItem{
+		ArtifactPath: filepath.Join(pkgDir, "bin", "plugin"),
+		ArtifactName: "bin/plugin",
+	})
+	assert.NoError(err)
+
+	restoreDir := t.TempDir()
+	logs := &bytes.Buffer{}
+	hit, err := c.ReplayCachedLogs("key", logs, restoreDir)
+	assert.NoError(err)
+	assert.True(hit)
+	assert.Equal("line one\nline two\n", logs.String())
+	contents, err := os.ReadFile(filepath.Join(restoreDir, "bin", "plugin"))
+	assert.NoError(err)
+	assert.Equal("binary", string(contents))
+	info, err := os.Stat(filepath.Join(restoreDir, "bin", "plugin"))
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0750), info.Mode().Perm())
+	assert.Equal([]string{"key"}, plugin.released)
+
+	hit, err = c.ReplayCachedLogs("missing", logs, restoreDir)
+	assert.NoError(err)
+	assert.False(hit)
+	assert.Equal([]string{"key"}, plugin.released, "misses have nothing to release")
+}
+
+func TestArtifactsOutsideThePackageAreNotRestored(t *testing.T) {
+	assert := assert.New(t)
+	plugin := &memoryCachePlugin{dir: t.TempDir(), entries: map[string][]plugins.CacheItem{
+		"key": {{ArtifactPath: "/etc/hostname", ArtifactName: "../escaped"}},
+	}}
+	c := newCacher(plugin, t.TempDir())
+	hit, err := c.ReplayCachedLogs("key", &bytes.Buffer{}, t.TempDir())
+	assert.Error(err)
+	assert.False(hit)
+}
+
+func TestCacheKeyRequestExcludesCacheAndOutputs(t *testing.T) {
+	assert := assert.New(t)
+	noGitignore := false
+	step := newLeafStep("build", 1)
+	step.runConfig.Outputs = []string{"bin/**"}
+	step.runConfig.Inputs = &workspaces.Inputs{
+		Include:          []string{"**/*.go", "go.mod"},
+		Exclude:          []string{"**/*_test.go"},
+		RespectGitignore: &noGitignore,
+	}
+	c := newCacher(nil, ".harbor").(*cacher)
+
+	req := c.cacheKeyRequest(step, []string{"child"}, nil)
+	assert.Equal([]string{"**/*.go", "go.mod"}, req.Includes)
+	assert.Equal([]string{".harbor", "bin/**", "**/*_test.go"}, req.Excludes)
+	assert.False(req.RespectGitignore)
+	assert.Equal([]string{"child"}, req.DependantCacheKeys)
+
+	req = c.cacheKeyRequest(newLeafStep("test", 1), nil, nil)
+	assert.Empty(req.Includes)
+	assert.Equal([]string{".harbor"}, req.Excludes)
+	assert.True(req.RespectGitignore)
+}
+
+// keyPlugin derives cache keys from everything in the request and counts how often it was asked
+type keyPlugin struct {
+	MockPlugin
+	lock  sync.Mutex
+	calls int
+}
+
+func (k *keyPlugin) GetCacheKey(req plugins.CacheKeyRequest) (string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.calls++
+	return strings.Join(append(req.AdditionalData, req.DependantCacheKeys...), "|"), nil
+}
+
+func TestCacheKeysArePerStep(t *testing.T) {
+	assert := assert.New(t)
+	key := func(step *RunRecipe, args ...string) string {
+		k, err := newCacher(&keyPlugin{}, ".harbor").CalculateCacheKey(step, args...)
+		assert.NoError(err)
+		return k
+	}
+	build := newLeafStep("build", 1)
+	base := key(build)
+	assert.NotEqual(base, key(newLeafStep("test", 1)))
+	assert.NotEqual(base, key(build, "-v"))
+
+	changedCommand := newLeafStep("build", 1)
+	changedCommand.runConfig.Command = "some other command"
+	assert.NotEqual(base, key(changedCommand))
+
+	changedType := newLeafStep("build", 1)
+	changedType.runConfig.Type = "otherRunner"
+	assert.NotEqual(base, key(changedType))
+
+	changedOptions := newLeafStep("build", 1)
+	changedOptions.runConfig.Settings["weight"] = 2
+	assert.NotEqual(base, key(changedOptions))
+
+	withEnv := newLeafStep("build", 1)
+	withEnv.runConfig.EnvInputs = []string{"HARBOR_TEST_ENV_INPUT"}
+	t.Setenv("HARBOR_TEST_ENV_INPUT", "one")
+	one := key(withEnv)
+	t.Setenv("HARBOR_TEST_ENV_INPUT", "two")
+	assert.NotEqual(one, key(withEnv))
+}
+
+func TestCacheKeysAreMemoizedPerStep(t *testing.T) {
+	assert := assert.New(t)
+	shared := newLeafStep("shared", 1)
+	build := newLeafStep("build", 1)
+	build.Needs = []*RunRecipe{shared}
+	test := newLeafStep("test", 1)
+	test.Needs = []*RunRecipe{shared}
+	plugin := &keyPlugin{}
+	c := newCacher(plugin, ".harbor")
+
+	buildKey, err := c.CalculateCacheKey(build)
+	assert.NoError(err)
+	testKey, err := c.CalculateCacheKey(test)
+	assert.NoError(err)
+	assert.NotEqual(buildKey, testKey)
+	_, err = c.CalculateCacheKey(build)
+	assert.NoError(err)
+	assert.Equal(3, plugin.calls)
+}
+
+func TestEntriesAreLabeledWithTheirStep(t *testing.T) {
+	assert := assert.New(t)
+	plugin := &memoryCachePlugin{dir: t.TempDir(), entries: map[string][]plugins.CacheItem{}, metadata: map[string]plugins.CacheMetadata{}}
+	c := newCacher(plugin, t.TempDir()).(*cacher)
+	c.remember("key", newLeafStep("build", 1))
+
+	assert.NoError(c.WriteLogsToCache("key", strings.NewReader("line\n")))
+	assert.Equal(plugins.CacheMetadata{PackageName: "pkg", CommandName: "build"}, plugin.metadata["key"])
+}
+
+func TestCacheKeysUseResolvedVariables(t *testing.T) {
+	assert := assert.New(t)
+	key := func(step *RunRecipe) (string, error) {
+		return newCacher(&keyPlugin{}, ".harbor").CalculateCacheKey(step)
+	}
+	step := newLeafStep("build", 1)
+	step.runConfig.Command = "go build -ldflags \"-X main.version=${{ env.HARBOR_TEST_VERSION }}\""
+	step.runConfig.Settings["out"] = "bin/${{ pkg.name }}"
+	t.Setenv("HARBOR_TEST_VERSION", "1.0.0")
+	one, err := key(step)
+	assert.NoError(err)
+	assert.Contains(one, `main.version=1.0.0`)
+	t.Setenv("HARBOR_TEST_VERSION", "1.1.0")
+	two, err := key(step)
+	assert.NoError(err)
+	assert.NotEqual(one, two)
+
+	step.runConfig.Command = "echo ${{ env.HARBOR_TEST_MISSING }}"
+	_, err = key(step)
+	assert.NoError(err, "unknown variables are replaced with nothing")
+	step.pkgObject.StrictVariables = true
+	_, err = key(step)
+	assert.Error(err)
+}
+
+func TestDeclaredEnvIsPartOfTheCacheKey(t *testing.T) {
+	assert := assert.New(t)
+	key := func(step *RunRecipe) string {
+		k, err := newCacher(&keyPlugin{}, ".harbor").CalculateCacheKey(step)
+		assert.NoError(err)
+		return k
+	}
+	step := newLeafStep("build", 1)
+	base := key(step)
+	step.runConfig.Env = map[string]string{"MODE": "release"}
+	release := key(step)
+	assert.NotEqual(base, release)
+	step.runConfig.Env["MODE"] = "debug"
+	assert.NotEqual(release, key(step))
+
+	t.Setenv("HARBOR_TEST_INHERITED", "inherited")
+	env := environ(map[string]string{"MODE": "debug", "HARBOR_TEST_INHERITED": "overridden"})
+	assert.Equal("debug", env["MODE"])
+	assert.Equal("overridden", env["HARBOR_TEST_INHERITED"])
+	assert.Equal(os.Getenv("PATH"), env["PATH"], "runners get harbor's environment too")
+}
@@ -0,0 +1,123 @@
+package runners
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor/internal/workspaces"
+)
+
+// DependencyEdge is a step needing another step, through the depends_on entry at File:Line
+type DependencyEdge struct {
+	From string
+	To   string
+	File string
+	Line int
+}
+
+func (e DependencyEdge) String() string {
+	if e.File == "" {
+		return fmt.Sprintf("%s -> %s", e.From, e.To)
+	}
+	return fmt.Sprintf("%s -> %s (%s:%d)", e.From, e.To, e.File, e.Line)
+}
+
+// CycleError is a step that transitively needs itself, Edges go around the cycle in order
+type CycleError struct {
+	Edges []DependencyEdge
+}
+
+// Path is the steps the cycle passes through, ending with the one it started at
+func (c *CycleError) Path() []string {
+	path := []string{}
+	for _, edge := range c.Edges {
+		path = append(path, edge.From)
+	}
+	return append(path, c.Edges[0].From)
+}
+
+func (c *CycleError) Error() string {
+	lines := []string{fmt.Sprintf("cycle detected: %s", strings.Join(c.Path(), " -> "))}
+	for _, edge := range c.Edges {
+		lines = append(lines, "  "+edge.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// normalized starts the cycle at its first step in sort order, so it is the same wherever it was found from
+func (c *CycleError) normalized() *CycleError {
+	first := 0
+	for i, edge := range c.Edges {
+		if edge.From < c.Edges[first].From {
+			first = i
+		}
+	}
+	return &CycleError{Edges: append(append([]DependencyEdge{}, c.Edges[first:]...), c.Edges[:first]...)}
+}
+
+func isCycle(err error) bool {
+	var cycle *CycleError
+	return errors.As(err, &cycle)
+}
+
+// wrapUnlessCycle wraps err with the step it happened in, cycles already say where they are
+func wrapUnlessCycle(err error, format string, args ...interface{}) error {
+	if isCycle(err) {
+		return err
+	}
+	return errors.Wrapf(err, format, args...)
+}
+
+// declaredIn is the harbor.conf of pkgConfig relative to the workspace root
+func (b *recipeBuilder) declaredIn(pkgConfig workspaces.WorkspaceConfig) string {
+	if pkgConfig.Location() == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(b.rootConfig.WorkspaceRoot(), pkgConfig.Location())
+	if err != nil {
+		return pkgConfig.Location()
+	}
+	return filepath.ToSlash(rel)
+}
+
+// CheckGraph builds the steps of every command of every package and returns every problem found doing so, such
+// as cycles and dependencies on packages or commands that don't exist, each only once
+func CheckGraph(rootConf workspaces.WorkspaceConfig) []error {
+	problems := []error{}
+	seen := map[string]bool{}
+	report := func(err error) {
+		var cycle *CycleError
+		if errors.As(err, &cycle) {
+			err = cycle.normalized()
+		}
+		if !seen[err.Error()] {
+			seen[err.Error()] = true
+			problems = append(problems, err)
+		}
+	}
+	b := newRecipeBuilder(rootConf)
+	for _, name := range rootConf.PackageNames() {
+		conf, err := b.packageConfig(name)
+		if err != nil {
+			report(err)
+			continue
+		}
+		if _, err := rootConf.PackageDependencies(conf); err != nil {
+			report(err)
+		}
+		commands := []string{}
+		for command := range conf.Commands {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		for _, command := range commands {
+			if _, err := b.step(command, conf); err != nil {
+				report(err)
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,43 @@
+package runners
+
+import (
+	"testing"
+
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCyclesAreReportedInOrder(t *testing.T) {
+	assert := assert.New(t)
+	conf := workspaces.WorkspaceConfig{Name: "ws"}
+	conf.AddSubPackage("a", workspaces.WorkspaceConfig{
+		Commands: map[string]workspaces.Command{
+			"build": {Dependencies: []workspaces.Dependency{{PackageName: "b", CommandName: "protoc"}}},
+			"lint":  {Dependencies: []workspaces.Dependency{{PackageName: "missing", CommandName: "lint"}}},
+		},
+	})
+	conf.AddSubPackage("b", workspaces.WorkspaceConfig{
+		Commands: map[string]workspaces.Command{
+			"protoc": {Dependencies: []workspaces.Dependency{{PackageName: "c", CommandName: "gen"}}},
+		},
+	})
+	conf.AddSubPackage("c", workspaces.WorkspaceConfig{
+		Commands: map[string]workspaces.Command{
+			"gen":  {Dependencies: []workspaces.Dependency{{PackageName: "a", CommandName: "build"}}},
+			"test": {Dependencies: []workspaces.Dependency{{PackageName: ".", CommandName: "gen"}}},
+		},
+	})
+
+	_, _, err := getRecipe("c:test", conf, Selection{})
+	cycle, ok := err.(*CycleError)
+	assert.True(ok, "cycles aren't wrapped")
+	assert.Equal([]string{"c:gen", "a:build", "b:protoc", "c:gen"}, cycle.Path(), "ancestors outside of the cycle are left out")
+	assert.Equal("cycle detected: a:build -> b:protoc -> c:gen -> a:build\n  a:build -> b:protoc\n  b:protoc -> c:gen\n  c:gen -> a:build", cycle.normalized().Error())
+
+	problems := CheckGraph(conf)
+	assert.Len(problems, 2, "the cycle is reported once, whichever step it was found from")
+	assert.Equal(cycle.normalized().Error(), problems[0].Error())
+	assert.Equal("a:lint -> missing:lint: error getting package named missing: does not exsist", problems[1].Error())
+
+	assert.Equal("a:build -> b:protoc (a/harbor.conf:7)", DependencyEdge{From: "a:build", To: "b:protoc", File: "a/harbor.conf", Line: 7}.String())
+}
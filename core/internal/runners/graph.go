@@ -0,0 +1,424 @@
+package runners
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor/internal/workspaces"
+)
+
+const (
+	// EdgeNeeds is a step that needs another step, through the depends_on of its command
+	EdgeNeeds = "needs"
+	// EdgePackage is a package that depends on another package, through its dependencies
+	EdgePackage = "package"
+)
+
+// GraphOptions select what harbor graph exports
+type GraphOptions struct {
+	// Target is a command name or pkg:command, when empty every command of every package is exported
+	Target string
+	// Packages collapses the steps of a package into a single node
+	Packages bool
+	// From and To highlight a path between two steps, or packages when collapsed
+	From string
+	To   string
+}
+
+type GraphNode struct {
+	ID          string `json:"id"`
+	Package     string `json:"package"`
+	Command     string `json:"command,omitempty"`
+	Highlighted bool   `json:"highlighted,omitempty"`
+}
+
+// GraphEdge points from a step, or package, to the one it depends on
+type GraphEdge struct {
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Kind        string `json:"kind"`
+	Highlighted bool   `json:"highlighted,omitempty"`
+	Cycle       bool   `json:"cycle,omitempty"`
+}
+
+// Graph is the dependency graph of the steps and packages of the workspace, sorted so it exports the same every time
+type Graph struct {
+	Nodes []GraphNode `json:"nodes"`
+	Edges []GraphEdge `json:"edges"`
+	// Cycles are the cycles in the graph, each as the nodes it passes through ending where it started
+	Cycles [][]string `json:"cycles,omitempty"`
+}
+
+// GraphCommand exports the dependency graph of the workspace to out as dot, mermaid or json
+func GraphCommand(opts GraphOptions, format string, out io.Writer) error {
+	if format != "dot" && format != "mermaid" && format != "json" {
+		return fmt.Errorf("unknown graph format %q, expected dot, mermaid or json", format)
+	}
+	rootConf, err := workspaces.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "error getting workspace config")
+	}
+	graph, err := buildGraph(rootConf, opts)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case "dot":
+		return graph.WriteDot(out)
+	case "mermaid":
+		return graph.WriteMermaid(out)
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(graph)
+}
+
+func buildGraph(rootConf workspaces.WorkspaceConfig, opts GraphOptions) (Graph, error) {
+	b := newRecipeBuilder(rootConf)
+	b.allowCycles = true
+	if opts.Target != "" {
+		if _, err := b.recipe(opts.Target, Selection{}); err != nil {
+			return Graph{}, err
+		}
+	} else {
+		for _, name := range rootConf.PackageNames() {
+			conf, err := b.packageConfig(name)
+			if err != nil {
+				return Graph{}, err
+			}
+			commands := []string{}
+			for command := range conf.Commands {
+				commands = append(commands, command)
+			}
+			sort.Strings(commands)
+			for _, command := range commands {
+				if _, err := b.step(command, conf); err != nil {
+					return Graph{}, err
+				}
+			}
+		}
+	}
+
+	graph := Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	packages := map[string]bool{}
+	for _, step := range b.graph {
+		packages[step.Pkg] = true
+		graph.Nodes = append(graph.Nodes, GraphNode{ID: step.HashKey(), Package: step.Pkg, Command: step.CommandName})
+		for _, dep := range step.Needs {
+			graph.addEdge(GraphEdge{From: step.HashKey(), To: dep.HashKey(), Kind: EdgeNeeds})
+		}
+	}
+	seenCycles := map[string]bool{}
+	for _, cycle := range b.cycles {
+		// every walk that enters a cycle finds it again starting at a different step
+		path := cycle.normalized().Path()
+		if key := strings.Join(path, " "); !seenCycles[key] {
+			seenCycles[key] = true
+			graph.Cycles = append(graph.Cycles, path)
+		}
+	}
+
+	packageEdges := []GraphEdge{}
+	for pkg := range packages {
+		conf, err := b.packageConfig(pkg)
+		if err != nil {
+			return Graph{}, err
+		}
+		deps, err := rootConf.PackageDependencies(conf)
+		if err != nil {
+			return Graph{}, err
+		}
+		for _, dep := range deps {
+			if packages[dep] {
+				packageEdges = append(packageEdges, GraphEdge{From: pkg, To: dep, Kind: EdgePackage})
+			}
+		}
+	}
+
+	if opts.Packages {
+		graph = graph.collapse()
+		for _, edge := range packageEdges {
+			graph.addEdge(edge)
+		}
+	} else {
+		graph.Edges = append(graph.Edges, packageEdges...)
+	}
+	graph.sort()
+	for _, cycle := range graph.Cycles {
+		graph.mark(cycle, func(e *GraphEdge) { e.Cycle = true }, nil)
+	}
+
+	if opts.From != "" || opts.To != "" {
+		from, to := graph.resolve(opts.From, b), graph.resolve(opts.To, b)
+		if !graph.hasNode(from) || !graph.hasNode(to) {
+			return graph, fmt.Errorf("can't highlight the path from %s to %s, both have to be in the graph", opts.From, opts.To)
+		}
+		path := graph.path(from, to)
+		if path == nil {
+			path = graph.path(to, from)
+		}
+		if path == nil {
+			return graph, fmt.Errorf("there is no path between %s and %s", opts.From, opts.To)
+		}
+		graph.mark(path, func(e *GraphEdge) { e.Highlighted = true }, func(n *GraphNode) { n.Highlighted = true })
+	}
+	return graph, nil
+}
+
+// addEdge adds edge unless the nodes are already connected, package edges win over the needs edges they imply
+func (g *Graph) addEdge(edge GraphEdge) {
+	for i, e := range g.Edges {
+		if e.From == edge.From && e.To == edge.To {
+			if edge.Kind == EdgePackage {
+				g.Edges[i].Kind = EdgePackage
+			}
+			return
+		}
+	}
+	g.Edges = append(g.Edges, edge)
+}
+
+// collapse merges the steps of every package into a node named after the package
+func (g Graph) collapse() Graph {
+	collapsed := Graph{Nodes: []GraphNode{}, Edges: []GraphEdge{}}
+	pkgOf := map[string]string{}
+	for _, node := range g.Nodes {
+		pkgOf[node.ID] = node.Package
+		if !collapsed.hasNode(node.Package) {
+			collapsed.Nodes = append(collapsed.Nodes, GraphNode{ID: node.Package, Package: node.Package})
+		}
+	}
+	for _, edge := range g.Edges {
+		from, to := pkgOf[edge.From], pkgOf[edge.To]
+		if from != to {
+			collapsed.addEdge(GraphEdge{From: from, To: to, Kind: edge.Kind})
+		}
+	}
+	for _, cycle := range g.Cycles {
+		pkgCycle := []string{}
+		for _, step := range cycle {
+			if pkg := pkgOf[step]; len(pkgCycle) == 0 || pkgCycle[len(pkgCycle)-1] != pkg {
+				pkgCycle = append(pkgCycle, pkg)
+			}
+		}
+		collapsed.Cycles = append(collapsed.Cycles, pkgCycle)
+	}
+	return collapsed
+}
+
+func (g *Graph) sort() {
+	sort.Slice(g.Nodes, func(i, j int) bool {
+		return g.Nodes[i].ID < g.Nodes[j].ID
+	})
+	sort.Slice(g.Edges, func(i, j int) bool {
+		if g.Edges[i].From != g.Edges[j].From {
+			return g.Edges[i].From < g.Edges[j].From
+		}
+		return g.Edges[i].To < g.Edges[j].To
+	})
+}
+
+func (g Graph) hasNode(id string) bool {
+	for _, node := range g.Nodes {
+		if node.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve maps a step to its package when the graph is collapsed
+func (g Graph) resolve(id string, b *recipeBuilder) string {
+	if g.hasNode(id) {
+		return id
+	}
+	if step, ok := b.graph[id]; ok {
+		return step.Pkg
+	}
+	return id
+}
+
+// path is the shortest path from one node to another following the edges, nil when there is none
+func (g Graph) path(from, to string) []string {
+	cameFrom := map[string]string{from: ""}
+	queue := []string{from}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		if node == to {
+			path := []string{to}
+			for node != from {
+				node = cameFrom[node]
+				path = append([]string{node}, path...)
+			}
+			return path
+		}
+		for _, edge := range g.Edges {
+			if _, seen := cameFrom[edge.To]; edge.From == node && !seen {
+				cameFrom[edge.To] = node
+				queue = append(queue, edge.To)
+			}
+		}
+	}
+	return nil
+}
+
+// mark calls onEdge with every edge and onNode with every node along path
+func (g *Graph) mark(path []string, onEdge func(*GraphEdge), onNode func(*GraphNode)) {
+	for i := range g.Nodes {
+		for _, id := range path {
+			if g.Nodes[i].ID == id && onNode != nil {
+				onNode(&g.Nodes[i])
+			}
+		}
+	}
+	for i := 0; i+1 < len(path); i++ {
+		for j := range g.Edges {
+			if g.Edges[j].From == path[i] && g.Edges[j].To == path[i+1] {
+				onEdge(&g.Edges[j])
+			}
+		}
+	}
+}
+
+// WriteDot writes the graph in the Graphviz dot language, the steps of a package are grouped in a cluster
+func (g Graph) WriteDot(w io.Writer) error {
+	lines := []string{"digraph harbor {", "  rankdir=LR;", "  compound=true;", "  node [shape=box];"}
+	clusters := map[string][]GraphNode{}
+	order := []string{}
+	for _, node := range g.Nodes {
+		if _, ok := clusters[node.Package]; !ok {
+			order = append(order, node.Package)
+		}
+		clusters[node.Package] = append(clusters[node.Package], node)
+	}
+	collapsed := true
+	for _, node := range g.Nodes {
+		collapsed = collapsed && node.Command == ""
+	}
+	for i, pkg := range order {
+		indent := "  "
+		if !collapsed {
+			lines = append(lines, fmt.Sprintf("  subgraph cluster_%d {", i), fmt.Sprintf("    label=%q;", pkg))
+			indent = "    "
+		}
+		for _, node := range clusters[pkg] {
+			attrs := []string{}
+			if node.Command != "" {
+				attrs = append(attrs, fmt.Sprintf("label=%q", node.Command))
+			}
+			if node.Highlighted {
+				attrs = append(attrs, "color=blue", "penwidth=2")
+			}
+			lines = append(lines, fmt.Sprintf("%s%q%s;", indent, node.ID, dotAttrs(attrs)))
+		}
+		if !collapsed {
+			lines = append(lines, "  }")
+		}
+	}
+	for _, edge := range g.Edges {
+		from, to := edge.From, edge.To
+		attrs := []string{}
+		if edge.Kind == EdgePackage && !collapsed {
+			// packages are clusters, the edge connects a step of each and is clipped to the clusters
+			from, to = clusters[edge.From][0].ID, clusters[edge.To][0].ID
+			attrs = append(attrs, fmt.Sprintf("ltail=cluster_%d", indexOf(order, edge.From)), fmt.Sprintf("lhead=cluster_%d", indexOf(order, edge.To)))
+		}
+		if edge.Kind == EdgePackage {
+			attrs = append(attrs, "style=dotted")
+		}
+		if edge.Cycle {
+			attrs = append(attrs, "color=red", "penwidth=2")
+		} else if edge.Highlighted {
+			attrs = append(attrs, "color=blue", "penwidth=2")
+		}
+		lines = append(lines, fmt.Sprintf("  %q -> %q%s;", from, to, dotAttrs(attrs)))
+	}
+	lines = append(lines, "}")
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+func dotAttrs(attrs []string) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	return " [" + strings.Join(attrs, ", ") + "]"
+}
+
+func indexOf(values []string, value string) int {
+	for i, v := range values {
+		if v == value {
+			return i
+		}
+	}
+	return -1
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart, the steps of a package are grouped in a subgraph
+func (g Graph) WriteMermaid(w io.Writer) error {
+	lines := []string{"flowchart LR"}
+	ids := map[string]string{}
+	packages := map[string]string{}
+	highlighted := []string{}
+	collapsed := true
+	for _, node := range g.Nodes {
+		collapsed = collapsed && node.Command == ""
+	}
+	order := []string{}
+	byPackage := map[string][]GraphNode{}
+	for i, node := range g.Nodes {
+		ids[node.ID] = fmt.Sprintf("n%d", i)
+		if node.Highlighted {
+			highlighted = append(highlighted, ids[node.ID])
+		}
+		if _, ok := byPackage[node.Package]; !ok {
+			order = append(order, node.Package)
+		}
+		byPackage[node.Package] = append(byPackage[node.Package], node)
+	}
+	for i, pkg := range order {
+		indent := "  "
+		if !collapsed {
+			packages[pkg] = fmt.Sprintf("p%d", i)
+			lines = append(lines, fmt.Sprintf("  subgraph %s[%q]", packages[pkg], pkg))
+			indent = "    "
+		}
+		for _, node := range byPackage[pkg] {
+			label := node.ID
+			if node.Command != "" {
+				label = node.Command
+			}
+			lines = append(lines, fmt.Sprintf("%s%s[%q]", indent, ids[node.ID], label))
+		}
+		if !collapsed {
+			lines = append(lines, "  end")
+		}
+	}
+	styles := []string{}
+	for i, edge := range g.Edges {
+		from, to, arrow := ids[edge.From], ids[edge.To], "-->"
+		if edge.Kind == EdgePackage {
+			arrow = "-.->"
+			if !collapsed {
+				from, to = packages[edge.From], packages[edge.To]
+			}
+		}
+		lines = append(lines, fmt.Sprintf("  %s %s %s", from, arrow, to))
+		if edge.Cycle {
+			styles = append(styles, fmt.Sprintf("  linkStyle %d stroke:red,stroke-width:2px", i))
+		} else if edge.Highlighted {
+			styles = append(styles, fmt.Sprintf("  linkStyle %d stroke:blue,stroke-width:2px", i))
+		}
+	}
+	lines = append(lines, styles...)
+	if len(highlighted) > 0 {
+		lines = append(lines, "  classDef highlighted stroke:blue,stroke-width:2px", "  class "+strings.Join(highlighted, ",")+" highlighted")
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
@@ -0,0 +1,76 @@
+package runners
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGraphOfACommand(t *testing.T) {
+	assert := assert.New(t)
+
+	graph, err := buildGraph(defaultConf, GraphOptions{Target: "command1", From: "subPackageB:command1", To: "subPackageC:command3"})
+	assert.NoError(err)
+	ids := []string{}
+	for _, node := range graph.Nodes {
+		ids = append(ids, node.ID)
+	}
+	assert.Equal([]string{"subPackageA:command1", "subPackageA:command2", "subPackageB:command1", "subPackageC:command3"}, ids)
+	assert.Equal([]GraphEdge{
+		{From: "subPackageA:command1", To: "subPackageA:command2", Kind: EdgeNeeds},
+		{From: "subPackageB:command1", To: "subPackageC:command3", Kind: EdgeNeeds, Highlighted: true},
+	}, graph.Edges)
+	assert.Empty(graph.Cycles)
+
+	collapsed, err := buildGraph(defaultConf, GraphOptions{Target: "command1", Packages: true})
+	assert.NoError(err)
+	assert.Len(collapsed.Nodes, 3)
+	assert.Equal([]GraphEdge{{From: "subPackageB", To: "subPackageC", Kind: EdgeNeeds}}, collapsed.Edges)
+
+	out := &bytes.Buffer{}
+	assert.NoError(graph.WriteDot(out))
+	assert.Contains(out.String(), `"subPackageB:command1" -> "subPackageC:command3" [color=blue, penwidth=2];`)
+	out.Reset()
+	assert.NoError(collapsed.WriteMermaid(out))
+	assert.Contains(out.String(), "n1 --> n2")
+
+	_, err = buildGraph(defaultConf, GraphOptions{Target: "command1", From: "subPackageA:command1", To: "subPackageC:command3"})
+	assert.Error(err)
+}
+
+func TestGraphShowsCycles(t *testing.T) {
+	assert := assert.New(t)
+	conf := workspaces.WorkspaceConfig{Name: "ws"}
+	conf.AddSubPackage("a", workspaces.WorkspaceConfig{
+		Dependencies: []string{"b"},
+		Commands: map[string]workspaces.Command{
+			"build": {Dependencies: []workspaces.Dependency{{PackageName: "b", CommandName: "protoc"}}},
+		},
+	})
+	conf.AddSubPackage("b", workspaces.WorkspaceConfig{
+		Commands: map[string]workspaces.Command{
+			"protoc": {Dependencies: []workspaces.Dependency{{PackageName: "a", CommandName: "build"}}},
+		},
+	})
+
+	graph, err := buildGraph(conf, GraphOptions{})
+	assert.NoError(err)
+	assert.Len(graph.Cycles, 1)
+	assert.Equal([]string{"a:build", "b:protoc", "a:build"}, graph.Cycles[0])
+	for _, edge := range graph.Edges {
+		assert.Equal(edge.Kind == EdgeNeeds, edge.Cycle, "%s -> %s", edge.From, edge.To)
+	}
+	assert.Contains(graph.Edges, GraphEdge{From: "a", To: "b", Kind: EdgePackage})
+
+	collapsed, err := buildGraph(conf, GraphOptions{Packages: true})
+	assert.NoError(err)
+	assert.Equal([]GraphEdge{
+		{From: "a", To: "b", Kind: EdgePackage, Cycle: true},
+		{From: "b", To: "a", Kind: EdgeNeeds, Cycle: true},
+	}, collapsed.Edges)
+
+	_, err = getRootRecipe("build", conf)
+	assert.Error(err, "running still fails on cycles")
+}
@@ -0,0 +1,129 @@
+package runners
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor/internal/multierror"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/rs/zerolog/log"
+)
+
+type cacheTier struct {
+	name     string
+	cacher   *cacher
+	readOnly bool
+}
+
+// layeredCacher consults its tiers in order, usually a fast local cache before slower remote ones. A hit
+// is copied back into the writable tiers before it, and writes go to every writable tier.
+type layeredCacher struct {
+	tiers []cacheTier
+}
+
+func newLayeredCacher(cachers []workspaces.CachePlugin, localCacheDir string) Cacher {
+	tiers := []cacheTier{}
+	for _, c := range cachers {
+		tiers = append(tiers, cacheTier{
+			name:     c.Provider,
+			cacher:   newCacher(c.Client, localCacheDir).(*cacher),
+			readOnly: c.ReadOnly,
+		})
+	}
+	return &layeredCacher{tiers: tiers}
+}
+
+// CalculateCacheKey asks the first tier for the key and uses it to read and write every tier, so only the
+// inputs are hashed once. That only works because providers have to agree on keys, every provider builds
+// them with plugins.HashInputs and plugins.CacheKey. A tier hashing differently would never hit.
+func (l *layeredCacher) CalculateCacheKey(r *RunRecipe, additionalData ...string) (string, error) {
+	if len(l.tiers) == 0 {
+		return "", nil
+	}
+	cacheKey, err := l.tiers[0].cacher.CalculateCacheKey(r, additionalData...)
+	if err != nil {
+		return "", err
+	}
+	for _, tier := range l.tiers[1:] {
+		tier.cacher.remember(cacheKey, r)
+	}
+	return cacheKey, nil
+}
+
+func (l *layeredCacher) ReplayCachedLogs(cacheKey string, w io.Writer, restoreTo string) (bool, error) {
+	for i, tier := range l.tiers {
+		logs := &bytes.Buffer{}
+		hit, restored, err := tier.cacher.replay(cacheKey, logs, restoreTo)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't replay from cache %s, trying the next one", tier.name)
+			continue
+		}
+		if !hit {
+			continue
+		}
+		log.Debug().Msgf("%s was found in cache %s", cacheKey, tier.name)
+		// Only back fill when the artifacts were restored, otherwise there is nothing to copy them from
+		if restoreTo != "" {
+			l.backfill(l.tiers[:i], cacheKey, logs.Bytes(), restored)
+		}
+		_, err = w.Write(logs.Bytes())
+		return true, err
+	}
+	return false, nil
+}
+
+// IsCached looks through the tiers without back filling, an unreachable tier is skipped like it is when replaying
+func (l *layeredCacher) IsCached(cacheKey string) (bool, error) {
+	for _, tier := range l.tiers {
+		hit, err := tier.cacher.IsCached(cacheKey)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't check cache %s, trying the next one", tier.name)
+			continue
+		}
+		if hit {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (l *layeredCacher) backfill(tiers []cacheTier, cacheKey string, logs []byte, artifacts []plugins.CacheItem) {
+	for _, tier := range tiers {
+		if tier.readOnly {
+			continue
+		}
+		log.Debug().Msgf("back filling %s into cache %s", cacheKey, tier.name)
+		if err := tier.cacher.WriteLogsToCache(cacheKey, bytes.NewReader(logs), artifacts...); err != nil {
+			log.Warn().Err(err).Msgf("can't back fill cache %s", tier.name)
+		}
+	}
+}
+
+// WriteLogsToCache writes to every writable tier. It only fails when every one of them failed, a single
+// unreachable remote cache shouldn't fail the step.
+func (l *layeredCacher) WriteLogsToCache(cacheKey string, r io.Reader, artifacts ...plugins.CacheItem) error {
+	logs, err := io.ReadAll(r)
+	if err != nil {
+		return errors.Wrap(err, "can't read logs")
+	}
+	var writeErr error
+	written := 0
+	for _, tier := range l.tiers {
+		if tier.readOnly {
+			continue
+		}
+		err := tier.cacher.WriteLogsToCache(cacheKey, bytes.NewReader(logs), artifacts...)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't write to cache %s", tier.name)
+			writeErr = multierror.Append(writeErr, errors.Wrapf(err, "cache %s", tier.name))
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		return writeErr
+	}
+	return nil
+}
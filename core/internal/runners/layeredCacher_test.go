@@ -0,0 +1,126 @@
+package runners
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/stretchr/testify/assert"
+)
+
+func newMemoryCache(t *testing.T) *memoryCachePlugin {
+	return &memoryCachePlugin{dir: t.TempDir(), entries: map[string][]plugins.CacheItem{}}
+}
+
+func TestLayeredCacheBackfillsFasterTiers(t *testing.T) {
+	assert := assert.New(t)
+	local, remote := newMemoryCache(t), newMemoryCache(t)
+	pkgDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(pkgDir, "out"), []byte("built"), 0644))
+	assert.NoError(newCacher(remote, "").WriteLogsToCache("key", strings.NewReader("from remote\n"), plugins.CacheItem{
+		ArtifactPath: filepath.Join(pkgDir, "out"),
+		ArtifactName: "out",
+	}))
+
+	layered := newLayeredCacher([]workspaces.CachePlugin{
+		{Provider: "local", Client: local},
+		{Provider: "remote", Client: remote},
+	}, "")
+	restoreDir := t.TempDir()
+	logs := &bytes.Buffer{}
+	hit, err := layered.ReplayCachedLogs("key", logs, restoreDir)
+	assert.NoError(err)
+	assert.True(hit)
+	assert.Equal("from remote\n", logs.String())
+	contents, err := os.ReadFile(filepath.Join(restoreDir, "out"))
+	assert.NoError(err)
+	assert.Equal("built", string(contents))
+
+	// The local tier now has the entry, artifacts included
+	assert.Len(local.entries["key"], 2)
+	assert.Equal("out", local.entries["key"][1].ArtifactName)
+}
+
+func TestLayeredCacheSkipsReadOnlyTiers(t *testing.T) {
+	assert := assert.New(t)
+	local, remote := newMemoryCache(t), newMemoryCache(t)
+	layered := newLayeredCacher([]workspaces.CachePlugin{
+		{Provider: "local", Client: local},
+		{Provider: "remote", Client: remote, ReadOnly: true},
+	}, "")
+
+	assert.NoError(layered.WriteLogsToCache("key", strings.NewReader("line\n")))
+	assert.Contains(local.entries, "key")
+	assert.NotContains(remote.entries, "key")
+
+	hit, err := layered.ReplayCachedLogs("missing", &bytes.Buffer{}, t.TempDir())
+	assert.NoError(err)
+	assert.False(hit)
+}
+
+func TestLayeredCacheLooksWithoutBackfilling(t *testing.T) {
+	assert := assert.New(t)
+	local, remote := newMemoryCache(t), newMemoryCache(t)
+	assert.NoError(newCacher(remote, "").WriteLogsToCache("key", strings.NewReader("from remote\n")))
+	layered := newLayeredCacher([]workspaces.CachePlugin{
+		{Provider: "local", Client: local},
+		{Provider: "remote", Client: remote},
+	}, "")
+
+	hit, err := layered.IsCached("key")
+	assert.NoError(err)
+	assert.True(hit)
+	assert.NotContains(local.entries, "key")
+	hit, err = layered.IsCached("missing")
+	assert.NoError(err)
+	assert.False(hit)
+}
+
+// keyedMemoryCache is a memory cache calculating its own keys, starting with prefix
+type keyedMemoryCache struct {
+	memoryCachePlugin
+	prefix string
+	calls  int
+}
+
+func (k *keyedMemoryCache) GetCacheKey(req plugins.CacheKeyRequest) (string, error) {
+	k.calls++
+	return k.prefix + strings.Join(req.AdditionalData, "|"), nil
+}
+
+func TestLayeredCacheUsesTheKeyOfTheFirstTierForEveryTier(t *testing.T) {
+	assert := assert.New(t)
+	newKeyedCache := func(prefix string) *keyedMemoryCache {
+		return &keyedMemoryCache{
+			memoryCachePlugin: memoryCachePlugin{dir: t.TempDir(), entries: map[string][]plugins.CacheItem{}},
+			prefix:            prefix,
+		}
+	}
+	local, remote := newKeyedCache("local:"), newKeyedCache("remote:")
+	layered := newLayeredCacher([]workspaces.CachePlugin{
+		{Provider: "local", Client: local},
+		{Provider: "remote", Client: remote},
+	}, "")
+
+	key, err := layered.CalculateCacheKey(newLeafStep("build", 1))
+	assert.NoError(err)
+	assert.True(strings.HasPrefix(key, "local:"), key)
+	assert.Equal(1, local.calls)
+	assert.Equal(0, remote.calls, "only the first tier calculates keys")
+
+	assert.NoError(layered.WriteLogsToCache(key, strings.NewReader("built\n")))
+	assert.Contains(local.entries, key)
+	assert.Contains(remote.entries, key, "every tier stores the entry under the same key")
+
+	delete(local.entries, key)
+	logs := &bytes.Buffer{}
+	hit, err := layered.ReplayCachedLogs(key, logs, t.TempDir())
+	assert.NoError(err)
+	assert.True(hit)
+	assert.Equal("built\n", logs.String())
+	assert.Contains(local.entries, key)
+}
@@ -0,0 +1,173 @@
+package runners
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/rs/zerolog/log"
+)
+
+// PlanStep describes a single step of the run graph as it would be executed
+type PlanStep struct {
+	Key           string   `json:"key"`
+	Package       string   `json:"package"`
+	Command       string   `json:"command"`
+	Type          string   `json:"type,omitempty"`
+	Needs         []string `json:"needs"`
+	ConditionsMet bool     `json:"conditions_met"`
+	// ConditionsReason is why the conditions aren't met or couldn't be evaluated
+	ConditionsReason string `json:"conditions_reason,omitempty"`
+	CacheKey         string `json:"cache_key,omitempty"`
+	CacheHit         bool   `json:"cache_hit"`
+}
+
+// Plan is the resolved run graph for a command. Steps are ordered so that every step comes after
+// the steps it needs.
+type Plan struct {
+	Root  string     `json:"root"`
+	Steps []PlanStep `json:"steps"`
+}
+
+// PlanCommand resolves the run graph for command and writes it to out in the given format
+// ("text" or "json") without invoking any runner plugin. Only the steps in the selection are planned.
+func PlanCommand(command string, args []string, format string, sel Selection, out io.Writer) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown plan format %q, expected text or json", format)
+	}
+	rootConf, err := workspaces.GetConfig()
+	if err != nil {
+		return errors.Wrap(err, "error getting workspace config")
+	}
+	runStep, _, err := getRecipe(command, rootConf, sel)
+	if err != nil {
+		return err
+	}
+	plan, err := buildPlan(runStep, args, getCacher(rootConf))
+	if err != nil {
+		return errors.Wrap(err, "can't build plan")
+	}
+	if format == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(plan)
+	}
+	return plan.WriteTree(out)
+}
+
+func buildPlan(root *RunRecipe, args []string, cacher Cacher) (Plan, error) {
+	plan := Plan{
+		Root:  root.HashKey(),
+		Steps: []PlanStep{},
+	}
+	visited := make(visitedSet)
+	var visit func(r *RunRecipe) error
+	visit = func(r *RunRecipe) error {
+		if visited.Has(r) {
+			return nil
+		}
+		visited.Add(r)
+		step := PlanStep{
+			Key:     r.HashKey(),
+			Package: r.Pkg,
+			Command: r.CommandName,
+			Needs:   []string{},
+		}
+		var err error
+		step.ConditionsMet, step.ConditionsReason, err = r.checkConditions(args)
+		if err != nil {
+			step.ConditionsReason = err.Error()
+		} else if r.conditionNote != "" {
+			step.ConditionsReason = r.conditionNote
+		}
+		for _, dep := range r.Needs {
+			if err := visit(dep); err != nil {
+				return err
+			}
+			step.Needs = append(step.Needs, dep.HashKey())
+		}
+		if r.runConfig != nil {
+			step.Type = r.runConfig.Type
+			cacheKey, err := cacher.CalculateCacheKey(r, args...)
+			if err != nil {
+				return errors.Wrapf(err, "can't get cache key for %s", r.HashKey())
+			}
+			step.CacheKey = cacheKey
+			step.CacheHit, err = cacher.IsCached(cacheKey)
+			if err != nil {
+				log.Warn().Err(err).Msgf("error checking cache for %s", r.HashKey())
+			}
+		}
+		plan.Steps = append(plan.Steps, step)
+		return nil
+	}
+	return plan, visit(root)
+}
+
+func (p Plan) step(key string) (PlanStep, bool) {
+	for _, step := range p.Steps {
+		if step.Key == key {
+			return step, true
+		}
+	}
+	return PlanStep{}, false
+}
+
+// WriteTree writes the plan as a human readable dependency tree. Steps needed by more than one
+// other step are only expanded the first time they are printed.
+func (p Plan) WriteTree(w io.Writer) error {
+	printed := map[string]bool{}
+	var write func(key, prefix, childPrefix string) error
+	write = func(key, prefix, childPrefix string) error {
+		step, ok := p.step(key)
+		if !ok {
+			return fmt.Errorf("step %s is not part of the plan", key)
+		}
+		line := prefix + step.describe()
+		if printed[key] && len(step.Needs) > 0 {
+			line += " (see above)"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		if printed[key] {
+			return nil
+		}
+		printed[key] = true
+		for i, need := range step.Needs {
+			branch, next := "├── ", "│   "
+			if i == len(step.Needs)-1 {
+				branch, next = "└── ", "    "
+			}
+			if err := write(need, childPrefix+branch, childPrefix+next); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return write(p.Root, "", "")
+}
+
+func (s PlanStep) describe() string {
+	parts := []string{s.Key}
+	if s.Type != "" {
+		parts = append(parts, fmt.Sprintf("[%s]", s.Type))
+	}
+	if !s.ConditionsMet {
+		parts = append(parts, "conditions=false")
+	}
+	if s.ConditionsReason != "" {
+		parts = append(parts, fmt.Sprintf("(%s)", s.ConditionsReason))
+	}
+	if s.CacheKey != "" {
+		cache := "miss"
+		if s.CacheHit {
+			cache = "hit"
+		}
+		parts = append(parts, fmt.Sprintf("cache=%s (%s)", cache, s.CacheKey))
+	}
+	return strings.Join(parts, " ")
+}
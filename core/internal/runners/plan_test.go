@@ -0,0 +1,65 @@
+package runners
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPlanOrdersDependenciesFirst(t *testing.T) {
+	assert := assert.New(t)
+	mockedcacher := &mockCache{}
+	mockedcacher.On("CalculateCacheKey", mock.Anything, mock.Anything)
+	mockedcacher.On("IsCached", mock.Anything)
+
+	recipe, err := getRootRecipe("command1", defaultConf)
+	assert.NoError(err)
+
+	plan, err := buildPlan(recipe, []string{}, mockedcacher)
+	assert.NoError(err)
+	assert.Len(plan.Steps, 5)
+	assert.Equal("Root:command1", plan.Root)
+
+	position := map[string]int{}
+	for i, step := range plan.Steps {
+		position[step.Key] = i
+	}
+	for _, step := range plan.Steps {
+		for _, need := range step.Needs {
+			assert.Less(position[need], position[step.Key], "%s should be planned before %s", need, step.Key)
+		}
+	}
+
+	step, ok := plan.step("subPackageA:command2")
+	assert.True(ok)
+	assert.Equal("test1", step.Type)
+	assert.Equal("cached_key", step.CacheKey)
+	assert.False(step.CacheHit)
+	assert.True(step.ConditionsMet)
+
+	// The root step has no command of its own so it should never be looked up in the cache
+	mockedcacher.AssertNumberOfCalls(t, "CalculateCacheKey", 4)
+	mockedcacher.AssertNumberOfCalls(t, "IsCached", 4)
+	mockedcacher.AssertNotCalled(t, "ReplayCachedLogs", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPlanWritesTree(t *testing.T) {
+	assert := assert.New(t)
+	plan := Plan{
+		Root: "Root:build",
+		Steps: []PlanStep{
+			{Key: "a:build", Type: "shell", Needs: []string{}, ConditionsMet: true, CacheKey: "123", CacheHit: true},
+			{Key: "b:build", Type: "shell", Needs: []string{"a:build"}, ConditionsMet: false},
+			{Key: "Root:build", Needs: []string{"a:build", "b:build"}, ConditionsMet: true},
+		},
+	}
+	buf := &bytes.Buffer{}
+	assert.NoError(plan.WriteTree(buf))
+	assert.Equal(`Root:build
+├── a:build [shell] cache=hit (123)
+└── b:build [shell] conditions=false
+    └── a:build [shell] cache=hit (123)
+`, buf.String())
+}
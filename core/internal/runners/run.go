@@ -2,124 +2,356 @@ package runners
 
 import (
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
-	plugins "github.com/radding/harbor-plugins"
 	"github.com/radding/harbor/internal/config"
 	"github.com/radding/harbor/internal/workspaces"
 	"github.com/rs/zerolog/log"
 )
 
-func RunCommand(command string, args []string) error {
+// RunOptions controls how a command is run across the workspace
+type RunOptions struct {
+	// Jobs is the maximum number of steps to run at once, 0 falls back to max_parallel in workspace.conf
+	Jobs int
+	// KeepGoing lets independent steps finish after a step fails, only its dependants are skipped
+	KeepGoing bool
+	// Summary receives a table with the outcome of every step once the run is over, nil disables it
+	Summary io.Writer
+	// Interrupts cancels the run when it receives a signal, the signal is forwarded to running tasks
+	Interrupts <-chan os.Signal
+	// GraceTimeout is how long running tasks get to stop after an interrupt before they are killed
+	GraceTimeout time.Duration
+	Selection
+}
+
+func (o RunOptions) maxParallel(rootConf workspaces.WorkspaceConfig) int {
+	if o.Jobs > 0 {
+		return o.Jobs
+	}
+	if rootConf.MaxParallel > 0 {
+		return rootConf.MaxParallel
+	}
+	return runtime.NumCPU()
+}
+
+func RunCommand(command string, args []string, opts RunOptions) error {
 	rootConf, err := workspaces.GetConfig()
 
 	if err != nil {
 		return errors.Wrap(err, "error getting workspace config")
 	}
-	log.Trace().Msgf("Getting recipe for %s", command)
-	runStep, err := getRootRecipe(command, rootConf)
+	runStep, anythingToRun, err := getRecipe(command, rootConf, opts.Selection)
 	if err != nil {
-		return errors.Wrap(err, "Can't get root recipe")
+		return err
+	}
+	if !anythingToRun {
+		log.Info().Msgf("nothing that runs %s changed since %s", command, opts.Since)
+		return nil
 	}
 
-	var plugin plugins.PluginClient = nil
-	plugin, err = rootConf.GetCacher()
-	if err != nil {
-		log.Warn().Msgf("error getting caching plugin: %s. Disabling caching for now", err.Error())
+	rCtx := newRunContext(getCacher(rootConf))
+	rCtx.maxParallel = opts.maxParallel(rootConf)
+	rCtx.keepGoing = opts.KeepGoing
+	defer rCtx.Kill()
+	if opts.Interrupts != nil {
+		go rCtx.cancelOnSignal(opts.Interrupts, opts.GraceTimeout)
 	}
-	localCache := rootConf.GetLocalCacheDir()
-	cacher := newCacher(plugin, localCache)
-	rCtx := newRunContext(cacher)
-	defer rCtx.Cancel(9, 0)
 	err = runStep.Run(args, config.Get().GetPlugin, rCtx)
 
+	if opts.Summary != nil {
+		if summaryErr := writeSummary(opts.Summary, summarize(runStep)); summaryErr != nil {
+			log.Warn().Err(summaryErr).Msg("failed to write run summary")
+		}
+	}
 	return err
 }
 
-func getRootRecipe(command string, rootConfig workspaces.WorkspaceConfig) (*RunRecipe, error) {
-	recipeGraph := map[string]*RunRecipe{}
+func getCacher(rootConf workspaces.WorkspaceConfig) Cacher {
+	cachers, err := rootConf.GetCachers()
+	if err != nil {
+		log.Warn().Msgf("error getting caching plugins: %s. Using the caches that loaded", err.Error())
+	}
+	localCache := rootConf.GetLocalCacheDir()
+	if len(cachers) == 0 {
+		log.Warn().Msg("no caching plugin loaded, disabling caching for now")
+		return newCacher(nil, localCache)
+	}
+	if len(cachers) == 1 && !cachers[0].ReadOnly {
+		return newCacher(cachers[0].Client, localCache)
+	}
+	return newLayeredCacher(cachers, localCache)
+}
+
+// Selection narrows down which steps of the run graph run
+type Selection struct {
+	// Since is a git ref, when set only the packages changed since it and their dependants run
+	Since string
+	// Filters are globs of package names, when set only the matching packages run the command
+	Filters []string
+	// Excludes are globs of package names that don't run the command, unless a package that runs needs them
+	Excludes []string
+	// Only runs the selected steps without the steps they depend on
+	Only bool
+}
+
+func (s Selection) selects(pkg string) bool {
+	for _, exclude := range s.Excludes {
+		if ok, _ := path.Match(exclude, pkg); ok {
+			return false
+		}
+	}
+	if len(s.Filters) == 0 {
+		return true
+	}
+	for _, filter := range s.Filters {
+		if ok, _ := path.Match(filter, pkg); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// getRecipe builds the run graph of target, which is a command name or pkg:command for a single step, and narrows it
+// down to the selection. It reports whether anything is left to run.
+func getRecipe(target string, rootConf workspaces.WorkspaceConfig, sel Selection) (*RunRecipe, bool, error) {
+	for _, glob := range append(append([]string{}, sel.Filters...), sel.Excludes...) {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, false, errors.Wrapf(err, "invalid package glob %q", glob)
+		}
+	}
+	log.Trace().Msgf("Getting recipe for %s", target)
+	runStep, err := newRecipeBuilder(rootConf).recipe(target, sel)
+	if err != nil {
+		return nil, false, wrapUnlessCycle(err, "Can't get root recipe")
+	}
+	if sel.Only {
+		if runStep.runConfig != nil {
+			runStep.Needs = []*RunRecipe{}
+		} else {
+			for _, step := range runStep.Needs {
+				step.Needs = []*RunRecipe{}
+			}
+		}
+	}
+	if sel.Since == "" {
+		return runStep, true, nil
+	}
+	changed, err := rootConf.ChangedPackages(sel.Since)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "can't get the packages changed since %s", sel.Since)
+	}
+	return runStep, pruneUnaffected(runStep, changed), nil
+}
+
+// splitTarget splits pkg:command targets, a target whose part before the colon isn't a package is a command name
+func splitTarget(target string, rootConf workspaces.WorkspaceConfig) (string, string, bool) {
+	i := strings.Index(target, ":")
+	if i < 0 {
+		return "", "", false
+	}
+	pkg, command := target[:i], target[i+1:]
+	if pkg == rootConf.Name {
+		return pkg, command, true
+	}
+	if _, err := rootConf.GetPackageConfig(pkg); err != nil {
+		return "", "", false
+	}
+	return pkg, command, true
+}
+
+// recipeBuilder builds the run graph, sharing the step of a package's command between every step that needs it
+type recipeBuilder struct {
+	rootConfig workspaces.WorkspaceConfig
+	graph      map[string]*RunRecipe
+	// stack is the path of steps being built, edges[i] is the dependency from stack[i] to the step after it
+	stack []*RunRecipe
+	edges []DependencyEdge
+	// allowCycles keeps building when a step transitively needs itself, recording the cycle instead of failing
+	allowCycles bool
+	cycles      []*CycleError
+}
+
+func newRecipeBuilder(rootConfig workspaces.WorkspaceConfig) *recipeBuilder {
+	return &recipeBuilder{
+		rootConfig: rootConfig,
+		graph:      map[string]*RunRecipe{},
+	}
+}
+
+// aggregate is the root step that runs command in the packages it needs
+func (b *recipeBuilder) aggregate(command string) *RunRecipe {
 	runStep := &RunRecipe{
-		Pkg:         rootConfig.Name,
+		Pkg:         b.rootConfig.Name,
 		CommandName: command,
 		Needs:       []*RunRecipe{},
 		lock:        &sync.Mutex{},
-		pkgObject:   rootConfig,
+		pkgObject:   b.rootConfig,
 	}
-	recipeGraph[runStep.HashKey()] = runStep
-	cycleTracker := make(visitedSet)
+	return runStep
+}
 
-	var getDependencies func(command string, pkgConfig workspaces.WorkspaceConfig) (*RunRecipe, error)
-	getDependencies = func(command string, pkgConfig workspaces.WorkspaceConfig) (*RunRecipe, error) {
-		key := fmt.Sprintf("%s:%s", pkgConfig.Name, command)
-		runStep, ok := recipeGraph[key]
+// step returns the step running command in the package with pkgConfig, with every step it depends on
+func (b *recipeBuilder) step(command string, pkgConfig workspaces.WorkspaceConfig) (*RunRecipe, error) {
+	key := fmt.Sprintf("%s:%s", pkgConfig.Name, command)
+	runStep, ok := b.graph[key]
+	if !ok {
+		cmd, ok := pkgConfig.Commands[command]
 		if !ok {
-			cmd, ok := pkgConfig.Commands[command]
-			if !ok {
-				return nil, fmt.Errorf("command with name %s not found in pkg %s", command, pkgConfig.Name)
-			}
-			runStep = &RunRecipe{
-				Pkg:         pkgConfig.Name,
-				CommandName: command,
-				Needs:       []*RunRecipe{},
-				lock:        &sync.Mutex{},
-				runConfig:   &cmd,
-				pkgObject:   pkgConfig,
-			}
-			recipeGraph[runStep.HashKey()] = runStep
+			return nil, fmt.Errorf("command with name %s not found in pkg %s", command, pkgConfig.Name)
+		}
+		runStep = &RunRecipe{
+			Pkg:         pkgConfig.Name,
+			CommandName: command,
+			Needs:       []*RunRecipe{},
+			lock:        &sync.Mutex{},
+			runConfig:   &cmd,
+			pkgObject:   pkgConfig,
 		}
-		if cycleTracker.Has(runStep) {
-			runSteps := []string{}
-			for key := range cycleTracker {
-				runSteps = append(runSteps, key)
+		b.graph[runStep.HashKey()] = runStep
+	}
+	for i, onStack := range b.stack {
+		if onStack == runStep {
+			cycle := &CycleError{Edges: append([]DependencyEdge{}, b.edges[i:]...)}
+			if b.allowCycles {
+				b.cycles = append(b.cycles, cycle)
+				return runStep, nil
 			}
-			return nil, errors.Errorf("error: cycle detected %s", runSteps)
+			return nil, cycle
 		}
-		cycleTracker.Add(runStep)
-		defer cycleTracker.Remove(runStep)
+	}
+	b.stack = append(b.stack, runStep)
+	defer func() { b.stack = b.stack[:len(b.stack)-1] }()
 
-		cmd := pkgConfig.Commands[command]
-		for _, dep := range cmd.Dependencies {
-			if dep.PackageName == "." {
-				dep.PackageName = pkgConfig.Name
+	cmd := pkgConfig.Commands[command]
+	for _, dep := range cmd.Dependencies {
+		pkgNames, exact, err := b.rootConfig.DependencyTargets(pkgConfig, dep)
+		if err != nil {
+			return runStep, errors.Wrapf(err, "can't resolve the dependencies of %s", runStep.HashKey())
+		}
+		for _, pkgName := range pkgNames {
+			edge := DependencyEdge{
+				From: runStep.HashKey(),
+				To:   fmt.Sprintf("%s:%s", pkgName, dep.CommandName),
+				File: b.declaredIn(pkgConfig),
+				Line: dep.Line(),
 			}
-			conf, err := rootConfig.GetPackageConfig(dep.PackageName)
+			conf, err := b.packageConfig(pkgName)
 			if err != nil {
-				return runStep, errors.Wrapf(err, "error getting subpackage config for %s", dep.PackageName)
+				return runStep, errors.Wrapf(err, "%s", edge)
 			}
-			depRecipe, err := getDependencies(dep.CommandName, conf)
+			if _, ok := conf.Commands[dep.CommandName]; !ok && !exact {
+				log.Trace().Msgf("package %s does not have command %s", pkgName, dep.CommandName)
+				continue
+			}
+			b.edges = append(b.edges, edge)
+			depRecipe, err := b.step(dep.CommandName, conf)
+			b.edges = b.edges[:len(b.edges)-1]
 			if err != nil {
-				return runStep, errors.Wrapf(err, "can't build recipe for %s", dep.PackageName)
+				return runStep, wrapUnlessCycle(err, "%s", edge)
+			}
+			if !hasStep(runStep.Needs, depRecipe) {
+				runStep.Needs = append(runStep.Needs, depRecipe)
 			}
-			runStep.Needs = append(runStep.Needs, depRecipe)
+		}
+	}
+	return runStep, nil
+}
 
+func hasStep(steps []*RunRecipe, step *RunRecipe) bool {
+	for _, s := range steps {
+		if s == step {
+			return true
 		}
+	}
+	return false
+}
 
-		return runStep, nil
+func (b *recipeBuilder) packageConfig(name string) (workspaces.WorkspaceConfig, error) {
+	if name == b.rootConfig.Name {
+		if _, err := b.rootConfig.GetPackageConfig(name); err != nil {
+			return b.rootConfig, nil
+		}
 	}
+	return b.rootConfig.GetPackageConfig(name)
+}
 
-	if cmd, ok := rootConfig.Commands[command]; ok && len(cmd.Dependencies) > 0 {
-		rootCmd, err := getDependencies(command, rootConfig)
-		return rootCmd, err
-	} else {
-		for _, conf := range rootConfig.GetAllSubPackages() {
-			_, ok := conf.Commands[command]
-			if !ok {
-				log.Trace().Msgf("package %s does not have command %s", conf.Name, command)
-				continue
-			}
-			depRecipe, err := getDependencies(command, conf)
-			if err != nil {
-				return runStep, errors.Wrapf(err, "can't get recipe for command %s in package %s", command, conf.Name)
-			}
-			runStep.Needs = append(runStep.Needs, depRecipe)
+// recipe builds the run graph of target, a command name or pkg:command
+func (b *recipeBuilder) recipe(target string, sel Selection) (*RunRecipe, error) {
+	if pkg, command, ok := splitTarget(target, b.rootConfig); ok {
+		if len(sel.Filters) > 0 || len(sel.Excludes) > 0 {
+			return nil, fmt.Errorf("%s is a single step, it can't be combined with --filter or --exclude", target)
+		}
+		conf, err := b.packageConfig(pkg)
+		if err != nil {
+			return nil, err
+		}
+		return b.step(command, conf)
+	}
+	if len(sel.Filters) > 0 || len(sel.Excludes) > 0 {
+		return b.selected(target, sel)
+	}
+	return b.root(target)
+}
+
+func getRootRecipe(command string, rootConfig workspaces.WorkspaceConfig) (*RunRecipe, error) {
+	return newRecipeBuilder(rootConfig).root(command)
+}
+
+func (b *recipeBuilder) root(command string) (*RunRecipe, error) {
+	runStep := b.aggregate(command)
+
+	if cmd, ok := b.rootConfig.Commands[command]; ok && len(cmd.Dependencies) > 0 {
+		return b.step(command, b.rootConfig)
+	}
+	for _, conf := range b.rootConfig.GetAllSubPackages() {
+		_, ok := conf.Commands[command]
+		if !ok {
+			log.Trace().Msgf("package %s does not have command %s", conf.Name, command)
+			continue
 		}
-		if len(runStep.Needs) == 0 {
-			return runStep, fmt.Errorf("no command named %q", command)
+		depRecipe, err := b.step(command, conf)
+		if err != nil {
+			return runStep, wrapUnlessCycle(err, "can't get recipe for command %s in package %s", command, conf.Name)
 		}
-		return runStep, nil
+		runStep.Needs = append(runStep.Needs, depRecipe)
 	}
+	if len(runStep.Needs) == 0 {
+		return runStep, fmt.Errorf("no command named %q", command)
+	}
+	return runStep, nil
+}
 
+// selected runs command in the packages, including the workspace itself, that the selection selects
+func (b *recipeBuilder) selected(command string, sel Selection) (*RunRecipe, error) {
+	runStep := b.aggregate(command)
+	candidates := []workspaces.WorkspaceConfig{}
+	if _, ok := b.rootConfig.Commands[command]; ok {
+		candidates = append(candidates, b.rootConfig)
+	}
+	for _, conf := range b.rootConfig.GetAllSubPackages() {
+		candidates = append(candidates, conf)
+	}
+	for _, conf := range candidates {
+		if _, ok := conf.Commands[command]; !ok || !sel.selects(conf.Name) {
+			continue
+		}
+		depRecipe, err := b.step(command, conf)
+		if err != nil {
+			return runStep, wrapUnlessCycle(err, "can't get recipe for command %s in package %s", command, conf.Name)
+		}
+		runStep.Needs = append(runStep.Needs, depRecipe)
+	}
+	if len(runStep.Needs) == 0 {
+		return runStep, fmt.Errorf("no selected package has a command named %q", command)
+	}
+	return runStep, nil
 }
 
 type commandNotFoundErr struct {
@@ -4,7 +4,12 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/pkg/errors"
 	plugins "github.com/radding/harbor-plugins"
@@ -33,37 +38,82 @@ func (v *visitedSet) Remove(h Hasher) {
 	delete((*v), h.HashKey())
 }
 
+// killWait is how long to wait for a task to report it stopped after it was sent SIGKILL
+const killWait = 5 * time.Second
+
 type runContext struct {
 	cancelCtx  context.Context
 	cancelFunc context.CancelFunc
-	cacher     Cacher
+	cancelOnce *sync.Once
+	signal     int64
+	timeoutMS  int64
+	// forceKill is closed when running tasks should be killed without waiting for the timeout
+	forceKill     chan struct{}
+	forceKillOnce *sync.Once
+	cacher        Cacher
+	// maxParallel is the number of slots available to run steps in, 0 or less means unbounded
+	maxParallel int
+	// keepGoing lets independent steps keep running after a step fails instead of canceling the run
+	keepGoing bool
 }
 
 func newRunContext(cacher Cacher) *runContext {
 	ctx, cancel := context.WithCancel(context.Background())
 	return &runContext{
-		cancelCtx:  ctx,
-		cancelFunc: cancel,
-		cacher:     cacher,
+		cancelCtx:     ctx,
+		cancelFunc:    cancel,
+		cancelOnce:    &sync.Once{},
+		forceKill:     make(chan struct{}),
+		forceKillOnce: &sync.Once{},
+		cacher:        cacher,
 	}
 }
 
+// Cancel stops the run, running tasks get sent signal and are killed if they haven't stopped after
+// timeoutMS. Only the first call has an effect.
 func (r *runContext) Cancel(signal int64, timeoutMS int64) {
-	r.cancelCtx = context.WithValue(r.cancelCtx, "signal", signal)
-	r.cancelCtx = context.WithValue(r.cancelCtx, "timeout", timeoutMS)
-	r.cancelFunc()
+	r.cancelOnce.Do(func() {
+		r.signal = signal
+		r.timeoutMS = timeoutMS
+		r.cancelFunc()
+	})
+}
+
+// Kill kills running tasks right away, even if they are still within the timeout given to Cancel
+func (r *runContext) Kill() {
+	r.Cancel(9, 0)
+	r.forceKillOnce.Do(func() {
+		close(r.forceKill)
+	})
 }
 
 func (r *runContext) SignalAndTimeoutValue() (int64, int64) {
-	val, ValOk := r.cancelCtx.Value("signal").(int64)
-	if !ValOk {
-		val = 0
-	}
-	timeout, timeoutOk := r.cancelCtx.Value("timeout").(int64)
-	if !timeoutOk {
-		timeout = 0
+	<-r.cancelCtx.Done()
+	return r.signal, r.timeoutMS
+}
+
+// cancelOnSignal cancels the run with the first signal received on signals, a second signal kills
+// every running task without waiting for the grace timeout.
+func (r *runContext) cancelOnSignal(signals <-chan os.Signal, grace time.Duration) {
+	for i := 0; ; i++ {
+		var sig os.Signal
+		select {
+		case sig = <-signals:
+		case <-r.forceKill:
+			return
+		}
+		if i > 0 {
+			log.Warn().Msgf("received %s again, killing running steps", sig)
+			r.Kill()
+			return
+		}
+		signal := int64(2)
+		if sysSig, ok := sig.(syscall.Signal); ok {
+			signal = int64(sysSig)
+		}
+		log.Warn().Msgf("received %s, stopping running steps (killing them after %s)", sig, grace)
+		r.Cancel(signal, grace.Milliseconds())
 	}
-	return val, timeout
 }
 
 type RunRecipe struct {
@@ -75,6 +125,14 @@ type RunRecipe struct {
 	err         error
 	pkgObject   workspaces.WorkspaceConfig
 	lock        *sync.Mutex
+
+	// status, reason, exitCode and duration describe the outcome of the step for the run summary
+	status   stepStatus
+	reason   string
+	exitCode int64
+	duration time.Duration
+	// conditionNote is why the step ran although one of its conditions couldn't be evaluated
+	conditionNote string
 }
 
 func (r RunRecipe) Eq(r2 RunRecipe) bool {
@@ -85,68 +143,148 @@ func (r RunRecipe) HashKey() string {
 	return fmt.Sprintf("%s:%s", r.Pkg, r.CommandName)
 }
 
-type runnerFetcher func(name string) (plugins.PluginClient, error)
-
-func (r *RunRecipe) Run(args []string, fetcher runnerFetcher, runCtx *runContext) error {
-	r.lock.Lock()
-	defer r.lock.Unlock()
-	if r.runConfig != nil {
-		shouldRun := true
-		for _, cond := range r.runConfig.RunConditions {
-			res, err := cond.Expr.Evaluate(r.pkgObject.VariableLookUpService())
-			if err != nil {
-				log.Warn().Str("Identifier", r.HashKey()).Msg("failed to evaluate run conditions, assuming true")
-				continue
+// checkConditions evaluates the run conditions of the step with the arguments of the run, a step without
+// conditions always runs. When the step doesn't run, reason says why. A condition that can't be evaluated is
+// handled by its on_error policy, a step that fails because of it returns an error.
+func (r *RunRecipe) checkConditions(args []string) (run bool, reason string, err error) {
+	if r.runConfig == nil {
+		return true, "", nil
+	}
+	lookup := r.pkgObject.VariableLookUpService(args...)
+	for _, cond := range r.runConfig.RunConditions {
+		res, err := cond.Expr.Evaluate(lookup)
+		if err != nil {
+			switch cond.Policy() {
+			case workspaces.ConditionFail:
+				return false, fmt.Sprintf("condition %q can't be evaluated", cond.Source()), errors.Wrapf(err, "can't evaluate condition %q of %s", cond.Source(), r.HashKey())
+			case workspaces.ConditionSkip:
+				return false, fmt.Sprintf("condition %q can't be evaluated: %s", cond.Source(), err), nil
 			}
-			shouldRun = shouldRun && res
+			log.Warn().Err(err).Str("Identifier", r.HashKey()).Msgf("can't evaluate condition %q, running anyway", cond.Source())
+			r.conditionNote = fmt.Sprintf("condition %q can't be evaluated, ran anyway: %s", cond.Source(), err)
+			continue
 		}
-		if !shouldRun {
-			r.done = true
-			log.Info().Str("Identifier", r.HashKey()).Msg("Run conditions evaluated to false, skipping")
-			return nil
+		if !res {
+			return false, fmt.Sprintf("condition %q is false", cond.Source()), nil
+		}
+	}
+	return true, "", nil
+}
+
+// resolvedConfig is the command of the step with the variables in its command and options resolved for a run
+// with args
+func (r *RunRecipe) resolvedConfig(args []string) (workspaces.Command, error) {
+	runConfig, err := r.pkgObject.ResolveCommand(*r.runConfig, args)
+	if err != nil {
+		return runConfig, errors.Wrapf(err, "can't resolve the variables of %s", r.HashKey())
+	}
+	return runConfig, nil
+}
+
+// environ is harbor's environment with env over it, runners get it instead of inheriting theirs
+func environ(env map[string]string) map[string]string {
+	res := map[string]string{}
+	for _, kv := range os.Environ() {
+		if key, value, ok := strings.Cut(kv, "="); ok {
+			res[key] = value
 		}
+	}
+	for key, value := range env {
+		res[key] = value
+	}
+	return res
+}
+
+// stopTask sends signal to the task and waits for it to finish. If it is still running after
+// timeoutMS, or forceKill is closed, it is sent SIGKILL.
+func (r *RunRecipe) stopTask(task plugins.ClientTask, done <-chan struct{}, signal int64, timeoutMS int64, forceKill <-chan struct{}) plugins.RunResponse {
+	if err := task.Stop(signal, timeoutMS); err != nil {
+		log.Error().Err(err).Str("Identifier", r.HashKey()).Msg("failed to stop task")
+	}
+	timeout := time.NewTimer(time.Duration(timeoutMS) * time.Millisecond)
+	defer timeout.Stop()
+	select {
+	case <-done:
+		return task.Status()
+	case <-timeout.C:
+		log.Warn().Str("Identifier", r.HashKey()).Msgf("task did not stop within %dms, killing it", timeoutMS)
+	case <-forceKill:
+	}
+	if err := task.Stop(9, 0); err != nil {
+		log.Error().Err(err).Str("Identifier", r.HashKey()).Msg("failed to kill task")
+	}
+	select {
+	case <-done:
+	case <-time.After(killWait):
+		log.Error().Str("Identifier", r.HashKey()).Msgf("task still running %s after being killed, giving up on it", killWait)
+	}
+	return task.Status()
+}
 
+type runnerFetcher func(name string) (plugins.PluginClient, error)
+
+// Run runs the step and everything it needs, scheduling at most runCtx.maxParallel steps at a time
+func (r *RunRecipe) Run(args []string, fetcher runnerFetcher, runCtx *runContext) error {
+	return newScheduler(r, args, runCtx).run(args, fetcher)
+}
+
+// weight returns the number of parallel slots the step claims while it runs
+func (r *RunRecipe) weight() int {
+	if r.runConfig == nil || r.runConfig.Resources < 1 {
+		return 1
+	}
+	return r.runConfig.Resources
+}
+
+// collectOutputs finds the files matching the outputs of the step so they can be cached
+func (r *RunRecipe) collectOutputs() ([]plugins.CacheItem, error) {
+	if r.runConfig == nil || len(r.runConfig.Outputs) == 0 {
+		return nil, nil
+	}
+	root := r.pkgObject.WorkspaceRoot()
+	files, err := plugins.CollectFiles(root, r.runConfig.Outputs, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't collect outputs")
+	}
+	if len(files) == 0 {
+		log.Warn().Str("Identifier", r.HashKey()).Msgf("no files matched the outputs %v", r.runConfig.Outputs)
+	}
+	artifacts := []plugins.CacheItem{}
+	for _, file := range files {
+		artifacts = append(artifacts, plugins.CacheItem{
+			ArtifactPath: filepath.Join(root, filepath.FromSlash(file)),
+			ArtifactName: file,
+		})
 	}
+	return artifacts, nil
+}
+
+// execute runs only this step, the scheduler guarantees that everything in r.Needs has already run
+func (r *RunRecipe) execute(args []string, fetcher runnerFetcher, runCtx *runContext) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if r.done {
 		log.Trace().Str("Identifier", r.HashKey()).Msg("Step has been run, skipping")
 		return r.err
 	}
 
 	log.Trace().Str("Identifier", r.HashKey()).Msg("starting to run")
-
-	wg := sync.WaitGroup{}
-	for _, dep := range r.Needs {
-		log.Trace().Str("Identifier", r.HashKey()).Msgf("Waiting for dependency %s", dep.HashKey())
-		wg.Add(1)
-		go func(dep *RunRecipe) {
-			defer wg.Done()
-			if !errors.Is(runCtx.cancelCtx.Err(), context.Canceled) {
-				err := dep.Run(args, fetcher, runCtx)
-				if err != nil {
-					if r.err == nil {
-						r.err = err
-					} else {
-						r.err = errors.Wrap(r.err, err.Error())
-					}
-				}
-			}
-		}(dep)
-	}
-	wg.Wait()
 	if errors.Is(runCtx.cancelCtx.Err(), context.Canceled) {
-		if r.err != nil {
-			return r.err
-		}
 		r.err = fmt.Errorf("run Context was canceled")
-	}
-	if r.err != nil {
+		r.setStatus(stepSkipped, "run was canceled")
 		return r.err
 	}
-	cacheKey, err := runCtx.cacher.CalculateCacheKey(r)
+	start := time.Now()
+	defer func() {
+		r.duration = time.Since(start)
+	}()
+	cacheKey, err := runCtx.cacher.CalculateCacheKey(r, args...)
 	if err != nil {
+		r.setStatus(stepFailed, "can't get cache key")
 		return errors.Wrap(err, "can't get cache key")
 	}
-	fromCache, err := runCtx.cacher.ReplayCachedLogs(cacheKey, &replayer{})
+	// Artifacts are restored here, before the scheduler lets any dependant start
+	fromCache, err := runCtx.cacher.ReplayCachedLogs(cacheKey, &replayer{}, r.pkgObject.WorkspaceRoot())
 	if err != nil {
 		log.Warn().Err(err).Msg("error retrieving from cache, just redoing it")
 	}
@@ -160,27 +298,36 @@ func (r *RunRecipe) Run(args []string, fetcher runnerFetcher, runCtx *runContext
 			r.done = true
 			return r.err
 		}
+		runConfig, err := r.resolvedConfig(args)
+		if err != nil {
+			r.err = err
+			r.setStatus(stepFailed, "can't resolve variables")
+			return err
+		}
 		runner, err := fetcher(r.runConfig.Type)
 		if err != nil {
 			r.err = err
+			r.setStatus(stepFailed, fmt.Sprintf("can't get runner %s", r.runConfig.Type))
 			return err
 		}
 		var task plugins.ClientTask
 		logger.Info().Msgf("Starting command %s", r.HashKey())
 		log.Info().Msgf("Starting command %s", r.HashKey())
 		task, r.err = runner.Run(plugins.RunRequest{
-			RunCommand:     r.runConfig.Command,
+			RunCommand:     runConfig.Command,
 			Args:           args,
 			Path:           r.pkgObject.WorkspaceRoot(),
 			PackageName:    r.Pkg,
 			CommandName:    r.CommandName,
-			Settings:       plugins.YamlToStruct(r.runConfig.Settings),
+			Settings:       plugins.YamlToStruct(runConfig.Settings),
+			Env:            environ(runConfig.Env),
 			StepIdentifier: r.HashKey(),
 		}, plugins.WithLogCapture(buf, r.HashKey()))
 		if r.err != nil {
+			r.setStatus(stepFailed, "runner failed to start the task")
 			return r.err
 		}
-		done := make(chan struct{})
+		done := make(chan struct{}, 1)
 
 		go func() {
 			task.Wait()
@@ -195,28 +342,50 @@ func (r *RunRecipe) Run(args []string, fetcher runnerFetcher, runCtx *runContext
 			if signal == 0 {
 				signal = 2
 			}
-			task.Stop(signal, timeoutMs)
+			stats := r.stopTask(task, done, signal, timeoutMs, runCtx.forceKill)
+			r.exitCode = stats.ExitCode
 			r.err = fmt.Errorf("global run context was canceled, canceling my tasks")
+			r.setStatus(stepFailed, fmt.Sprintf("canceled while running (%s)", stats.Status))
 		case <-done:
 			stats := task.Status()
 			logger.Debug().Msgf("task result: {status = %s, exitcode = %d, time elapsed = %d", stats.Status, stats.ExitCode, stats.TimeElapsed)
 			log.Debug().Msgf("task result: {status = %s, exitcode = %d, time elapsed = %d", stats.Status, stats.ExitCode, stats.TimeElapsed)
+			r.exitCode = stats.ExitCode
 			if stats.Status == proto.RunStatus_CRASHED {
 				r.err = fmt.Errorf("task failed with exit code: %d", stats.ExitCode)
-				runCtx.Cancel(9, 0)
+				r.setStatus(stepFailed, "task crashed")
+				// In keep going mode only the dependants of this step are skipped
+				if !runCtx.keepGoing {
+					runCtx.Cancel(9, 0)
+				}
+			} else {
+				r.setStatus(stepSucceeded, "")
 			}
 		}
 		r.done = true
 		logger.Info().Msgf("%s finished", r.HashKey())
 		log.Info().Msgf("%s finished", r.HashKey())
-		err = runCtx.cacher.WriteLogsToCache(cacheKey, buf)
+		// Failed runs are not cached, otherwise the next run would replay the failure as a success
+		if r.err != nil {
+			return r.err
+		}
+		artifacts, err := r.collectOutputs()
+		if err != nil {
+			log.Error().Err(err).Msgf("failed to collect the outputs of %s", r.HashKey())
+			r.err = err
+			r.setStatus(stepFailed, "failed to collect outputs")
+			return r.err
+		}
+		err = runCtx.cacher.WriteLogsToCache(cacheKey, buf, artifacts...)
 		if err != nil {
 			logger.Error().Err(err).Msgf("failed to cache %s", r.HashKey())
 			log.Error().Err(err).Msgf("failed to cache %s", r.HashKey())
 			r.err = err
+			r.setStatus(stepFailed, "failed to write to the cache")
 		}
 	} else {
 		log.Debug().Msgf("%s was cached, replaying it now", r.HashKey())
+		r.setStatus(stepCached, "")
 	}
 	return r.err
 }
@@ -3,7 +3,9 @@ package runners
 import (
 	"fmt"
 	"io"
+	"os"
 	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -23,13 +25,18 @@ func (m *mockCache) CalculateCacheKey(r *RunRecipe, additionalData ...string) (s
 	return "cached_key", nil
 }
 
-func (m *mockCache) ReplayCachedLogs(cacheKey string, w io.Writer) (bool, error) {
-	m.Called(cacheKey, w)
+func (m *mockCache) ReplayCachedLogs(cacheKey string, w io.Writer, restoreTo string) (bool, error) {
+	m.Called(cacheKey, w, restoreTo)
 	return false, nil
 }
 
-func (m *mockCache) WriteLogsToCache(cacheKey string, r io.Reader) error {
-	m.Called(cacheKey, r)
+func (m *mockCache) IsCached(cacheKey string) (bool, error) {
+	m.Called(cacheKey)
+	return false, nil
+}
+
+func (m *mockCache) WriteLogsToCache(cacheKey string, r io.Reader, artifacts ...plugins.CacheItem) error {
+	m.Called(cacheKey, r, artifacts)
 	return nil
 }
 
@@ -92,16 +99,36 @@ func (m *MockPlugin) Kill() {
 	m.Called()
 }
 
-func (m *MockPlugin) GetCacheKey(localdirectory string, dependencyKeys []string, additionalData []string) (string, error) {
-	m.Called(localdirectory, dependencyKeys, additionalData)
+func (m *MockPlugin) GetCacheKey(req plugins.CacheKeyRequest) (string, error) {
+	m.Called(req.LocalDirectory, req.DependantCacheKeys, req.AdditionalData)
 	return "", nil
 }
 
-func (m *MockPlugin) Cache(cacheKey string, LocalCacheDirectory string, cacheItems chan plugins.CacheItem) error {
-	m.Called(cacheKey, LocalCacheDirectory, cacheItems)
+func (m *MockPlugin) ConfigureCache(settings map[string]interface{}) error {
+	m.Called(settings)
+	return nil
+}
+
+func (m *MockPlugin) Cache(cacheKey string, LocalCacheDirectory string, metadata plugins.CacheMetadata, cacheItems chan plugins.CacheItem) error {
+	m.Called(cacheKey, LocalCacheDirectory, metadata, cacheItems)
 	return nil
 }
 
+func (m *MockPlugin) ListCache(localCacheDir string) ([]*plugins.CacheEntry, error) {
+	m.Called(localCacheDir)
+	return []*plugins.CacheEntry{}, nil
+}
+
+func (m *MockPlugin) HasCache(cacheKey string, localCacheDir string) (bool, error) {
+	m.Called(cacheKey, localCacheDir)
+	return false, nil
+}
+
+func (m *MockPlugin) PruneCache(req *plugins.PruneRequest) (*plugins.PruneResponse, error) {
+	m.Called(req)
+	return &plugins.PruneResponse{}, nil
+}
+
 func (m *MockPlugin) ReplayCache(cacheKey string, localCacheDir string) (chan plugins.CacheItem, bool, error) {
 	m.Called(cacheKey, localCacheDir)
 	ch := make(chan plugins.CacheItem)
@@ -109,6 +136,48 @@ func (m *MockPlugin) ReplayCache(cacheKey string, localCacheDir string) (chan pl
 	return ch, false, nil
 }
 
+func (m *MockPlugin) PeekCache(cacheKey string, localCacheDir string) (chan plugins.CacheItem, bool, error) {
+	m.Called(cacheKey, localCacheDir)
+	ch := make(chan plugins.CacheItem)
+	defer close(ch)
+	return ch, false, nil
+}
+
+func (m *MockPlugin) ReleaseReplay(cacheKey string, localCacheDir string) error {
+	m.Called(cacheKey, localCacheDir)
+	return nil
+}
+
+func (m *MockPlugin) CanHandle(req plugins.CanHandleRequest) (bool, error) {
+	m.Called(req.Url)
+	return false, nil
+}
+
+func (m *MockPlugin) Clone(req plugins.CloneRequest) (*plugins.CloneResponse, error) {
+	m.Called(req.Source, req.Destination)
+	return &plugins.CloneResponse{Destination: req.Destination}, nil
+}
+
+func (m *MockPlugin) RegisterCommand() (*plugins.RegisterCommandResponse, error) {
+	m.Called()
+	return &plugins.RegisterCommandResponse{}, nil
+}
+
+func (m *MockPlugin) RunCommand(req *plugins.HandleCommandRequest, handler plugins.CommandHandler) error {
+	m.Called(req, handler)
+	return nil
+}
+
+func (m *MockPlugin) Namespaces() ([]string, error) {
+	m.Called()
+	return []string{}, nil
+}
+
+func (m *MockPlugin) ResolveVariable(req *plugins.ResolveVariableRequest) (interface{}, bool, error) {
+	m.Called(req.Namespace, req.Name)
+	return nil, false, nil
+}
+
 func TestCanRunTestFine(t *testing.T) {
 	assert := assert.New(t)
 	mockT := &mockTask{}
@@ -117,8 +186,8 @@ func TestCanRunTestFine(t *testing.T) {
 	mockT.On("Status", mock.Anything)
 	mockT.On("Stop", mock.Anything, mock.Anything)
 	mockedcacher.On("CalculateCacheKey", mock.Anything, mock.Anything).Once()
-	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything).Once()
-	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything).Once()
+	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything, mock.Anything).Once()
+	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything, mock.Anything).Once()
 
 	mockPlugin := &MockPlugin{
 		mockTask: mockT,
@@ -162,8 +231,8 @@ func TestRunsInCorrectOrder(t *testing.T) {
 
 	mockedcacher := &mockCache{}
 	mockedcacher.On("CalculateCacheKey", mock.Anything, mock.Anything)
-	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything)
-	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything)
+	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything, mock.Anything)
+	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything, mock.Anything)
 
 	mockT.On("Wait", mock.Anything)
 	mockT.On("Status", mock.Anything)
@@ -240,8 +309,8 @@ func TestEachStepOnlyRunsOnce(t *testing.T) {
 
 	mockedcacher := &mockCache{}
 	mockedcacher.On("CalculateCacheKey", mock.Anything, mock.Anything)
-	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything)
-	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything)
+	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything, mock.Anything)
+	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything, mock.Anything)
 
 	mockT := &mockTask{}
 	mockT.On("Wait", mock.Anything)
@@ -323,8 +392,8 @@ func TestWillReturnErrorsFromChildren(t *testing.T) {
 
 	mockedcacher := &mockCache{}
 	mockedcacher.On("CalculateCacheKey", mock.Anything, mock.Anything)
-	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything)
-	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything)
+	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything, mock.Anything)
+	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything, mock.Anything)
 
 	mockT := &mockTask{}
 	mockT.On("Wait", mock.Anything)
@@ -383,3 +452,61 @@ func TestWillReturnErrorsFromChildren(t *testing.T) {
 	// call test4 and test1
 	mockPlugin.AssertNumberOfCalls(t, "Run", 2)
 }
+
+// stubbornTask ignores every signal except SIGKILL
+type stubbornTask struct {
+	signals chan int64
+	done    chan struct{}
+}
+
+func (s *stubbornTask) Wait() plugins.RunResponse {
+	<-s.done
+	return s.Status()
+}
+
+func (s *stubbornTask) Status() plugins.RunResponse {
+	select {
+	case <-s.done:
+		return plugins.RunResponse{Status: proto.RunStatus_CANCELED, ExitCode: -1}
+	default:
+		return plugins.RunResponse{Status: proto.RunStatus_RUNNING}
+	}
+}
+
+func (s *stubbornTask) Stop(signal int64, timeoutMS int64) error {
+	s.signals <- signal
+	if signal == 9 {
+		close(s.done)
+	}
+	return nil
+}
+
+func TestStopTaskEscalatesAfterTimeout(t *testing.T) {
+	assert := assert.New(t)
+	task := &stubbornTask{signals: make(chan int64, 2), done: make(chan struct{})}
+	recipe := &RunRecipe{CommandName: "test", lock: &sync.Mutex{}}
+
+	status := recipe.stopTask(task, task.done, 15, 50, make(chan struct{}))
+	assert.Equal(proto.RunStatus_CANCELED, status.Status)
+	assert.Equal(int64(15), <-task.signals)
+	assert.Equal(int64(9), <-task.signals)
+}
+
+func TestSecondSignalKillsRunningTasks(t *testing.T) {
+	assert := assert.New(t)
+	rCtx := newRunContext(&mockCache{})
+	signals := make(chan os.Signal, 2)
+	go rCtx.cancelOnSignal(signals, time.Hour)
+
+	signals <- syscall.SIGTERM
+	<-rCtx.cancelCtx.Done()
+	signal, timeout := rCtx.SignalAndTimeoutValue()
+	assert.Equal(int64(syscall.SIGTERM), signal)
+	assert.Equal(time.Hour.Milliseconds(), timeout)
+
+	task := &stubbornTask{signals: make(chan int64, 2), done: make(chan struct{})}
+	recipe := &RunRecipe{CommandName: "test", lock: &sync.Mutex{}}
+	signals <- os.Interrupt
+	status := recipe.stopTask(task, task.done, signal, timeout, rCtx.forceKill)
+	assert.Equal(proto.RunStatus_CANCELED, status.Status)
+}
@@ -74,6 +74,15 @@ func (r *RunRecipe) assertMatches(other *RunRecipe) bool {
 	return commandNameMatches && pkgMatches && lenOfDepsMatch && depsMatch
 }
 
+// hashKeys are the hash keys of steps, in order
+func hashKeys(steps []*RunRecipe) []string {
+	keys := []string{}
+	for _, step := range steps {
+		keys = append(keys, step.HashKey())
+	}
+	return keys
+}
+
 func TestWillCreateASimpleRunRecipeFromSimpleConfig(t *testing.T) {
 	assert := assert.New(t)
 	conf := workspaces.WorkspaceConfig{
@@ -205,3 +214,66 @@ func TestThrowsErrorOnCircularDependency(t *testing.T) {
 	_, err := getRootRecipe("command1", conf)
 	assert.Error(err)
 }
+
+func TestSelectionNarrowsTheRecipe(t *testing.T) {
+	assert := assert.New(t)
+	recipe, ok, err := getRecipe("command1", defaultConf, Selection{Filters: []string{"*A", "*B"}, Excludes: []string{"subPackageA"}})
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal([]string{"subPackageB:command1"}, hashKeys(recipe.Needs))
+	assert.Equal([]string{"subPackageC:command3"}, hashKeys(recipe.Needs[0].Needs), "dependencies of selected packages still run")
+
+	recipe, _, err = getRecipe("subPackageA:command1", defaultConf, Selection{})
+	assert.NoError(err)
+	assert.Equal("subPackageA:command1", recipe.HashKey())
+	assert.Equal([]string{"subPackageA:command2"}, hashKeys(recipe.Needs))
+
+	recipe, _, err = getRecipe("subPackageA:command1", defaultConf, Selection{Only: true})
+	assert.NoError(err)
+	assert.Empty(recipe.Needs)
+
+	recipe, _, err = getRecipe("command1", defaultConf, Selection{Only: true})
+	assert.NoError(err)
+	assert.Len(recipe.Needs, 2)
+	for _, step := range recipe.Needs {
+		assert.Empty(step.Needs)
+	}
+
+	_, _, err = getRecipe("command1", defaultConf, Selection{Excludes: []string{"*"}})
+	assert.Error(err)
+	_, _, err = getRecipe("subPackageA:command1", defaultConf, Selection{Filters: []string{"*"}})
+	assert.Error(err)
+	_, _, err = getRecipe("command1", defaultConf, Selection{Filters: []string{"["}})
+	assert.Error(err)
+	_, _, err = getRecipe("notAPackage:command1", defaultConf, Selection{})
+	assert.Error(err, "the whole target is a command name when its prefix isn't a package")
+}
+
+func TestUpstreamAndGlobDependencies(t *testing.T) {
+	assert := assert.New(t)
+	build := workspaces.Command{Type: "test1", Command: "test"}
+	conf := workspaces.WorkspaceConfig{Name: "ws"}
+	conf.AddSubPackage("plugins/cache", workspaces.WorkspaceConfig{Commands: map[string]workspaces.Command{"build": build}})
+	conf.AddSubPackage("plugins/docs", workspaces.WorkspaceConfig{})
+	conf.AddSubPackage("lib", workspaces.WorkspaceConfig{Commands: map[string]workspaces.Command{"build": build}})
+	conf.AddSubPackage("app", workspaces.WorkspaceConfig{
+		Dependencies: []string{"plugins/*", "lib"},
+		Commands: map[string]workspaces.Command{
+			"build": {
+				Type:         "test1",
+				Dependencies: []workspaces.Dependency{{CommandName: "build", Upstream: true}},
+			},
+			"test": {
+				Type:         "test1",
+				Dependencies: []workspaces.Dependency{{PackageName: "plugins/*", CommandName: "build"}},
+			},
+		},
+	})
+	recipe, _, err := getRecipe("app:build", conf, Selection{})
+	assert.NoError(err)
+	assert.Equal([]string{"lib:build", "plugins/cache:build"}, hashKeys(recipe.Needs), "packages without the command are skipped")
+
+	recipe, _, err = getRecipe("app:test", conf, Selection{})
+	assert.NoError(err)
+	assert.Equal([]string{"plugins/cache:build"}, hashKeys(recipe.Needs))
+}
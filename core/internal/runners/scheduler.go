@@ -0,0 +1,165 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor/internal/multierror"
+	"github.com/rs/zerolog/log"
+)
+
+// scheduler runs a recipe graph in topological order, only running steps whose needs have finished
+// and never using more than runCtx.maxParallel slots at once.
+type scheduler struct {
+	runCtx *runContext
+	// steps is topologically sorted, every step comes after the steps it needs
+	steps      []*RunRecipe
+	waitingOn  map[string]int
+	dependants map[string][]*RunRecipe
+}
+
+type stepResult struct {
+	step   *RunRecipe
+	weight int
+	err    error
+}
+
+func newScheduler(root *RunRecipe, args []string, runCtx *runContext) *scheduler {
+	s := &scheduler{
+		runCtx:     runCtx,
+		steps:      []*RunRecipe{},
+		waitingOn:  map[string]int{},
+		dependants: map[string][]*RunRecipe{},
+	}
+	visited := make(visitedSet)
+	var collect func(r *RunRecipe)
+	collect = func(r *RunRecipe) {
+		if visited.Has(r) {
+			return
+		}
+		visited.Add(r)
+		// Steps whose conditions are false don't pull in what they need
+		if !r.done {
+			run, reason, err := r.checkConditions(args)
+			if err != nil {
+				r.done = true
+				r.err = err
+				r.setStatus(stepFailed, reason)
+				log.Error().Err(err).Str("Identifier", r.HashKey()).Msg("Run conditions can't be evaluated, failing")
+			} else if !run {
+				r.done = true
+				r.setStatus(stepSkipped, reason)
+				log.Info().Str("Identifier", r.HashKey()).Msgf("%s, skipping", reason)
+			}
+		}
+		if !r.done {
+			needs := make(visitedSet)
+			for _, dep := range r.Needs {
+				if needs.Has(dep) {
+					continue
+				}
+				needs.Add(dep)
+				collect(dep)
+				s.waitingOn[r.HashKey()]++
+				s.dependants[dep.HashKey()] = append(s.dependants[dep.HashKey()], r)
+			}
+		}
+		s.steps = append(s.steps, r)
+	}
+	collect(root)
+	return s
+}
+
+func (s *scheduler) slots() int {
+	return s.runCtx.maxParallel
+}
+
+// weight clamps the weight of a step to the number of slots so heavy steps can always be scheduled
+func (s *scheduler) weight(r *RunRecipe) int {
+	weight := r.weight()
+	if s.slots() > 0 && weight > s.slots() {
+		return s.slots()
+	}
+	return weight
+}
+
+func (s *scheduler) canceled() bool {
+	return errors.Is(s.runCtx.cancelCtx.Err(), context.Canceled)
+}
+
+func (s *scheduler) run(args []string, fetcher runnerFetcher) error {
+	ready := []*RunRecipe{}
+	for _, step := range s.steps {
+		if s.waitingOn[step.HashKey()] == 0 {
+			ready = append(ready, step)
+		}
+	}
+	failed := make(visitedSet)
+	results := make(chan stepResult)
+	running, used := 0, 0
+	stopped := false
+	var runErr error
+
+	for len(ready) > 0 || running > 0 {
+		for len(ready) > 0 && !s.canceled() && !stopped {
+			step := ready[0]
+			weight := s.weight(step)
+			// Steps start in order, so a heavy step at the front of the queue waits for enough slots
+			// instead of being starved by lighter steps behind it
+			if s.slots() > 0 && running > 0 && used+weight > s.slots() {
+				break
+			}
+			ready = ready[1:]
+			running++
+			used += weight
+			log.Trace().Str("Identifier", step.HashKey()).Msgf("scheduling step, %d/%d slots in use", used, s.slots())
+			go func(step *RunRecipe, weight int) {
+				results <- stepResult{
+					step:   step,
+					weight: weight,
+					err:    step.execute(args, fetcher, s.runCtx),
+				}
+			}(step, weight)
+		}
+		if running == 0 {
+			// Canceled or stopped with steps still waiting to be started
+			break
+		}
+
+		res := <-results
+		running--
+		used -= res.weight
+		if res.err != nil {
+			runErr = multierror.Append(runErr, res.err)
+			s.failDependants(res.step, res.err, failed)
+			// Without keep going, steps that already started finish but nothing new is started
+			stopped = !s.runCtx.keepGoing
+			continue
+		}
+		for _, dependant := range s.dependants[res.step.HashKey()] {
+			s.waitingOn[dependant.HashKey()]--
+			if s.waitingOn[dependant.HashKey()] == 0 && !failed.Has(dependant) {
+				ready = append(ready, dependant)
+			}
+		}
+	}
+	if s.canceled() && runErr == nil {
+		runErr = fmt.Errorf("run Context was canceled")
+	}
+	return runErr
+}
+
+// failDependants marks everything that transitively needs step as failed so it never gets scheduled
+func (s *scheduler) failDependants(step *RunRecipe, err error, failed visitedSet) {
+	for _, dependant := range s.dependants[step.HashKey()] {
+		if failed.Has(dependant) {
+			continue
+		}
+		failed.Add(dependant)
+		dependant.done = true
+		dependant.err = errors.Wrapf(err, "dependency %s failed", step.HashKey())
+		dependant.setStatus(stepSkipped, fmt.Sprintf("dependency %s failed", step.HashKey()))
+		s.failDependants(dependant, err, failed)
+	}
+}
@@ -0,0 +1,254 @@
+package runners
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor-plugins/proto"
+	"github.com/radding/harbor/internal/workspaces"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"gopkg.in/yaml.v3"
+)
+
+// concurrencyPlugin records how many of its tasks are running at the same time
+type concurrencyPlugin struct {
+	MockPlugin
+	lock    sync.Mutex
+	current int
+	max     int
+	order   []string
+	// crash lists the commands whose tasks crash
+	crash map[string]bool
+}
+
+type concurrencyTask struct {
+	plugin *concurrencyPlugin
+	weight int
+	crash  bool
+}
+
+func (c *concurrencyTask) Wait() plugins.RunResponse {
+	// Crashes happen right away so they are always seen before any other step finishes
+	if !c.crash {
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.plugin.lock.Lock()
+	c.plugin.current -= c.weight
+	c.plugin.lock.Unlock()
+	return plugins.RunResponse{Status: proto.RunStatus_FINISHED}
+}
+
+func (c *concurrencyTask) Status() plugins.RunResponse {
+	if c.crash {
+		return plugins.RunResponse{Status: proto.RunStatus_CRASHED, ExitCode: 2}
+	}
+	return plugins.RunResponse{Status: proto.RunStatus_FINISHED}
+}
+
+func (c *concurrencyTask) Stop(signal int64, timeoutMS int64) error {
+	return nil
+}
+
+func (c *concurrencyPlugin) Run(req plugins.RunRequest, opts ...plugins.CallOption) (plugins.ClientTask, error) {
+	weight := 1
+	if w, ok := req.Settings.AsMap()["weight"].(float64); ok {
+		weight = int(w)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.current += weight
+	if c.current > c.max {
+		c.max = c.current
+	}
+	c.order = append(c.order, req.CommandName)
+	return &concurrencyTask{plugin: c, weight: weight, crash: c.crash[req.CommandName]}, nil
+}
+
+func newLeafStep(name string, resources int) *RunRecipe {
+	return &RunRecipe{
+		Pkg:         "pkg",
+		CommandName: name,
+		lock:        &sync.Mutex{},
+		runConfig: &workspaces.Command{
+			Type:      "testRunner",
+			Command:   "some command",
+			Resources: resources,
+			Settings:  map[string]interface{}{"weight": resources},
+		},
+	}
+}
+
+func newSchedulerCacher() *mockCache {
+	mockedcacher := &mockCache{}
+	mockedcacher.On("CalculateCacheKey", mock.Anything, mock.Anything)
+	mockedcacher.On("ReplayCachedLogs", mock.Anything, mock.Anything, mock.Anything)
+	mockedcacher.On("WriteLogsToCache", mock.Anything, mock.Anything, mock.Anything)
+	return mockedcacher
+}
+
+func TestSchedulerRespectsMaxParallel(t *testing.T) {
+	assert := assert.New(t)
+	root := &RunRecipe{
+		Pkg:         "Root",
+		CommandName: "build",
+		lock:        &sync.Mutex{},
+		Needs:       []*RunRecipe{},
+	}
+	for i := 0; i < 8; i++ {
+		root.Needs = append(root.Needs, newLeafStep(fmt.Sprintf("step%d", i), 1))
+	}
+	plugin := &concurrencyPlugin{}
+	rCtx := newRunContext(newSchedulerCacher())
+	rCtx.maxParallel = 3
+
+	err := root.Run([]string{}, func(string) (plugins.PluginClient, error) { return plugin, nil }, rCtx)
+	assert.NoError(err)
+	assert.Len(plugin.order, 8)
+	assert.Equal(3, plugin.max)
+}
+
+func TestSchedulerHeavyStepsClaimMoreSlots(t *testing.T) {
+	assert := assert.New(t)
+	root := &RunRecipe{
+		Pkg:         "Root",
+		CommandName: "build",
+		lock:        &sync.Mutex{},
+		Needs: []*RunRecipe{
+			newLeafStep("light1", 1),
+			newLeafStep("heavy", 3),
+			newLeafStep("light2", 1),
+			// Heavier than the whole pool, gets clamped to every slot
+			newLeafStep("huge", 10),
+		},
+	}
+	root.Needs[3].runConfig.Settings["weight"] = 4
+	plugin := &concurrencyPlugin{}
+	rCtx := newRunContext(newSchedulerCacher())
+	rCtx.maxParallel = 4
+
+	err := root.Run([]string{}, func(string) (plugins.PluginClient, error) { return plugin, nil }, rCtx)
+	assert.NoError(err)
+	assert.Len(plugin.order, 4)
+	assert.ElementsMatch([]string{"light1", "heavy"}, plugin.order[:2])
+	assert.Equal([]string{"light2", "huge"}, plugin.order[2:])
+	assert.Equal(4, plugin.max)
+}
+
+func TestSchedulerSkipsStepsBehindFalseConditions(t *testing.T) {
+	assert := assert.New(t)
+	falseCond := &workspaces.RunCondition{}
+	assert.NoError(yaml.Unmarshal([]byte(`"1 == 2"`), falseCond))
+	skipped := newLeafStep("skipped", 1)
+	skipped.runConfig.RunConditions = []*workspaces.RunCondition{falseCond}
+	skipped.Needs = []*RunRecipe{newLeafStep("onlyNeededBySkipped", 1)}
+	root := &RunRecipe{
+		Pkg:         "Root",
+		CommandName: "build",
+		lock:        &sync.Mutex{},
+		Needs:       []*RunRecipe{skipped, newLeafStep("runs", 1)},
+	}
+	plugin := &concurrencyPlugin{}
+	rCtx := newRunContext(newSchedulerCacher())
+
+	err := root.Run([]string{}, func(string) (plugins.PluginClient, error) { return plugin, nil }, rCtx)
+	assert.NoError(err)
+	assert.Equal([]string{"runs"}, plugin.order)
+}
+
+func newKeepGoingGraph() *RunRecipe {
+	crashes := newLeafStep("crashes", 1)
+	dependant := newLeafStep("dependant", 1)
+	dependant.Needs = []*RunRecipe{crashes}
+	slow := newLeafStep("independent", 1)
+	afterSlow := newLeafStep("afterIndependent", 1)
+	afterSlow.Needs = []*RunRecipe{slow}
+	return &RunRecipe{
+		Pkg:         "Root",
+		CommandName: "test",
+		lock:        &sync.Mutex{},
+		Needs:       []*RunRecipe{dependant, afterSlow},
+	}
+}
+
+func TestKeepGoingRunsIndependentBranches(t *testing.T) {
+	assert := assert.New(t)
+	root := newKeepGoingGraph()
+	plugin := &concurrencyPlugin{crash: map[string]bool{"crashes": true}}
+	rCtx := newRunContext(newSchedulerCacher())
+	rCtx.keepGoing = true
+
+	err := root.Run([]string{}, func(string) (plugins.PluginClient, error) { return plugin, nil }, rCtx)
+	assert.Error(err)
+	assert.ElementsMatch([]string{"crashes", "independent", "afterIndependent"}, plugin.order)
+	assert.NoError(rCtx.cancelCtx.Err())
+
+	statuses := map[string]StepSummary{}
+	for _, s := range summarize(root) {
+		statuses[s.Key] = s
+	}
+	assert.Len(statuses, 4)
+	assert.Equal("failed", statuses["pkg:crashes"].Status)
+	assert.Equal(int64(2), statuses["pkg:crashes"].ExitCode)
+	assert.Equal("skipped", statuses["pkg:dependant"].Status)
+	assert.Equal("dependency pkg:crashes failed", statuses["pkg:dependant"].Reason)
+	assert.Equal("succeeded", statuses["pkg:independent"].Status)
+	assert.Equal("succeeded", statuses["pkg:afterIndependent"].Status)
+}
+
+func TestWithoutKeepGoingACrashCancelsTheRun(t *testing.T) {
+	assert := assert.New(t)
+	root := newKeepGoingGraph()
+	plugin := &concurrencyPlugin{crash: map[string]bool{"crashes": true}}
+	rCtx := newRunContext(newSchedulerCacher())
+
+	err := root.Run([]string{}, func(string) (plugins.PluginClient, error) { return plugin, nil }, rCtx)
+	assert.Error(err)
+	assert.ElementsMatch([]string{"crashes", "independent"}, plugin.order)
+	assert.Error(rCtx.cancelCtx.Err())
+}
+
+func TestConditionsThatCantBeEvaluatedFollowTheirPolicy(t *testing.T) {
+	assert := assert.New(t)
+	withCondition := func(name, condition string) *RunRecipe {
+		cond := &workspaces.RunCondition{}
+		assert.NoError(yaml.Unmarshal([]byte(condition), cond))
+		step := newLeafStep(name, 1)
+		step.runConfig.RunConditions = []*workspaces.RunCondition{cond}
+		return step
+	}
+	root := &RunRecipe{
+		Pkg:         "Root",
+		CommandName: "build",
+		lock:        &sync.Mutex{},
+		Needs: []*RunRecipe{
+			withCondition("runs", `${{ env.HARBOR_TEST_UNSET }} == "x"`),
+			withCondition("skips", `{if: '${{ env.HARBOR_TEST_UNSET }} == "x"', on_error: skip}`),
+			withCondition("fails", `{if: '${{ env.HARBOR_TEST_UNSET }} == "x"', on_error: fail}`),
+			withCondition("false", `1 == 2`),
+		},
+	}
+	plugin := &concurrencyPlugin{}
+	rCtx := newRunContext(newSchedulerCacher())
+	rCtx.keepGoing = true
+
+	err := root.Run([]string{}, func(string) (plugins.PluginClient, error) { return plugin, nil }, rCtx)
+	assert.ErrorContains(err, "HARBOR_TEST_UNSET not present in environment")
+	assert.Equal([]string{"runs"}, plugin.order)
+
+	statuses := map[string]StepSummary{}
+	for _, s := range summarize(root) {
+		statuses[s.Key] = s
+	}
+	assert.Equal("succeeded", statuses["pkg:runs"].Status)
+	assert.Contains(statuses["pkg:runs"].Reason, "can't be evaluated, ran anyway")
+	assert.Equal("skipped", statuses["pkg:skips"].Status)
+	assert.Contains(statuses["pkg:skips"].Reason, "HARBOR_TEST_UNSET not present in environment")
+	assert.Equal("failed", statuses["pkg:fails"].Status)
+	assert.Equal(`condition "${{ env.HARBOR_TEST_UNSET }} == \"x\"" can't be evaluated`, statuses["pkg:fails"].Reason)
+	assert.Equal("skipped", statuses["pkg:false"].Status)
+	assert.Equal(`condition "1 == 2" is false`, statuses["pkg:false"].Reason)
+}
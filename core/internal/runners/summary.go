@@ -0,0 +1,87 @@
+package runners
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+type stepStatus string
+
+const (
+	stepPending   stepStatus = ""
+	stepSucceeded stepStatus = "succeeded"
+	stepFailed    stepStatus = "failed"
+	stepSkipped   stepStatus = "skipped"
+	stepCached    stepStatus = "cached"
+)
+
+func (r *RunRecipe) setStatus(status stepStatus, reason string) {
+	r.status = status
+	r.reason = reason
+}
+
+// StepSummary is the outcome of a single step of a run
+type StepSummary struct {
+	Key      string
+	Status   string
+	ExitCode int64
+	Duration time.Duration
+	Reason   string
+}
+
+// summarize collects the outcome of every step with a command in the graph, dependencies first
+func summarize(root *RunRecipe) []StepSummary {
+	summaries := []StepSummary{}
+	visited := make(visitedSet)
+	var visit func(r *RunRecipe)
+	visit = func(r *RunRecipe) {
+		if visited.Has(r) {
+			return
+		}
+		visited.Add(r)
+		for _, dep := range r.Needs {
+			visit(dep)
+		}
+		if r.runConfig == nil {
+			return
+		}
+		status, reason := r.status, r.reason
+		if status == stepPending {
+			// Never started, either because the run was stopped or canceled before it got there
+			status, reason = stepSkipped, "run stopped before the step started"
+		}
+		if r.conditionNote != "" && reason == "" {
+			reason = r.conditionNote
+		} else if r.conditionNote != "" {
+			reason = fmt.Sprintf("%s; %s", reason, r.conditionNote)
+		}
+		summaries = append(summaries, StepSummary{
+			Key:      r.HashKey(),
+			Status:   string(status),
+			ExitCode: r.exitCode,
+			Duration: r.duration,
+			Reason:   reason,
+		})
+	}
+	visit(root)
+	return summaries
+}
+
+// writeSummary writes a table of every step and its outcome followed by a count per status
+func writeSummary(w io.Writer, summaries []StepSummary) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tSTATUS\tEXIT CODE\tDURATION\tREASON")
+	counts := map[string]int{}
+	for _, s := range summaries {
+		counts[s.Status]++
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\n", s.Key, s.Status, s.ExitCode, s.Duration.Round(time.Millisecond), s.Reason)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d succeeded, %d failed, %d skipped, %d cached\n",
+		counts[string(stepSucceeded)], counts[string(stepFailed)], counts[string(stepSkipped)], counts[string(stepCached)])
+	return err
+}
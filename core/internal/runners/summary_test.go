@@ -0,0 +1,28 @@
+package runners
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteSummary(t *testing.T) {
+	assert := assert.New(t)
+	buf := &bytes.Buffer{}
+	err := writeSummary(buf, []StepSummary{
+		{Key: "a:build", Status: "succeeded", Duration: 1500 * time.Millisecond},
+		{Key: "b:test", Status: "failed", ExitCode: 1, Reason: "task crashed"},
+		{Key: "c:test", Status: "skipped", Reason: "dependency b:test failed"},
+		{Key: "d:build", Status: "cached"},
+	})
+	assert.NoError(err)
+	assert.Equal(`STEP     STATUS     EXIT CODE  DURATION  REASON
+a:build  succeeded  0          1.5s      
+b:test   failed     1          0s        task crashed
+c:test   skipped    0          0s        dependency b:test failed
+d:build  cached     0          0s        
+1 succeeded, 1 failed, 1 skipped, 1 cached
+`, buf.String())
+}
@@ -8,13 +8,16 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
-	"gopkg.in/yaml.v3"
 )
 
 const MAX_DISTANCE = 1000
 
 var Config *WorkspaceConfig = nil
 
+// Strict makes loading the workspace fail on unknown fields and anything else that doesn't match the schema of
+// workspace.conf and harbor.conf, as well as on packages with the same name
+var Strict = false
+
 func GetConfig() (WorkspaceConfig, error) {
 	if Config != nil {
 		return *Config, nil
@@ -35,13 +38,12 @@ func GetConfig() (WorkspaceConfig, error) {
 		return *defaultConf, errors.Wrap(err, "error reading configuration file")
 	}
 
-	err = yaml.Unmarshal(bts, defaultConf)
+	err = parseConfig(bts, configPath, defaultConf)
 	if err != nil {
-		return *defaultConf, errors.Wrapf(err, "error unmarshalling yaml")
+		return *defaultConf, err
 	}
 
 	Config = defaultConf
-	Config.location = configPath
 
 	err = Config.loadSubPackages()
 
@@ -0,0 +1,156 @@
+package workspaces
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor-plugins/proto"
+	"github.com/radding/harbor/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+type packageManager interface {
+	CanHandle(plugins.CanHandleRequest) (bool, error)
+	Clone(plugins.CloneRequest) (*plugins.CloneResponse, error)
+}
+
+type namedManager struct {
+	name    string
+	manager packageManager
+}
+
+func getManagers() []namedManager {
+	conf := config.Get()
+	managers := []namedManager{}
+	for _, name := range conf.ProvidersOf(proto.PluginCapabilities_DEPENDENCY_PROVIDER) {
+		client, err := conf.GetPlugin(name)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't load plugin %s", name)
+			continue
+		}
+		managers = append(managers, namedManager{name: name, manager: client})
+	}
+	return managers
+}
+
+// AddPackage clones req.Source with the first dependency provider plugin that can handle it and adds the clone
+// to the packages of the workspace. The destination defaults to a directory in the workspace root named after
+// the source.
+func (w *WorkspaceConfig) AddPackage(req *plugins.CloneRequest) (Package, error) {
+	return w.addPackage(req, getManagers())
+}
+
+func (w *WorkspaceConfig) addPackage(req *plugins.CloneRequest, managers []namedManager) (Package, error) {
+	root := w.WorkspaceRoot()
+	source := req.Source
+	dest := req.Destination
+	if dest == "" {
+		dest = filepath.Join(root, packageDirName(source))
+	}
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return Package{}, errors.Wrapf(err, "can't get the absolute path of %s", dest)
+	}
+	if _, err := relativeToRoot(root, dest); err != nil {
+		return Package{}, err
+	}
+	if !validateDoesNotExsist(dest) {
+		return Package{}, fmt.Errorf("can't clone into %s, it isn't an empty directory", dest)
+	}
+
+	resp, err := clone(&plugins.CloneRequest{
+		Source:      source,
+		Destination: dest,
+		Ref:         req.Ref,
+		Depth:       req.Depth,
+		Submodules:  req.Submodules,
+	}, managers)
+	if err != nil {
+		return Package{}, err
+	}
+	cloned := resp.Destination
+	if cloned == "" {
+		cloned = dest
+	} else if !filepath.IsAbs(cloned) {
+		cloned = filepath.Join(root, cloned)
+	}
+
+	rel, err := relativeToRoot(root, cloned)
+	if err != nil {
+		return Package{}, err
+	}
+	pkg := Package{
+		Path:       rel,
+		Source:     source,
+		Ref:        req.Ref,
+		Depth:      req.Depth,
+		Submodules: req.Submodules,
+	}
+	conf, err := loadConfig(filepath.Join(cloned, "harbor.conf"))
+	if errors.Is(err, os.ErrNotExist) {
+		log.Warn().Msgf("%s has no harbor.conf, harbor will ignore it until it has one", rel)
+	} else if err != nil {
+		return pkg, errors.Wrapf(err, "can't load the configuration of %s", rel)
+	} else {
+		name := conf.Name
+		pkg.Name = &name
+		w.AddSubPackage(name, conf)
+	}
+	w.Packages = append(w.Packages, pkg)
+	if err := w.Save(); err != nil {
+		return pkg, errors.Wrap(err, "can't save the workspace configuration")
+	}
+	lock, err := w.LoadLock()
+	if err != nil {
+		return pkg, err
+	}
+	lock.Set(lockPackage(pkg, resp))
+	return pkg, errors.Wrap(lock.Save(), "can't save the lock file")
+}
+
+// clone clones with the first manager that can handle the source
+func clone(req *plugins.CloneRequest, managers []namedManager) (*plugins.CloneResponse, error) {
+	for _, m := range managers {
+		canHandle, err := m.manager.CanHandle(plugins.CanHandleRequest{Url: req.Source})
+		if err != nil {
+			log.Warn().Err(err).Msgf("plugin %s failed to check %s", m.name, req.Source)
+			continue
+		}
+		if !canHandle {
+			continue
+		}
+		log.Info().Msgf("cloning %s into %s with %s", req.Source, req.Destination, m.name)
+		resp, err := m.manager.Clone(*req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "plugin %s can't clone %s", m.name, req.Source)
+		}
+		log.Info().Msgf("checked out %s of %s", resp.Commit, resp.ResolvedRemote)
+		return resp, nil
+	}
+	return nil, fmt.Errorf("no plugin can handle %s, install a dependency provider that supports it", req.Source)
+}
+
+func relativeToRoot(root, path string) (string, error) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the workspace at %s", path, root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// packageDirName guesses the directory a source would be cloned into, the way git does
+func packageDirName(source string) string {
+	name := source
+	if i := strings.IndexAny(name, "?#"); i >= 0 {
+		name = name[:i]
+	}
+	name = strings.TrimRight(name, "/")
+	if i := strings.LastIndexAny(name, "/:"); i >= 0 {
+		name = name[i+1:]
+	}
+	return strings.TrimSuffix(name, ".git")
+}
@@ -0,0 +1,76 @@
+package workspaces
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeManager "clones" by writing a harbor.conf into the destination
+type fakeManager struct {
+	prefix string
+	cloned []string
+}
+
+func (f *fakeManager) CanHandle(req plugins.CanHandleRequest) (bool, error) {
+	return strings.HasPrefix(req.Url, f.prefix), nil
+}
+
+func (f *fakeManager) Clone(req plugins.CloneRequest) (*plugins.CloneResponse, error) {
+	f.cloned = append(f.cloned, req.Source)
+	if err := os.MkdirAll(req.Destination, 0755); err != nil {
+		return nil, err
+	}
+	resp := &plugins.CloneResponse{Destination: req.Destination, Commit: "abc123"}
+	return resp, os.WriteFile(filepath.Join(req.Destination, "harbor.conf"), []byte("workspace_name: lib\n"), 0644)
+}
+
+func TestAddPackageClonesWithTheFirstManagerThatCanHandleIt(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	location := filepath.Join(root, "workspace.conf")
+	assert.NoError(os.WriteFile(location, []byte("workspace_name: ws\n"), 0644))
+	conf, err := loadConfig(location)
+	assert.NoError(err)
+
+	other := &fakeManager{prefix: "svn://"}
+	git := &fakeManager{prefix: "https://"}
+	managers := []namedManager{{name: "svn", manager: other}, {name: "git", manager: git}}
+
+	pkg, err := conf.addPackage(&plugins.CloneRequest{Source: "https://example.com/org/lib.git", Ref: "v1"}, managers)
+	assert.NoError(err)
+	assert.Equal("lib", pkg.Path)
+	assert.Equal("lib", *pkg.Name)
+	assert.Empty(other.cloned)
+	assert.Equal([]string{"https://example.com/org/lib.git"}, git.cloned)
+
+	saved, err := loadConfig(location)
+	assert.NoError(err)
+	assert.Len(saved.Packages, 1)
+	assert.Equal("https://example.com/org/lib.git", saved.Packages[0].Source)
+	assert.Equal("v1", saved.Packages[0].Ref)
+	lock, err := conf.LoadLock()
+	assert.NoError(err)
+	locked, ok := lock.Get("lib")
+	assert.True(ok)
+	assert.Equal("abc123", locked.Commit)
+
+	_, err = conf.addPackage(&plugins.CloneRequest{Source: "https://example.com/org/lib.git"}, managers)
+	assert.Error(err, "the destination isn't empty anymore")
+	_, err = conf.addPackage(&plugins.CloneRequest{Source: "ftp://example.com/lib"}, managers)
+	assert.Error(err)
+	_, err = conf.addPackage(&plugins.CloneRequest{Source: "https://example.com/org/other", Destination: filepath.Join(root, "..")}, managers)
+	assert.Error(err)
+}
+
+func TestPackageDirName(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("harbor", packageDirName("https://github.com/radding/harbor.git"))
+	assert.Equal("harbor", packageDirName("git@github.com:radding/harbor.git"))
+	assert.Equal("harbor", packageDirName("https://github.com/radding/harbor/?ref=main"))
+	assert.Equal("lib", packageDirName("../lib"))
+}
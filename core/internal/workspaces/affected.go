@@ -0,0 +1,157 @@
+package workspaces
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+func git(dir string, args ...string) ([]string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	lines := []string{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+// ChangedFiles lists the slash separated paths, relative to the workspace root, of the files changed since the
+// merge base of since and HEAD. Uncommitted and untracked files count as changed.
+func (w *WorkspaceConfig) ChangedFiles(since string) ([]string, error) {
+	root := w.WorkspaceRoot()
+	base, err := git(root, "merge-base", since, "HEAD")
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't find where HEAD diverged from %s", since)
+	}
+	if len(base) == 0 {
+		return nil, fmt.Errorf("HEAD and %s have no common history", since)
+	}
+	changed, err := git(root, "diff", "--name-only", "--no-renames", "--relative", base[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list changed files")
+	}
+	untracked, err := git(root, "ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list untracked files")
+	}
+	return append(changed, untracked...), nil
+}
+
+// PackagesOf returns the names of the packages containing files, which are relative to the workspace root. A file
+// belongs to the deepest package containing it, files outside of every package belong to the workspace itself.
+// Changing workspace.conf or workspace.lock can change any package, so it changes all of them.
+func (w *WorkspaceConfig) PackagesOf(files []string) map[string]bool {
+	root := w.WorkspaceRoot()
+	dirs := map[string]string{}
+	for name, pkg := range w.subPackages {
+		rel, err := filepath.Rel(root, pkg.WorkspaceRoot())
+		if err != nil {
+			continue
+		}
+		dirs[name] = filepath.ToSlash(rel)
+	}
+	packages := map[string]bool{}
+	for _, file := range files {
+		if file == filepath.Base(w.location) || file == LOCK_FILENAME {
+			packages[w.Name] = true
+			for name := range w.subPackages {
+				packages[name] = true
+			}
+			continue
+		}
+		owner, ownerDir := w.Name, ""
+		for name, dir := range dirs {
+			contains := dir == "." || file == dir || strings.HasPrefix(file, dir+"/")
+			if contains && len(dir) >= len(ownerDir) {
+				owner, ownerDir = name, dir
+			}
+		}
+		packages[owner] = true
+	}
+	return packages
+}
+
+// ChangedPackages returns the names of the packages with files changed since the given git ref
+func (w *WorkspaceConfig) ChangedPackages(since string) (map[string]bool, error) {
+	files, err := w.ChangedFiles(since)
+	if err != nil {
+		return nil, err
+	}
+	return w.PackagesOf(files), nil
+}
+
+// AffectedPackages returns the sorted names of the packages changed since the given git ref and of every package
+// that transitively depends on one of them, through its package dependencies or the dependencies of its commands
+func (w *WorkspaceConfig) AffectedPackages(since string) ([]string, error) {
+	changed, err := w.ChangedPackages(since)
+	if err != nil {
+		return nil, err
+	}
+	return w.withDependants(changed), nil
+}
+
+func (w *WorkspaceConfig) withDependants(changed map[string]bool) []string {
+	dependants := map[string][]string{}
+	addEdges := func(name string, conf WorkspaceConfig) {
+		conf.Name = name
+		addEdge := func(dep string) {
+			if dep != name {
+				dependants[dep] = append(dependants[dep], name)
+			}
+		}
+		pkgDeps, _ := w.PackageDependencies(conf)
+		for _, dep := range pkgDeps {
+			addEdge(dep)
+		}
+		for _, cmd := range conf.Commands {
+			for _, dep := range cmd.Dependencies {
+				targets, _, _ := w.DependencyTargets(conf, dep)
+				for _, target := range targets {
+					addEdge(target)
+				}
+			}
+		}
+	}
+	addEdges(w.Name, *w)
+	for name, conf := range w.subPackages {
+		addEdges(name, conf)
+	}
+
+	affected := map[string]bool{}
+	queue := []string{}
+	for name := range changed {
+		affected[name] = true
+		queue = append(queue, name)
+	}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, dependant := range dependants[name] {
+			if !affected[dependant] {
+				affected[dependant] = true
+				queue = append(queue, dependant)
+			}
+		}
+	}
+	names := []string{}
+	for name := range affected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
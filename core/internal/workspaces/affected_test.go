@@ -0,0 +1,90 @@
+package workspaces
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, os.WriteFile(path, []byte(contents), 0644))
+	}
+}
+
+func loadTestWorkspace(t *testing.T, root string) WorkspaceConfig {
+	conf, err := loadConfig(filepath.Join(root, "workspace.conf"))
+	assert.NoError(t, err)
+	conf.subPackages = map[string]WorkspaceConfig{}
+	assert.NoError(t, conf.loadSubPackages())
+	return conf
+}
+
+var affectedWorkspace = map[string]string{
+	"workspace.conf":        "workspace_name: ws\npackages:\n  - path: libs/*\n  - path: app\n",
+	"libs/core/harbor.conf": "workspace_name: core\n",
+	"libs/util/harbor.conf": `
+workspace_name: util
+commands:
+  build:
+    depends_on:
+      - pkg: core
+        command: build
+`,
+	"app/harbor.conf": `
+workspace_name: app
+commands:
+  build:
+    depends_on:
+      - pkg: util
+        command: build
+`,
+}
+
+func TestChangedFilesBelongToTheDeepestPackage(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, affectedWorkspace)
+	conf := loadTestWorkspace(t, root)
+
+	assert.Equal(map[string]bool{"core": true, "ws": true}, conf.PackagesOf([]string{"libs/core/main.go", "README.md"}))
+	assert.Equal(map[string]bool{"app": true}, conf.PackagesOf([]string{"app/harbor.conf"}))
+	assert.Len(conf.PackagesOf([]string{"workspace.conf"}), 4)
+
+	assert.Equal([]string{"app", "core", "util"}, conf.withDependants(map[string]bool{"core": true}))
+	assert.Equal([]string{"app"}, conf.withDependants(map[string]bool{"app": true}))
+}
+
+func TestAffectedPackagesSinceARef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, affectedWorkspace)
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "harbor@example.com")
+	}
+	run := func(args ...string) {
+		_, err := git(root, args...)
+		assert.NoError(err)
+	}
+	run("init", "-q", "-b", "main")
+	run("add", ".")
+	run("commit", "-qm", "initial")
+	run("checkout", "-qb", "feature")
+	writeFiles(t, root, map[string]string{"libs/util/util.go": "package util\n"})
+	conf := loadTestWorkspace(t, root)
+
+	affected, err := conf.AffectedPackages("main")
+	assert.NoError(err)
+	assert.Equal([]string{"app", "util"}, affected)
+
+	_, err = conf.AffectedPackages("does-not-exist")
+	assert.Error(err)
+}
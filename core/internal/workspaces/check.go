@@ -0,0 +1,77 @@
+package workspaces
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	"github.com/radding/harbor-plugins/proto"
+	"github.com/radding/harbor/internal/config"
+	"gopkg.in/yaml.v3"
+)
+
+// Check validates workspace.conf and the harbor.conf of every package against the schema and checks that an
+// installed runner plugin provides the type of every command and that the conditions of every command can be
+// evaluated. The problems ignored loading the workspace, like packages with the same name, are reported too.
+func (w *WorkspaceConfig) Check() []error {
+	return w.check(config.Get().ProvidersOf(proto.PluginCapabilities_TASK_RUNNER), loadPluginNamespaces)
+}
+
+func (w *WorkspaceConfig) check(runnerTypes []string, namespaces func() map[string]string) []error {
+	problems := append([]error{}, w.loadProblems...)
+	packages := []WorkspaceConfig{*w}
+	for _, name := range w.PackageNames() {
+		if pkg, ok := w.subPackages[name]; ok {
+			packages = append(packages, pkg)
+		}
+	}
+	for _, pkg := range packages {
+		file := pkg.location
+		if rel, err := filepath.Rel(w.WorkspaceRoot(), pkg.location); err == nil {
+			file = filepath.ToSlash(rel)
+		}
+		bts, err := ioutil.ReadFile(pkg.location)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("can't read %s: %s", file, err))
+			continue
+		}
+		problems = append(problems, validateConfig(bts, file)...)
+		problems = append(problems, checkRunnerTypes(bts, file, runnerTypes)...)
+		problems = append(problems, pkg.checkConditions(file, namespaces)...)
+	}
+	return problems
+}
+
+// checkRunnerTypes reports the commands in the configuration file whose type isn't one of runnerTypes
+func checkRunnerTypes(bts []byte, file string, runnerTypes []string) []error {
+	known := map[string]bool{}
+	for _, runnerType := range runnerTypes {
+		known[runnerType] = true
+	}
+	installed := append([]string{}, runnerTypes...)
+	sort.Strings(installed)
+
+	problems := []error{}
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(bts, &doc); err != nil || len(doc.Content) == 0 {
+		return problems
+	}
+	commands := mappingValue(doc.Content[0], "commands")
+	if commands == nil || commands.Kind != yaml.MappingNode {
+		return problems
+	}
+	for i := 0; i+1 < len(commands.Content); i += 2 {
+		runnerType := mappingValue(commands.Content[i+1], "type")
+		if runnerType == nil || runnerType.Kind != yaml.ScalarNode || known[runnerType.Value] {
+			continue
+		}
+		problems = append(problems, ConfigError{
+			File:    file,
+			Line:    runnerType.Line,
+			Column:  runnerType.Column,
+			Message: fmt.Sprintf("no installed runner plugin provides type %q, the installed ones are %v", runnerType.Value, installed),
+		})
+	}
+	return problems
+}
@@ -0,0 +1,26 @@
+package workspaces
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckFindsDuplicateNamesAndUnknownRunners(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"workspace.conf": "workspace_name: ws\npackages:\n  - path: \"*\"\n",
+		"a/harbor.conf":  "workspace_name: lib\ncommands:\n  build:\n    type: shell\n    command: go build\n",
+		"b/harbor.conf":  "workspace_name: lib\ncommands:\n  build:\n    type: shel\n    command: go build\n",
+	})
+	conf := loadTestWorkspace(t, root)
+
+	messages := []string{}
+	for _, problem := range conf.check([]string{"shell"}, noNamespaces) {
+		messages = append(messages, problem.Error())
+	}
+	assert.Len(messages, 2)
+	assert.Contains(messages[0], "are both named lib")
+	assert.Equal(`b/harbor.conf:4:11: no installed runner plugin provides type "shel", the installed ones are [shell]`, messages[1])
+}
@@ -0,0 +1,88 @@
+package workspaces
+
+import (
+	"fmt"
+	"sort"
+
+	mathparser "github.com/radding/harbor/internal/MathParser"
+)
+
+// builtinTypes are the types of the variables of the built in providers, except env and vars which can hold anything
+var builtinTypes = map[string]map[string]string{
+	"os": {"name": mathparser.StringType, "arch": mathparser.StringType},
+	"git": {
+		"branch":    mathparser.StringType,
+		"commit":    mathparser.StringType,
+		"sha":       mathparser.StringType,
+		"short_sha": mathparser.StringType,
+		"dirty":     mathparser.BoolType,
+	},
+	"pkg":       {"name": mathparser.StringType, "path": mathparser.StringType},
+	"workspace": {"name": mathparser.StringType, "root": mathparser.StringType},
+	"args":      {"count": mathparser.NumberType, "all": mathparser.StringType},
+	"file":      {"exists": mathparser.BoolType},
+}
+
+// argumentVariables are the built in variables that take an argument
+var argumentVariables = map[string]bool{"file.exists": true}
+
+// conditionTypes knows the types of the built in variables, the variables of the namespaces plugins provide can hold
+// anything
+type conditionTypes struct {
+	namespaces func() map[string]string
+}
+
+func (c conditionTypes) TypeOf(providerName, variableName string, hasArgument bool) (string, error) {
+	name := fmt.Sprintf("%s.%s", providerName, variableName)
+	if providerName == "env" || providerName == "vars" {
+		if hasArgument {
+			return "", fmt.Errorf("%s doesn't take an argument", name)
+		}
+		return mathparser.AnyType, nil
+	}
+	variables, ok := builtinTypes[providerName]
+	if !ok {
+		if _, ok := c.namespaces()[providerName]; ok {
+			return mathparser.AnyType, nil
+		}
+		return "", fmt.Errorf("unknown variable provider %s", providerName)
+	}
+	typ, ok := variables[variableName]
+	if !ok {
+		return "", fmt.Errorf("%s is not a variable", name)
+	}
+	if argumentVariables[name] && !hasArgument {
+		return "", fmt.Errorf("%s takes an argument", name)
+	} else if !argumentVariables[name] && hasArgument {
+		return "", fmt.Errorf("%s doesn't take an argument", name)
+	}
+	return typ, nil
+}
+
+// checkConditions reports the conditions of the commands of the package that can never be evaluated, file is
+// the name of the configuration file of the package to report them in
+func (w *WorkspaceConfig) checkConditions(file string, namespaces func() map[string]string) []error {
+	types := conditionTypes{namespaces: namespaces}
+	names := []string{}
+	for name := range w.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	problems := []error{}
+	for _, name := range names {
+		for _, cond := range w.Commands[name].RunConditions {
+			if cond.Expr == nil {
+				continue
+			}
+			if err := cond.Expr.Check(types); err != nil {
+				problems = append(problems, ConfigError{
+					File:    file,
+					Line:    cond.line,
+					Column:  cond.column,
+					Message: fmt.Sprintf("condition %q of %s: %s", cond.source, name, err),
+				})
+			}
+		}
+	}
+	return problems
+}
@@ -0,0 +1,100 @@
+package workspaces
+
+import (
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func noNamespaces() map[string]string {
+	return map[string]string{}
+}
+
+func TestConditionsCanHaveAnErrorPolicy(t *testing.T) {
+	assert := assert.New(t)
+	cmd := Command{}
+	assert.NoError(yaml.Unmarshal([]byte(`
+conditions:
+  - ${{ env.CI }}
+  - if: exists(env.DEPLOY)
+    on_error: fail
+`), &cmd))
+	assert.Equal(ConditionRun, cmd.RunConditions[0].Policy())
+	assert.Equal("exists(env.DEPLOY)", cmd.RunConditions[1].Source())
+	assert.Equal(ConditionFail, cmd.RunConditions[1].Policy())
+
+	bts, err := yaml.Marshal(cmd)
+	assert.NoError(err)
+	roundTrip := Command{}
+	assert.NoError(yaml.Unmarshal(bts, &roundTrip))
+	assert.Equal(ConditionFail, roundTrip.RunConditions[1].Policy())
+
+	assert.ErrorContains(yaml.Unmarshal([]byte("conditions: [{if: 'true', on_error: ignore}]"), &cmd), "run, skip or fail")
+	assert.ErrorContains(yaml.Unmarshal([]byte("conditions: ['1 ==']"), &cmd), `can't parse condition "1 =="`)
+}
+
+func TestConditionsAreCheckedWhenLoading(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"workspace.conf": "workspace_name: ws\n",
+		"harbor.conf": `workspace_name: api
+commands:
+  build:
+    conditions:
+      - ${{ env.CI }} == "true" && args.count > 0
+      - docker.running
+  test:
+    conditions:
+      - args.count == "2"
+      - file.exists
+      - if: vars.deploy && startsWith(git.branch, "release/")
+        on_error: skip
+`,
+	})
+	conf, err := loadConfig(filepath.Join(root, "harbor.conf"))
+	assert.NoError(err, "problems with conditions are only warnings")
+
+	messages := []string{}
+	for _, problem := range conf.checkConditions("harbor.conf", noNamespaces) {
+		messages = append(messages, problem.Error())
+	}
+	assert.Equal([]string{
+		`harbor.conf:6:9: condition "docker.running" of build: unknown variable provider docker`,
+		`harbor.conf:9:9: condition "args.count == \"2\"" of test: Can't compare E(args.count) with S(2)`,
+		`harbor.conf:10:9: condition "file.exists" of test: file.exists takes an argument`,
+	}, messages)
+	problems := conf.checkConditions("harbor.conf", func() map[string]string {
+		return map[string]string{"docker": "docker_plugin"}
+	})
+	assert.Len(problems, 2, "namespaces of plugins are known")
+
+	Strict = true
+	defer func() { Strict = false }()
+	_, err = loadConfig(filepath.Join(root, "harbor.conf"))
+	assert.ErrorContains(err, "unknown variable provider docker")
+}
+
+func TestBuiltinTypesCoverEveryBuiltinVariable(t *testing.T) {
+	assert := assert.New(t)
+	resolver := (&WorkspaceConfig{}).builtinVariables(nil)
+	for name, provider := range resolver.providers {
+		vars, ok := provider.(variables)
+		if !ok {
+			continue
+		}
+		names, typed := []string{}, []string{}
+		for variable := range vars {
+			names = append(names, variable)
+		}
+		for variable := range builtinTypes[name] {
+			typed = append(typed, variable)
+		}
+		sort.Strings(names)
+		sort.Strings(typed)
+		assert.Equal(names, typed, name)
+	}
+}
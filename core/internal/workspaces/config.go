@@ -16,74 +16,303 @@ import (
 )
 
 type Package struct {
-	Name *string `yaml:"name"`
+	Name *string `yaml:"name,omitempty"`
 	Path string  `yaml:"path"`
+	// Source is where the package was cloned from by harbor workspace add
+	Source string `yaml:"source,omitempty"`
+	// Ref is the branch, tag or commit of the source that was checked out
+	Ref string `yaml:"ref,omitempty"`
+	// Depth is the number of commits of history that were cloned, 0 is all of them
+	Depth      int64 `yaml:"depth,omitempty"`
+	Submodules bool  `yaml:"submodules,omitempty"`
 }
 
+// Dependency is a command that has to run before another one. The package is a name, a glob of names or . for the
+// package of the command itself. In harbor.conf a dependency can also be written as a string, either command,
+// pkg:command or ^command, which runs the command in every package the package depends on.
 type Dependency struct {
 	PackageName string `yaml:"pkg"`
 	CommandName string `yaml:"command"`
+	// Upstream is set by ^command, the command runs in the package dependencies of the package
+	Upstream bool `yaml:"-"`
+
+	line int
+}
+
+// Line is the line of the harbor.conf the dependency is declared on, 0 when it wasn't loaded from one
+func (d Dependency) Line() int {
+	return d.line
+}
+
+type plainDependency Dependency
+
+func (d *Dependency) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	short := ""
+	if err := unmarshal(&short); err != nil {
+		return unmarshal((*plainDependency)(d))
+	}
+	*d = Dependency{PackageName: ".", CommandName: short}
+	if strings.HasPrefix(short, "^") {
+		d.PackageName = ""
+		d.CommandName = strings.TrimPrefix(short, "^")
+		d.Upstream = true
+	} else if i := strings.Index(short, ":"); i >= 0 {
+		d.PackageName = short[:i]
+		d.CommandName = short[i+1:]
+	}
+	if d.CommandName == "" {
+		return fmt.Errorf("dependency %q has no command", short)
+	}
+	return nil
 }
 
+func (d Dependency) MarshalYAML() (interface{}, error) {
+	if d.Upstream {
+		return "^" + d.CommandName, nil
+	}
+	return plainDependency(d), nil
+}
+
+// ConditionPolicy is what happens to a command when one of its conditions can't be evaluated
+type ConditionPolicy string
+
+const (
+	// ConditionRun runs the command anyway, it is the default
+	ConditionRun ConditionPolicy = "run"
+	// ConditionSkip skips the command as if the condition was false
+	ConditionSkip ConditionPolicy = "skip"
+	// ConditionFail fails the command
+	ConditionFail ConditionPolicy = "fail"
+)
+
+// RunCondition is an expression that has to be true for a command to run. In harbor.conf it is either the
+// expression or a mapping of the expression, if, and on_error.
 type RunCondition struct {
-	Expr *mathparser.Expression
+	Expr    *mathparser.Expression
+	OnError ConditionPolicy
+	source  string
+
+	line, column int
+}
+
+// Source is the expression as it was written
+func (r *RunCondition) Source() string {
+	return r.source
+}
+
+// Policy is what happens to the command when the condition can't be evaluated
+func (r *RunCondition) Policy() ConditionPolicy {
+	if r.OnError == "" {
+		return ConditionRun
+	}
+	return r.OnError
 }
 
 func (r *RunCondition) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	data := ""
-	unmarshal(&data)
+	if err := unmarshal(&data); err != nil {
+		full := struct {
+			If      string          `yaml:"if"`
+			OnError ConditionPolicy `yaml:"on_error"`
+		}{}
+		if err := unmarshal(&full); err != nil {
+			return err
+		}
+		switch full.OnError {
+		case "", ConditionRun, ConditionSkip, ConditionFail:
+		default:
+			return fmt.Errorf("on_error is %q, it has to be run, skip or fail", full.OnError)
+		}
+		data, r.OnError = full.If, full.OnError
+	}
 	var err error = nil
+	r.source = data
 	r.Expr, err = mathparser.Parse(data)
-	return err
+	return errors.Wrapf(err, "can't parse condition %q", data)
+}
+
+func (r *RunCondition) MarshalYAML() (interface{}, error) {
+	if r.OnError == "" {
+		return r.source, nil
+	}
+	return map[string]interface{}{"if": r.source, "on_error": string(r.OnError)}, nil
 }
 
 type Command struct {
 	Type          string                 `yaml:"type"`
 	Command       string                 `yaml:"command"`
-	RunConditions []*RunCondition        `yaml:"conditions"`
-	Dependencies  []Dependency           `yaml:"depends_on"`
-	Settings      map[string]interface{} `yaml:"options"`
+	RunConditions []*RunCondition        `yaml:"conditions,omitempty"`
+	Dependencies  []Dependency           `yaml:"depends_on,omitempty"`
+	Settings      map[string]interface{} `yaml:"options,omitempty"`
+	// Resources is the number of parallel slots the command claims while it runs, defaults to 1
+	Resources int `yaml:"resources,omitempty"`
+	// Outputs are globs, relative to the package, of the files the command produces. They are cached
+	// with the logs and restored on a cache hit.
+	Outputs []string `yaml:"outputs,omitempty"`
+	// Inputs select the files, relative to the package, that the cache key of the command is calculated from
+	Inputs *Inputs `yaml:"inputs,omitempty"`
+	// EnvInputs are the names of environment variables whose values are part of the cache key
+	EnvInputs []string `yaml:"env_inputs,omitempty"`
+	// Env is the environment the command runs with, merged over the env of its package
+	Env map[string]string `yaml:"env,omitempty"`
+	// EnvFiles are .env files, relative to the package, loaded into the environment before Env
+	EnvFiles []string `yaml:"env_files,omitempty"`
+}
+
+// Inputs are the globs selecting the files a command depends on. Without an include everything in the
+// package is an input.
+type Inputs struct {
+	Include []string `yaml:"include,omitempty"`
+	Exclude []string `yaml:"exclude,omitempty"`
+	// RespectGitignore excludes the files ignored by .gitignore, defaults to true
+	RespectGitignore *bool `yaml:"respect_gitignore,omitempty"`
 }
 
 type CacheSettings struct {
 	Provider string                 `yaml:"provider"`
-	Settings map[string]interface{} `yaml:"Settings"`
+	Settings map[string]interface{} `yaml:"settings,omitempty"`
+}
+
+func (c *CacheSettings) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	raw := struct {
+		Provider string                 `yaml:"provider"`
+		Settings map[string]interface{} `yaml:"settings"`
+		// LegacySettings is the capitalized key older configs used
+		LegacySettings map[string]interface{} `yaml:"Settings"`
+	}{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	c.Provider = raw.Provider
+	c.Settings = raw.Settings
+	if c.Settings == nil {
+		c.Settings = raw.LegacySettings
+	}
+	return nil
+}
+
+// ReadOnly reports whether harbor should only read from the cache and never write to it
+func (c *CacheSettings) ReadOnly() bool {
+	readOnly, _ := c.Settings["read_only"].(bool)
+	return readOnly
+}
+
+// CacheTiers are the caches harbor uses in order, a hit in a later tier is copied back into the
+// earlier ones. In workspace.conf it is either a single cache or a list of them.
+type CacheTiers []*CacheSettings
+
+func (c *CacheTiers) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	tiers := []*CacheSettings{}
+	if err := unmarshal(&tiers); err == nil {
+		*c = tiers
+		return nil
+	}
+	single := &CacheSettings{}
+	if err := unmarshal(single); err != nil {
+		return err
+	}
+	*c = CacheTiers{single}
+	return nil
+}
+
+// CachePlugin is a configured cache plugin of one of the cache tiers
+type CachePlugin struct {
+	Provider string
+	Client   plugins.PluginClient
+	ReadOnly bool
 }
 
 type WorkspaceConfig struct {
-	Name          string             `yaml:"workspace_name"`
-	Packages      []Package          `yaml:"packages"`
-	CacheSettings *CacheSettings     `yaml:"cache"`
-	Commands      map[string]Command `yaml:"commands"`
+	Name     string             `yaml:"workspace_name"`
+	Packages []Package          `yaml:"packages"`
+	Caches   CacheTiers         `yaml:"cache,omitempty"`
+	Commands map[string]Command `yaml:"commands"`
+	// MaxParallel is the default number of steps harbor runs at once, 0 means one per CPU
+	MaxParallel int `yaml:"max_parallel,omitempty"`
+	// Dependencies are the names, or globs of names, of the packages this package depends on
+	Dependencies []string `yaml:"dependencies,omitempty"`
+	// Vars are the values of ${{ vars.name }}, the vars of a package override the ones of the workspace
+	Vars map[string]string `yaml:"vars,omitempty"`
+	// Env is the environment the commands run with, merged over the env of the workspace for a package
+	Env map[string]string `yaml:"env,omitempty"`
+	// EnvFiles are .env files, relative to this file, loaded into the environment before Env
+	EnvFiles []string `yaml:"env_files,omitempty"`
+	// StrictVariables makes variables in commands and options that can't be resolved fail the command instead of
+	// being replaced with nothing
+	StrictVariables bool `yaml:"strict_variables,omitempty"`
 
 	location    string
 	subPackages map[string]WorkspaceConfig
+	// workspace is the workspace a package belongs to, nil for the workspace itself
+	workspace *WorkspaceConfig
+	// loadProblems are the problems that were ignored loading the workspace
+	loadProblems []error
 }
 
-func (w *WorkspaceConfig) VariableLookUpService() mathparser.VariableLookUp {
-	n := newVariableResolver()
-	n.registerProvider("env", ProviderFunc(getEnvVariable))
+// VariableLookUpService resolves the variables of the run conditions of the commands of the package, args are the
+// arguments harbor run was called with
+func (w *WorkspaceConfig) VariableLookUpService(args ...string) mathparser.VariableLookUp {
+	n := w.builtinVariables(args)
+	n.discover = func(n *variableResolver) {
+		registerPluginVariables(n, w.WorkspaceRoot())
+	}
 	return n
 }
 
 func (w *WorkspaceConfig) GetLocalCacheDir() string {
-	if w.CacheSettings != nil && w.CacheSettings.Settings != nil {
-		localCache, ok := w.CacheSettings.Settings["local_cache_dir"]
+	for _, cache := range w.Caches {
+		localCache, ok := cache.Settings["local_cache_dir"].(string)
 		if ok {
-			return localCache.(string)
+			return localCache
 		}
 	}
 	return filepath.Join(w.WorkspaceRoot(), ".harbor")
 }
 
-func (w *WorkspaceConfig) GetCacher() (plugins.PluginClient, error) {
-	cacheSettings := w.CacheSettings
-	if cacheSettings == nil {
-		cacheSettings = &CacheSettings{
+// GetCachers loads and configures the plugin of every cache tier, defaulting to the local cache. Tiers that
+// fail to load are left out and reported in the returned error.
+func (w *WorkspaceConfig) GetCachers() ([]CachePlugin, error) {
+	tiers := w.Caches
+	if len(tiers) == 0 {
+		tiers = CacheTiers{{
 			Provider: "local_cache",
+		}}
+	}
+	cachers := []CachePlugin{}
+	var loadErr error
+	for _, tier := range tiers {
+		plugin, err := w.getCacher(tier)
+		if err != nil {
+			if loadErr == nil {
+				loadErr = err
+			} else {
+				loadErr = errors.Wrap(loadErr, err.Error())
+			}
+			continue
 		}
+		cachers = append(cachers, CachePlugin{
+			Provider: tier.Provider,
+			Client:   plugin,
+			ReadOnly: tier.ReadOnly(),
+		})
+	}
+	return cachers, loadErr
+}
+
+func (w *WorkspaceConfig) getCacher(cacheSettings *CacheSettings) (plugins.PluginClient, error) {
+	plugin, err := config.Get().GetPlugin(cacheSettings.Provider)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't get cache provider %s", cacheSettings.Provider)
+	}
+	settings := cacheSettings.Settings
+	if settings == nil {
+		settings = map[string]interface{}{}
+	}
+	err = plugin.ConfigureCache(settings)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't configure cache provider %s", cacheSettings.Provider)
 	}
-	return config.Get().GetPlugin(cacheSettings.Provider)
+	return plugin, nil
 }
 
 func (w *WorkspaceConfig) AddSubPackage(name string, conf WorkspaceConfig) {
@@ -91,6 +320,7 @@ func (w *WorkspaceConfig) AddSubPackage(name string, conf WorkspaceConfig) {
 		w.subPackages = map[string]WorkspaceConfig{}
 	}
 	conf.Name = name
+	conf.workspace = w
 	w.subPackages[name] = conf
 }
 
@@ -143,12 +373,73 @@ func loadConfig(path string) (WorkspaceConfig, error) {
 		return *defaultConf, errors.Wrap(err, "error reading configuration file")
 	}
 
-	err = yaml.Unmarshal(bts, defaultConf)
-	if err != nil {
-		return *defaultConf, errors.Wrapf(err, "error unmarshalling yaml")
+	err = parseConfig(bts, path, defaultConf)
+	return *defaultConf, err
+}
+
+// parseConfig unmarshals the configuration file at path into conf, in strict mode it fails on anything that
+// doesn't match the schema and on conditions that can never be evaluated
+func parseConfig(bts []byte, path string, conf *WorkspaceConfig) error {
+	conf.location = path
+	if Strict {
+		if problems := validateConfig(bts, path); len(problems) > 0 {
+			return ConfigErrors(problems)
+		}
+	}
+	if err := yaml.Unmarshal(bts, conf); err != nil {
+		return errors.Wrapf(err, "error unmarshalling yaml")
+	}
+	annotateLines(bts, conf)
+	problems := conf.checkConditions(path, loadPluginNamespaces)
+	if Strict && len(problems) > 0 {
+		return ConfigErrors(problems)
 	}
-	defaultConf.location = path
-	return *defaultConf, nil
+	for _, problem := range problems {
+		log.Warn().Msg(problem.Error())
+	}
+	return nil
+}
+
+// annotateLines records the line every dependency and condition of conf is declared on in bts
+func annotateLines(bts []byte, conf *WorkspaceConfig) {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(bts, &doc); err != nil || len(doc.Content) == 0 {
+		return
+	}
+	commands := mappingValue(doc.Content[0], "commands")
+	if commands == nil || commands.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(commands.Content); i += 2 {
+		cmd, ok := conf.Commands[commands.Content[i].Value]
+		if !ok {
+			continue
+		}
+		dependsOn := mappingValue(commands.Content[i+1], "depends_on")
+		if dependsOn != nil && len(dependsOn.Content) == len(cmd.Dependencies) {
+			for j, dep := range dependsOn.Content {
+				cmd.Dependencies[j].line = dep.Line
+			}
+		}
+		conditions := mappingValue(commands.Content[i+1], "conditions")
+		if conditions != nil && len(conditions.Content) == len(cmd.RunConditions) {
+			for j, cond := range conditions.Content {
+				cmd.RunConditions[j].line, cmd.RunConditions[j].column = cond.Line, cond.Column
+			}
+		}
+	}
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
 }
 
 func (w *WorkspaceConfig) loadSubPackages() error {
@@ -158,9 +449,12 @@ func (w *WorkspaceConfig) loadSubPackages() error {
 		if err != nil {
 			return errors.Wrapf(err, "error running glob: %s", pkg.Path)
 		}
+		if len(ms) == 0 && pkg.Source != "" {
+			log.Warn().Msgf("%s from %s is not checked out, run harbor workspace sync", pkg.Path, pkg.Source)
+		}
 		matches = append(matches, ms...)
 	}
-	matches = filterNonDirs(matches)
+	matches = filterNonDirs(uniquePaths(matches))
 	log.Trace().Msgf("Found packages: %s", matches)
 	for _, pkg := range matches {
 		conf, err := loadConfig(filepath.Join(pkg, "harbor.conf"))
@@ -170,6 +464,15 @@ func (w *WorkspaceConfig) loadSubPackages() error {
 			log.Trace().Msgf("%s is not a harbor workspace, ignoring", pkg)
 			continue
 		}
+		if existing, ok := w.subPackages[conf.Name]; ok && existing.location != conf.location {
+			err := fmt.Errorf("%s and %s are both named %s", existing.location, conf.location, conf.Name)
+			if Strict {
+				return err
+			}
+			log.Warn().Msgf("%s, only the last one is used", err)
+			w.loadProblems = append(w.loadProblems, err)
+		}
+		conf.workspace = w
 		w.subPackages[conf.Name] = conf
 	}
 	subPackages := []string{}
@@ -180,6 +483,20 @@ func (w *WorkspaceConfig) loadSubPackages() error {
 	return nil
 }
 
+// uniquePaths drops the paths matched by more than one package glob
+func uniquePaths(paths []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, path := range paths {
+		path = filepath.Clean(path)
+		if !seen[path] {
+			seen[path] = true
+			res = append(res, path)
+		}
+	}
+	return res
+}
+
 func filterNonDirs(paths []string) []string {
 	res := []string{}
 	for _, path := range paths {
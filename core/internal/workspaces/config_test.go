@@ -30,3 +30,35 @@ func TestCanParseRunCondition(t *testing.T) {
 	assert.Len(testVal.Cond, 6)
 
 }
+
+func TestCacheAcceptsASingleCacheOrAList(t *testing.T) {
+	assert := assert.New(t)
+
+	single := WorkspaceConfig{}
+	err := yaml.Unmarshal([]byte(`
+cache:
+  provider: local_cache
+  Settings:
+    local_cache_dir: /tmp/cache
+`), &single)
+	assert.NoError(err)
+	assert.Len(single.Caches, 1)
+	assert.Equal("local_cache", single.Caches[0].Provider)
+	assert.Equal("/tmp/cache", single.GetLocalCacheDir())
+
+	layered := WorkspaceConfig{}
+	err = yaml.Unmarshal([]byte(`
+cache:
+  - provider: local_cache
+  - provider: http_cache
+    settings:
+      url: http://localhost:8080
+      read_only: true
+`), &layered)
+	assert.NoError(err)
+	assert.Len(layered.Caches, 2)
+	assert.Equal("http_cache", layered.Caches[1].Provider)
+	assert.Equal("http://localhost:8080", layered.Caches[1].Settings["url"])
+	assert.False(layered.Caches[0].ReadOnly())
+	assert.True(layered.Caches[1].ReadOnly())
+}
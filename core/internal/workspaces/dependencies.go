@@ -0,0 +1,86 @@
+package workspaces
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+func isGlob(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+// PackageNames returns the sorted names of the workspace and of all of its packages
+func (w *WorkspaceConfig) PackageNames() []string {
+	names := []string{w.Name}
+	for name := range w.subPackages {
+		if name != w.Name {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matchPackages returns the names of the packages matching glob, other than exclude
+func (w *WorkspaceConfig) matchPackages(glob string, exclude string) ([]string, error) {
+	matches := []string{}
+	for _, name := range w.PackageNames() {
+		ok, err := path.Match(glob, name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid package glob %q: %s", glob, err)
+		}
+		if ok && name != exclude {
+			matches = append(matches, name)
+		}
+	}
+	return matches, nil
+}
+
+// PackageDependencies resolves the package level dependencies of pkg to the sorted names of the packages it depends on
+func (w *WorkspaceConfig) PackageDependencies(pkg WorkspaceConfig) ([]string, error) {
+	seen := map[string]bool{}
+	names := []string{}
+	for _, dep := range pkg.Dependencies {
+		matches := []string{dep}
+		if isGlob(dep) {
+			var err error
+			if matches, err = w.matchPackages(dep, pkg.Name); err != nil {
+				return nil, err
+			}
+		} else if !w.hasPackage(dep) {
+			return nil, fmt.Errorf("%s depends on %s, which is not a package of the workspace", pkg.Name, dep)
+		}
+		for _, name := range matches {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DependencyTargets resolves dep, of a command in pkg, to the names of the packages its command runs in. Exact is
+// false when dep is a glob or ^command, the packages that don't have the command are then skipped instead of being
+// an error. Globs never match pkg itself.
+func (w *WorkspaceConfig) DependencyTargets(pkg WorkspaceConfig, dep Dependency) (names []string, exact bool, err error) {
+	switch {
+	case dep.Upstream:
+		names, err = w.PackageDependencies(pkg)
+		return names, false, err
+	case dep.PackageName == "." || dep.PackageName == "":
+		return []string{pkg.Name}, true, nil
+	case isGlob(dep.PackageName):
+		names, err = w.matchPackages(dep.PackageName, pkg.Name)
+		return names, false, err
+	}
+	return []string{dep.PackageName}, true, nil
+}
+
+func (w *WorkspaceConfig) hasPackage(name string) bool {
+	_, ok := w.subPackages[name]
+	return ok || name == w.Name
+}
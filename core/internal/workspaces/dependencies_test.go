@@ -0,0 +1,91 @@
+package workspaces
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDependenciesCanBeWrittenShort(t *testing.T) {
+	assert := assert.New(t)
+
+	cmd := Command{}
+	err := yaml.Unmarshal([]byte(`
+depends_on:
+  - ^build
+  - protoc
+  - plugins:protoc
+  - pkg: "plugins/*"
+    command: build
+`), &cmd)
+	assert.NoError(err)
+	assert.Equal([]Dependency{
+		{CommandName: "build", Upstream: true},
+		{PackageName: ".", CommandName: "protoc"},
+		{PackageName: "plugins", CommandName: "protoc"},
+		{PackageName: "plugins/*", CommandName: "build"},
+	}, cmd.Dependencies)
+
+	bts, err := yaml.Marshal(cmd)
+	assert.NoError(err)
+	roundTrip := Command{}
+	assert.NoError(yaml.Unmarshal(bts, &roundTrip))
+	assert.Equal(cmd.Dependencies, roundTrip.Dependencies)
+
+	assert.Error(yaml.Unmarshal([]byte("depends_on: [\"^\"]"), &cmd))
+}
+
+func TestDependencyTargets(t *testing.T) {
+	assert := assert.New(t)
+	conf := WorkspaceConfig{Name: "ws"}
+	conf.AddSubPackage("plugins/cache", WorkspaceConfig{})
+	conf.AddSubPackage("plugins/runner", WorkspaceConfig{})
+	conf.AddSubPackage("app", WorkspaceConfig{Dependencies: []string{"plugins/*", "ws"}})
+	app, _ := conf.GetPackageConfig("app")
+
+	names, exact, err := conf.DependencyTargets(app, Dependency{CommandName: "build", Upstream: true})
+	assert.NoError(err)
+	assert.False(exact)
+	assert.Equal([]string{"plugins/cache", "plugins/runner", "ws"}, names)
+
+	names, exact, err = conf.DependencyTargets(app, Dependency{PackageName: "plugins/*", CommandName: "build"})
+	assert.NoError(err)
+	assert.False(exact)
+	assert.Equal([]string{"plugins/cache", "plugins/runner"}, names)
+
+	names, _, err = conf.DependencyTargets(app, Dependency{PackageName: "[a-z]*", CommandName: "build"})
+	assert.NoError(err)
+	assert.Equal([]string{"ws"}, names, "globs never match the package itself")
+
+	names, exact, err = conf.DependencyTargets(app, Dependency{PackageName: ".", CommandName: "build"})
+	assert.NoError(err)
+	assert.True(exact)
+	assert.Equal([]string{"app"}, names)
+
+	app.Dependencies = []string{"missing"}
+	_, _, err = conf.DependencyTargets(app, Dependency{CommandName: "build", Upstream: true})
+	assert.Error(err)
+}
+
+func TestDependenciesKnowTheirLine(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"workspace.conf": "workspace_name: ws\npackages:\n  - path: a\n",
+		"a/harbor.conf": `workspace_name: a
+commands:
+  build:
+    depends_on:
+      - ^build
+      - pkg: b
+        command: protoc
+`,
+	})
+	conf := loadTestWorkspace(t, root)
+	a, err := conf.GetPackageConfig("a")
+	assert.NoError(err)
+	deps := a.Commands["build"].Dependencies
+	assert.Equal(5, deps[0].Line())
+	assert.Equal(6, deps[1].Line())
+}
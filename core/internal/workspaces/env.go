@@ -0,0 +1,113 @@
+package workspaces
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	mathparser "github.com/radding/harbor/internal/MathParser"
+	"github.com/rs/zerolog/log"
+)
+
+// readEnvFile reads the KEY=value lines of a .env file. Blank lines and lines starting with # are skipped, keys can
+// start with export and values can be in single or double quotes.
+func readEnvFile(path string) (map[string]string, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fi.Close()
+	env := map[string]string{}
+	scanner := bufio.NewScanner(fi)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, lineNumber)
+		}
+		value, err = envValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", path, lineNumber)
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
+
+func envValue(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, `"`):
+		end := strings.LastIndex(value, `"`)
+		if end == 0 {
+			return "", fmt.Errorf("%s has no closing quote", value)
+		}
+		return strconv.Unquote(value[:end+1])
+	case strings.HasPrefix(value, "'"):
+		end := strings.LastIndex(value, "'")
+		if end == 0 {
+			return "", fmt.Errorf("%s has no closing quote", value)
+		}
+		return value[1:end], nil
+	}
+	// Unquoted values end at a comment
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// mergeEnv loads the env files, relative to dir, and then env into environment. Env values can use ${{ }}
+// variables. Env files that don't exist are skipped, so a .env that is only there on some machines can be listed.
+func mergeEnv(environment map[string]string, dir string, files []string, env map[string]string, lookup mathparser.VariableLookUp, strict bool) error {
+	for _, file := range files {
+		path := filepath.FromSlash(file)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		fromFile, err := readEnvFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			log.Debug().Msgf("env file %s does not exist, skipping it", path)
+			continue
+		} else if err != nil {
+			return errors.Wrapf(err, "can't read env file %s", file)
+		}
+		for key, value := range fromFile {
+			environment[key] = value
+		}
+	}
+	for key, value := range env {
+		resolved, err := Interpolate(value, lookup, strict)
+		if err != nil {
+			return errors.Wrapf(err, "can't interpolate env %s", key)
+		}
+		environment[key] = resolved
+	}
+	return nil
+}
+
+// environment is what the workspace, the package and cmd, a command of the package, add to the environment of cmd,
+// later ones overriding earlier ones
+func (w *WorkspaceConfig) environment(cmd Command, lookup mathparser.VariableLookUp, strict bool) (map[string]string, error) {
+	environment := map[string]string{}
+	root := w.root()
+	if err := mergeEnv(environment, root.WorkspaceRoot(), root.EnvFiles, root.Env, lookup, strict); err != nil {
+		return nil, err
+	}
+	if root != w {
+		if err := mergeEnv(environment, w.WorkspaceRoot(), w.EnvFiles, w.Env, lookup, strict); err != nil {
+			return nil, err
+		}
+	}
+	if err := mergeEnv(environment, w.WorkspaceRoot(), cmd.EnvFiles, cmd.Env, lookup, strict); err != nil {
+		return nil, err
+	}
+	return environment, nil
+}
@@ -0,0 +1,96 @@
+package workspaces
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadEnvFile(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		".env": `
+# comment
+PLAIN=value # trailing comment
+export EXPORTED=yes
+DOUBLE="two words\nand a # sign"
+SINGLE='$NOT_EXPANDED'
+EMPTY=
+`,
+		"broken.env": "NO_EQUALS\n",
+	})
+	env, err := readEnvFile(filepath.Join(root, ".env"))
+	assert.NoError(err)
+	assert.Equal(map[string]string{
+		"PLAIN":    "value",
+		"EXPORTED": "yes",
+		"DOUBLE":   "two words\nand a # sign",
+		"SINGLE":   "$NOT_EXPANDED",
+		"EMPTY":    "",
+	}, env)
+
+	_, err = readEnvFile(filepath.Join(root, "broken.env"))
+	assert.ErrorContains(err, "broken.env:1")
+}
+
+func TestEnvIsMergedFromWorkspaceToCommand(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"workspace.conf": `
+workspace_name: ws
+packages:
+  - path: api
+vars:
+  region: us-east-1
+  retries: 3
+env:
+  LEVEL: workspace
+  REGION: ${{ vars.region }}
+env_files: [.env]
+`,
+		".env": "FROM_FILE=workspace\nLEVEL=file\n",
+		"api/harbor.conf": `
+workspace_name: api
+vars:
+  region: eu-west-1
+env:
+  LEVEL: package
+  PACKAGE: ${{ pkg.name }}
+env_files: [.env, missing.env]
+commands:
+  build:
+    type: shell
+    command: deploy to ${{ vars.region }}
+    env:
+      COMMAND: "yes"
+    env_files: [build.env]
+`,
+		"api/.env":      "FROM_FILE=package\n",
+		"api/build.env": "LEVEL=command file\n",
+	})
+	conf := loadTestWorkspace(t, root)
+	api, err := conf.GetPackageConfig("api")
+	assert.NoError(err)
+
+	resolved, err := api.ResolveCommand(api.Commands["build"], nil)
+	assert.NoError(err)
+	assert.Equal("deploy to eu-west-1", resolved.Command)
+	assert.Equal(map[string]string{
+		"FROM_FILE": "package",
+		"LEVEL":     "command file",
+		"REGION":    "eu-west-1",
+		"PACKAGE":   "api",
+		"COMMAND":   "yes",
+	}, resolved.Env)
+
+	res, err := evaluate(t, api.builtinVariables(nil), `vars.retries > 2 && vars.region == "eu-west-1"`)
+	assert.NoError(err)
+	assert.True(res, "vars of the workspace are inherited and typed like env")
+
+	resolved, err = conf.ResolveCommand(Command{}, nil)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"FROM_FILE": "workspace", "LEVEL": "workspace", "REGION": "us-east-1"}, resolved.Env)
+}
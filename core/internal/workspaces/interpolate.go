@@ -0,0 +1,115 @@
+package workspaces
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	mathparser "github.com/radding/harbor/internal/MathParser"
+	"github.com/rs/zerolog/log"
+)
+
+// Interpolate replaces every ${{ value }} in s with the text of the value, which is a variable like pkg.name or a
+// function call. $${{ is an escaped ${{ and is left in the text as ${{. Variables that can't be resolved are
+// replaced with nothing, unless strict is set.
+func Interpolate(s string, lookup mathparser.VariableLookUp, strict bool) (string, error) {
+	out := strings.Builder{}
+	rest := s
+	for {
+		start := strings.Index(rest, "${{")
+		if start < 0 {
+			out.WriteString(rest)
+			return out.String(), nil
+		}
+		if start > 0 && rest[start-1] == '$' {
+			out.WriteString(rest[:start-1])
+			out.WriteString("${{")
+			rest = rest[start+3:]
+			continue
+		}
+		out.WriteString(rest[:start])
+		end := strings.Index(rest[start:], "}}")
+		if end < 0 {
+			return "", fmt.Errorf("%q has a ${{ without a }}", s)
+		}
+		source := strings.TrimSpace(rest[start+3 : start+end])
+		rest = rest[start+end+2:]
+		text, err := interpolateValue(source, lookup)
+		if err != nil && strict {
+			return "", err
+		} else if err != nil {
+			log.Warn().Err(err).Msgf("replacing ${{ %s }} with nothing", source)
+		}
+		out.WriteString(text)
+	}
+}
+
+func interpolateValue(source string, lookup mathparser.VariableLookUp) (string, error) {
+	value, err := mathparser.ParseValue(source)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't parse ${{ %s }}", source)
+	}
+	value, err = value.Evaluate(lookup)
+	if err != nil {
+		return "", errors.Wrapf(err, "can't resolve ${{ %s }}", source)
+	}
+	return value.AsString()
+}
+
+// interpolateSettings interpolates every string in the options of a command
+func interpolateSettings(value interface{}, lookup mathparser.VariableLookUp, strict bool) (interface{}, error) {
+	switch val := value.(type) {
+	case string:
+		return Interpolate(val, lookup, strict)
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(val))
+		for key, item := range val {
+			resolved, err := interpolateSettings(item, lookup, strict)
+			if err != nil {
+				return nil, errors.Wrapf(err, "can't interpolate option %s", key)
+			}
+			res[key] = resolved
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(val))
+		for i, item := range val {
+			resolved, err := interpolateSettings(item, lookup, strict)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = resolved
+		}
+		return res, nil
+	}
+	return value, nil
+}
+
+// ResolveCommand returns cmd, a command of the package, with the variables in its command and options replaced
+// by their values for a run with args. They fail to resolve in strict mode or when strict_variables is set. The
+// Env of the returned command is everything the workspace, the package and the command declare, with the env
+// files loaded.
+func (w *WorkspaceConfig) ResolveCommand(cmd Command, args []string) (Command, error) {
+	strict := Strict || w.StrictVariables
+	lookup := w.VariableLookUpService(args...)
+	command, err := Interpolate(cmd.Command, lookup, strict)
+	if err != nil {
+		return cmd, errors.Wrap(err, "can't interpolate the command")
+	}
+	env, err := w.environment(cmd, lookup, strict)
+	if err != nil {
+		return cmd, err
+	}
+	cmd.Command = command
+	cmd.Env = env
+	cmd.EnvFiles = nil
+	if cmd.Settings == nil {
+		return cmd, nil
+	}
+	settings, err := interpolateSettings(cmd.Settings, lookup, strict)
+	if err != nil {
+		return cmd, err
+	}
+	cmd.Settings = settings.(map[string]interface{})
+	return cmd, nil
+}
@@ -0,0 +1,60 @@
+package workspaces
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterpolate(t *testing.T) {
+	lookup := (&WorkspaceConfig{Name: "api"}).builtinVariables([]string{"-v"})
+	cases := map[string]string{
+		"go build -o ${{ pkg.name }}":            "go build -o api",
+		"${{pkg.name}}-${{ args.count }}":        "api-1",
+		"echo $${{ pkg.name }} ${{ pkg.name }}":  "echo ${{ pkg.name }} api",
+		"${{ startsWith(pkg.name, \"a\") }}":     "true",
+		"no variables, just $ and {{ braces }}":  "no variables, just $ and {{ braces }}",
+		"missing: '${{ env.HARBOR_TEST_NOPE }}'": "missing: ''",
+	}
+	for source, expected := range cases {
+		res, err := Interpolate(source, lookup, false)
+		assert.NoError(t, err, source)
+		assert.Equal(t, expected, res, source)
+	}
+
+	for _, source := range []string{"${{ env.HARBOR_TEST_NOPE }}", "${{ pkg.name", "${{ == }}"} {
+		_, err := Interpolate(source, lookup, true)
+		assert.Error(t, err, source)
+	}
+	_, err := Interpolate("${{ pkg.name", lookup, false)
+	assert.Error(t, err, "syntax errors fail even when not strict")
+}
+
+func TestResolveCommand(t *testing.T) {
+	assert := assert.New(t)
+	conf := WorkspaceConfig{Name: "api"}
+	cmd := Command{
+		Type:    "shell",
+		Command: "build ${{ pkg.name }}",
+		Settings: map[string]interface{}{
+			"env":   map[string]interface{}{"NAME": "${{ pkg.name }}"},
+			"flags": []interface{}{"-o", "${{ pkg.name }}.bin", 3},
+		},
+	}
+	resolved, err := conf.ResolveCommand(cmd, nil)
+	assert.NoError(err)
+	assert.Equal("build api", resolved.Command)
+	assert.Equal(map[string]interface{}{
+		"env":   map[string]interface{}{"NAME": "api"},
+		"flags": []interface{}{"-o", "api.bin", 3},
+	}, resolved.Settings)
+	assert.Equal("build ${{ pkg.name }}", cmd.Command, "the command itself is left alone")
+	assert.Equal("${{ pkg.name }}", cmd.Settings["env"].(map[string]interface{})["NAME"])
+
+	cmd.Command = "build ${{ nope.name }}"
+	_, err = conf.ResolveCommand(cmd, nil)
+	assert.NoError(err)
+	conf.StrictVariables = true
+	_, err = conf.ResolveCommand(cmd, nil)
+	assert.Error(err)
+}
@@ -0,0 +1,181 @@
+package workspaces
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor/internal/multierror"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const LOCK_FILENAME = "workspace.lock"
+
+// LockedPackage is the exact revision a package cloned by a manager plugin was checked out at
+type LockedPackage struct {
+	Path   string `yaml:"path"`
+	Source string `yaml:"source"`
+	Ref    string `yaml:"ref,omitempty"`
+	// Resolved is the remote the manager cloned, with local paths made absolute
+	Resolved string `yaml:"resolved"`
+	Commit   string `yaml:"commit"`
+}
+
+// Lockfile pins every package with a source to a commit, it lives next to workspace.conf
+type Lockfile struct {
+	Packages []LockedPackage `yaml:"packages"`
+
+	location string
+}
+
+// LoadLock reads the lock file of the workspace, a workspace without one gets an empty lock file
+func (w *WorkspaceConfig) LoadLock() (*Lockfile, error) {
+	lock := &Lockfile{
+		Packages: []LockedPackage{},
+		location: filepath.Join(w.WorkspaceRoot(), LOCK_FILENAME),
+	}
+	bts, err := ioutil.ReadFile(lock.location)
+	if errors.Is(err, os.ErrNotExist) {
+		return lock, nil
+	} else if err != nil {
+		return lock, errors.Wrap(err, "error reading lock file")
+	}
+	if err := yaml.Unmarshal(bts, lock); err != nil {
+		return lock, errors.Wrapf(err, "error unmarshalling %s", lock.location)
+	}
+	return lock, nil
+}
+
+func (l *Lockfile) Save() error {
+	sort.Slice(l.Packages, func(i, j int) bool {
+		return l.Packages[i].Path < l.Packages[j].Path
+	})
+	log.Trace().Msgf("saving lock file to %s", l.location)
+	bts, err := yaml.Marshal(l)
+	if err != nil {
+		return errors.Wrap(err, "error marshalling lock file")
+	}
+	return os.WriteFile(l.location, bts, 0644)
+}
+
+func (l *Lockfile) Get(path string) (LockedPackage, bool) {
+	for _, pkg := range l.Packages {
+		if pkg.Path == path {
+			return pkg, true
+		}
+	}
+	return LockedPackage{}, false
+}
+
+func (l *Lockfile) Set(locked LockedPackage) {
+	for i, pkg := range l.Packages {
+		if pkg.Path == locked.Path {
+			l.Packages[i] = locked
+			return
+		}
+	}
+	l.Packages = append(l.Packages, locked)
+}
+
+func (l *Lockfile) Remove(path string) {
+	packages := []LockedPackage{}
+	for _, pkg := range l.Packages {
+		if pkg.Path != path {
+			packages = append(packages, pkg)
+		}
+	}
+	l.Packages = packages
+}
+
+func lockPackage(pkg Package, resp *plugins.CloneResponse) LockedPackage {
+	return LockedPackage{
+		Path:     pkg.Path,
+		Source:   pkg.Source,
+		Ref:      pkg.Ref,
+		Resolved: resp.ResolvedRemote,
+		Commit:   resp.Commit,
+	}
+}
+
+// Sync brings the checkout of every package with a source to the commit in the lock file. Packages that aren't
+// locked yet, or whose source or ref changed, are checked out at their ref and locked. In frozen mode those fail
+// instead and the lock file is never written.
+func (w *WorkspaceConfig) Sync(frozen bool) error {
+	return w.sync(frozen, getManagers())
+}
+
+func (w *WorkspaceConfig) sync(frozen bool, managers []namedManager) error {
+	lock, err := w.LoadLock()
+	if err != nil {
+		return err
+	}
+	var syncErr error
+	addErr := func(err error) {
+		syncErr = multierror.Append(syncErr, err)
+	}
+
+	inConfig := map[string]bool{}
+	for _, pkg := range w.Packages {
+		if pkg.Source == "" {
+			continue
+		}
+		inConfig[pkg.Path] = true
+		locked, ok := lock.Get(pkg.Path)
+		upToDate := ok && locked.Source == pkg.Source && locked.Ref == pkg.Ref
+		if !upToDate && frozen {
+			addErr(fmt.Errorf("%s is not locked at its source and ref, run harbor workspace sync without --frozen", pkg.Path))
+			continue
+		}
+		req := &plugins.CloneRequest{
+			Source:      pkg.Source,
+			Destination: filepath.Join(w.WorkspaceRoot(), filepath.FromSlash(pkg.Path)),
+			Ref:         pkg.Ref,
+			Depth:       pkg.Depth,
+			Submodules:  pkg.Submodules,
+			Update:      true,
+		}
+		if upToDate {
+			req.Ref = locked.Commit
+		}
+		resp, err := clone(req, managers)
+		if err != nil && upToDate && req.Depth > 0 {
+			// Plenty of remotes refuse shallow fetches of a commit that isn't the tip of a branch or tag
+			log.Debug().Err(err).Msgf("can't fetch %s at depth %d, fetching all of it", locked.Commit, req.Depth)
+			req.Depth = 0
+			resp, err = clone(req, managers)
+		}
+		if err != nil {
+			addErr(errors.Wrapf(err, "can't sync %s", pkg.Path))
+			continue
+		}
+		if upToDate && !strings.HasPrefix(resp.Commit, locked.Commit) {
+			addErr(fmt.Errorf("%s is at %s instead of the locked %s", pkg.Path, resp.Commit, locked.Commit))
+			continue
+		}
+		log.Info().Msgf("%s is at %s", pkg.Path, resp.Commit)
+		lock.Set(lockPackage(pkg, resp))
+	}
+	for _, locked := range lock.Packages {
+		if inConfig[locked.Path] {
+			continue
+		}
+		if frozen {
+			addErr(fmt.Errorf("%s is locked but is no longer a package of the workspace", locked.Path))
+			continue
+		}
+		lock.Remove(locked.Path)
+	}
+	if frozen {
+		return syncErr
+	}
+	if err := lock.Save(); err != nil {
+		addErr(errors.Wrap(err, "can't save the lock file"))
+	}
+	return syncErr
+}
@@ -0,0 +1,145 @@
+package workspaces
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/stretchr/testify/assert"
+)
+
+// revisionManager checks out refs as commits named after them and records what it was asked for
+type revisionManager struct {
+	requests []plugins.CloneRequest
+	// refuseShallowCommits fails shallow fetches of commits, like plenty of remotes do
+	refuseShallowCommits bool
+	// fail fails cloning these sources
+	fail map[string]bool
+}
+
+func (r *revisionManager) CanHandle(req plugins.CanHandleRequest) (bool, error) {
+	return true, nil
+}
+
+func (r *revisionManager) Clone(req plugins.CloneRequest) (*plugins.CloneResponse, error) {
+	r.requests = append(r.requests, req)
+	if r.fail[req.Source] {
+		return nil, fmt.Errorf("can't reach %s", req.Source)
+	}
+	if r.refuseShallowCommits && req.Depth > 0 && len(req.Ref) == 40 {
+		return nil, fmt.Errorf("server does not allow request for unadvertised object %s", req.Ref)
+	}
+	commit := "commit-of-" + req.Ref
+	if len(req.Ref) == 40 {
+		commit = req.Ref
+	}
+	return &plugins.CloneResponse{Destination: req.Destination, ResolvedRemote: req.Source, Commit: commit}, nil
+}
+
+func TestSyncLocksAndChecksOutLockedCommits(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	location := filepath.Join(root, "workspace.conf")
+	assert.NoError(os.WriteFile(location, []byte(`
+workspace_name: ws
+packages:
+  - path: libs/*
+  - path: libs/a
+    source: https://example.com/a.git
+    ref: main
+`), 0644))
+	conf, err := loadConfig(location)
+	assert.NoError(err)
+	manager := &revisionManager{}
+	managers := []namedManager{{name: "fake", manager: manager}}
+
+	assert.Error(conf.sync(true, managers), "nothing is locked yet")
+	assert.Empty(manager.requests)
+
+	assert.NoError(conf.sync(false, managers))
+	lock, err := conf.LoadLock()
+	assert.NoError(err)
+	assert.Equal([]LockedPackage{{
+		Path:     "libs/a",
+		Source:   "https://example.com/a.git",
+		Ref:      "main",
+		Resolved: "https://example.com/a.git",
+		Commit:   "commit-of-main",
+	}}, lock.Packages)
+	assert.True(manager.requests[0].Update)
+
+	locked := "0123456789012345678901234567890123456789"
+	lock.Packages[0].Commit = locked
+	lock.Packages = append(lock.Packages, LockedPackage{Path: "libs/removed"})
+	assert.NoError(lock.Save())
+	assert.Error(conf.sync(true, managers), "libs/removed is no longer a package")
+
+	assert.NoError(conf.sync(false, managers))
+	assert.Equal(locked, manager.requests[len(manager.requests)-1].Ref)
+	lock, err = conf.LoadLock()
+	assert.NoError(err)
+	assert.Len(lock.Packages, 1)
+	assert.Equal(locked, lock.Packages[0].Commit)
+	assert.NoError(conf.sync(true, managers))
+}
+
+func TestSyncFetchesAllOfALockedCommitWhenShallowFetchesFail(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	location := filepath.Join(root, "workspace.conf")
+	assert.NoError(os.WriteFile(location, []byte(`
+workspace_name: ws
+packages:
+  - path: libs/a
+    source: https://example.com/a.git
+    ref: main
+    depth: 1
+`), 0644))
+	conf, err := loadConfig(location)
+	assert.NoError(err)
+	manager := &revisionManager{refuseShallowCommits: true}
+	managers := []namedManager{{name: "fake", manager: manager}}
+	assert.NoError(conf.sync(false, managers))
+	assert.Equal(int64(1), manager.requests[0].Depth, "the ref is fetched shallowly")
+
+	locked := "0123456789012345678901234567890123456789"
+	lock, err := conf.LoadLock()
+	assert.NoError(err)
+	lock.Packages[0].Commit = locked
+	assert.NoError(lock.Save())
+
+	manager.requests = nil
+	assert.NoError(conf.sync(true, managers))
+	assert.Len(manager.requests, 2)
+	assert.Equal(int64(1), manager.requests[0].Depth)
+	assert.Equal(locked, manager.requests[1].Ref)
+	assert.Equal(int64(0), manager.requests[1].Depth)
+}
+
+func TestSyncReportsEveryFailedPackageInOrder(t *testing.T) {
+	assert := assert.New(t)
+	root := t.TempDir()
+	location := filepath.Join(root, "workspace.conf")
+	assert.NoError(os.WriteFile(location, []byte(`
+workspace_name: ws
+packages:
+  - path: libs/a
+    source: https://example.com/a.git
+  - path: libs/b
+    source: https://example.com/b.git
+  - path: libs/c
+    source: https://example.com/c.git
+`), 0644))
+	conf, err := loadConfig(location)
+	assert.NoError(err)
+	manager := &revisionManager{fail: map[string]bool{"https://example.com/a.git": true, "https://example.com/c.git": true}}
+	err = conf.sync(false, []namedManager{{name: "fake", manager: manager}})
+	assert.Error(err)
+	lines := strings.Split(err.Error(), "\n")
+	assert.Len(lines, 2)
+	assert.Contains(lines[0], "can't sync libs/a")
+	assert.Contains(lines[1], "can't sync libs/c")
+}
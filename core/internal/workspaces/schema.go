@@ -0,0 +1,367 @@
+package workspaces
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// schema is the subset of JSON Schema harbor describes its configuration files with
+type schema struct {
+	Schema      string   `json:"$schema,omitempty"`
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+
+	Properties        map[string]*schema  `json:"properties,omitempty"`
+	Required          []string            `json:"required,omitempty"`
+	DependentRequired map[string][]string `json:"dependentRequired,omitempty"`
+	// AdditionalProperties is false for objects with a fixed set of fields, or the schema of the values of a map
+	AdditionalProperties interface{} `json:"additionalProperties,omitempty"`
+	Items                *schema     `json:"items,omitempty"`
+	OneOf                []*schema   `json:"oneOf,omitempty"`
+}
+
+func str(description string) *schema {
+	return &schema{Type: "string", Description: description}
+}
+
+func list(description string, items *schema) *schema {
+	return &schema{Type: "array", Description: description, Items: items}
+}
+
+func object(description string, properties map[string]*schema, required ...string) *schema {
+	return &schema{Type: "object", Description: description, Properties: properties, Required: required, AdditionalProperties: false}
+}
+
+func anyObject(description string) *schema {
+	return &schema{Type: "object", Description: description}
+}
+
+// envSchema is a map of environment variables, the values are strings but numbers and booleans are read as text
+func envSchema(description string) *schema {
+	return &schema{Type: "object", Description: description, AdditionalProperties: &schema{OneOf: []*schema{
+		str(""), {Type: "integer"}, {Type: "boolean"},
+	}}}
+}
+
+var cacheSchema = object("A cache harbor stores the logs and outputs of commands in", map[string]*schema{
+	"provider": str("The name of the cache plugin"),
+	"settings": anyObject("The settings of the cache plugin, read_only makes harbor only read from it"),
+}, "provider")
+
+var commandSchema = func() *schema {
+	s := object("A command harbor can run in the package", map[string]*schema{
+		"type":    str("The runner plugin that runs the command"),
+		"command": str("What the runner runs, ${{ pkg.name }} is replaced with the value of the variable and $${{ is a literal ${{"),
+		"conditions": list("Expressions that all have to be true for the command to run", &schema{OneOf: []*schema{
+			str("An expression like ${{ env.CI }} == \"true\""),
+			object("An expression and what happens when it can't be evaluated", map[string]*schema{
+				"if": str("An expression like ${{ env.CI }} == \"true\""),
+				"on_error": {Type: "string", Enum: []string{"run", "skip", "fail"},
+					Description: "Whether the command runs, is skipped or fails when the expression can't be evaluated, defaults to run"},
+			}, "if"),
+		}}),
+		"depends_on": list("The commands that have to run before this one", &schema{OneOf: []*schema{
+			str("command, pkg:command or ^command, which runs the command in every package this package depends on"),
+			object("A command of a package", map[string]*schema{
+				"pkg":     str("A package name, a glob of package names or . for this package"),
+				"command": str("The name of the command"),
+			}, "pkg", "command"),
+		}}),
+		"options":    anyObject("Settings passed to the runner plugin, ${{ }} variables in them are replaced like in command"),
+		"resources":  &schema{Type: "integer", Description: "The number of parallel slots the command claims while it runs, defaults to 1"},
+		"outputs":    list("Globs, relative to the package, of the files the command produces", str("")),
+		"env_inputs": list("Names of environment variables that are part of the cache key", str("")),
+		"env":        envSchema("Environment variables the command runs with, over the ones of the package, values can use ${{ }} variables"),
+		"env_files":  list("Paths of .env files, relative to the package, loaded before env, missing files are skipped", str("")),
+		"inputs": object("The files the cache key of the command is calculated from", map[string]*schema{
+			"include":           list("Globs of the files to include, everything in the package when empty", str("")),
+			"exclude":           list("Globs of the files to leave out", str("")),
+			"respect_gitignore": &schema{Type: "boolean", Description: "Leave out the files ignored by .gitignore, defaults to true"},
+		}),
+	})
+	s.DependentRequired = map[string][]string{"command": {"type"}}
+	return s
+}()
+
+var workspaceSchema = &schema{
+	Schema:      "https://json-schema.org/draft/2020-12/schema",
+	Title:       "harbor workspace.conf and harbor.conf",
+	Description: "The configuration of a harbor workspace or of one of its packages",
+	Type:        "object",
+	Properties: map[string]*schema{
+		"workspace_name": str("The name of the workspace or package, unique across the workspace"),
+		"packages": list("The packages of the workspace", object("A package, or a glob of packages", map[string]*schema{
+			"name":       str("The name of the package"),
+			"path":       str("The path, or glob of paths, of the package relative to the workspace"),
+			"source":     str("Where harbor workspace add cloned the package from"),
+			"ref":        str("The branch, tag or commit of the source that is checked out"),
+			"depth":      &schema{Type: "integer", Description: "The number of commits of history that are cloned, 0 is all of them"},
+			"submodules": &schema{Type: "boolean", Description: "Whether the submodules of the source are cloned"},
+		}, "path")),
+		"cache": {
+			Description: "The cache, or caches in the order harbor uses them",
+			OneOf:       []*schema{cacheSchema, list("", cacheSchema)},
+		},
+		"commands": {
+			Type:                 "object",
+			Description:          "The commands of the workspace or package by name",
+			AdditionalProperties: commandSchema,
+		},
+		"max_parallel":     {Type: "integer", Description: "The default number of steps harbor runs at once, 0 is one per CPU"},
+		"dependencies":     list("The names, or globs of names, of the packages this package depends on", str("")),
+		"vars":             envSchema("Values of ${{ vars.name }}, the vars of a package override the ones of the workspace"),
+		"env":              envSchema("Environment variables the commands run with, a package's are over the workspace's, values can use ${{ }} variables"),
+		"env_files":        list("Paths of .env files, relative to this file, loaded before env, missing files are skipped", str("")),
+		"strict_variables": {Type: "boolean", Description: "Fail commands whose command or options use ${{ }} variables that can't be resolved, instead of replacing them with nothing"},
+	},
+	Required:             []string{"workspace_name"},
+	AdditionalProperties: false,
+}
+
+// JSONSchema is the JSON Schema of workspace.conf and harbor.conf, for editors to validate and complete them with
+func JSONSchema() ([]byte, error) {
+	bts, err := json.MarshalIndent(workspaceSchema, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(bts, '\n'), nil
+}
+
+// ConfigError is a problem at a line and column of a configuration file
+type ConfigError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// ConfigErrors are all the problems found in the configuration files of a workspace
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// validateConfig checks the contents of the configuration file named file against the schema
+func validateConfig(bts []byte, file string) []error {
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(bts, &doc); err != nil {
+		return []error{fmt.Errorf("%s: %s", file, err)}
+	}
+	if len(doc.Content) == 0 {
+		return []error{ConfigError{File: file, Line: 1, Column: 1, Message: "the file is empty"}}
+	}
+	v := &validator{file: file, problems: []error{}}
+	v.validate(workspaceSchema, doc.Content[0])
+	return v.problems
+}
+
+type validator struct {
+	file     string
+	problems []error
+}
+
+func (v *validator) report(node *yaml.Node, format string, args ...interface{}) {
+	v.problems = append(v.problems, ConfigError{File: v.file, Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)})
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+func (v *validator) validate(s *schema, node *yaml.Node) {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if len(s.OneOf) > 0 {
+		v.validateOneOf(s, node)
+		return
+	}
+	switch s.Type {
+	case "object":
+		if isNull(node) {
+			return
+		}
+		if node.Kind != yaml.MappingNode {
+			v.report(node, "expected a mapping, got %s", describe(node))
+			return
+		}
+		v.validateObject(s, node)
+	case "array":
+		if isNull(node) {
+			return
+		}
+		if node.Kind != yaml.SequenceNode {
+			v.report(node, "expected a list, got %s", describe(node))
+			return
+		}
+		for _, item := range node.Content {
+			v.validate(s.Items, item)
+		}
+	case "string":
+		if node.Kind != yaml.ScalarNode || isNull(node) {
+			v.report(node, "expected a string, got %s", describe(node))
+		} else if len(s.Enum) > 0 && !contains(s.Enum, node.Value) {
+			v.report(node, "expected one of %s, got %s", strings.Join(s.Enum, ", "), describe(node))
+		}
+	case "integer":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!int" {
+			v.report(node, "expected an integer, got %s", describe(node))
+		}
+	case "boolean":
+		if node.Kind != yaml.ScalarNode || node.Tag != "!!bool" {
+			v.report(node, "expected true or false, got %s", describe(node))
+		}
+	}
+}
+
+func (v *validator) validateObject(s *schema, node *yaml.Node) {
+	present := map[string]bool{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		present[key.Value] = true
+		if prop, ok := s.Properties[key.Value]; ok {
+			v.validate(prop, value)
+			continue
+		}
+		switch additional := s.AdditionalProperties.(type) {
+		case *schema:
+			v.validate(additional, value)
+		case bool:
+			if suggestion := closest(key.Value, s.Properties); suggestion != "" {
+				v.report(key, "unknown field %q, did you mean %q?", key.Value, suggestion)
+			} else {
+				v.report(key, "unknown field %q", key.Value)
+			}
+		}
+	}
+	for _, required := range s.Required {
+		if !present[required] {
+			v.report(node, "missing required field %q", required)
+		}
+	}
+	fields := []string{}
+	for field := range s.DependentRequired {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, required := range s.DependentRequired[field] {
+			if present[field] && !present[required] {
+				v.report(node, "missing field %q, it is required with %q", required, field)
+			}
+		}
+	}
+}
+
+// validateOneOf reports the problems of the alternative matching the kind of node, when no alternative matches
+func (v *validator) validateOneOf(s *schema, node *yaml.Node) {
+	var best []error
+	for _, alternative := range s.OneOf {
+		try := &validator{file: v.file, problems: []error{}}
+		try.validate(alternative, node)
+		if len(try.problems) == 0 {
+			return
+		}
+		if best == nil && kindMatches(alternative, node) {
+			best = try.problems
+		}
+	}
+	if best == nil {
+		expected := []string{}
+		for _, alternative := range s.OneOf {
+			expected = append(expected, alternative.Type)
+		}
+		v.report(node, "expected a %s, got %s", strings.Join(expected, " or "), describe(node))
+		return
+	}
+	v.problems = append(v.problems, best...)
+}
+
+func kindMatches(s *schema, node *yaml.Node) bool {
+	switch s.Type {
+	case "object":
+		return node.Kind == yaml.MappingNode
+	case "array":
+		return node.Kind == yaml.SequenceNode
+	}
+	return node.Kind == yaml.ScalarNode
+}
+
+func describe(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	if isNull(node) {
+		return "nothing"
+	}
+	return fmt.Sprintf("%q", node.Value)
+}
+
+// closest is the field a misspelled field was most likely meant to be, or nothing when none is close
+func closest(field string, properties map[string]*schema) string {
+	best, bestDistance := "", 3
+	for name := range properties {
+		distance := editDistance(strings.ToLower(field), name)
+		if distance < bestDistance || (distance == bestDistance && name < best) {
+			best, bestDistance = name, distance
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func min(values ...int) int {
+	m := values[0]
+	for _, v := range values[1:] {
+		if v < m {
+			m = v
+		}
+	}
+	return m
+}
@@ -0,0 +1,86 @@
+package workspaces
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var invalidConfig = `workspace_name: ws
+on_install: []
+cache:
+  provider: local_cache
+  Settings:
+    local_cache_dir: /tmp/cache
+commands:
+  build:
+    command: go build
+    resources: many
+    depends_on:
+      - ^protoc
+      - pkg: plugins
+  lint:
+    type: shell
+    depends_on: lint
+`
+
+func TestValidationReportsWhereProblemsAre(t *testing.T) {
+	assert := assert.New(t)
+
+	problems := validateConfig([]byte(invalidConfig), "harbor.conf")
+	messages := []string{}
+	for _, problem := range problems {
+		messages = append(messages, problem.Error())
+	}
+	assert.Equal([]string{
+		`harbor.conf:2:1: unknown field "on_install"`,
+		`harbor.conf:5:3: unknown field "Settings", did you mean "settings"?`,
+		`harbor.conf:10:16: expected an integer, got "many"`,
+		`harbor.conf:13:9: missing required field "command"`,
+		`harbor.conf:9:5: missing field "type", it is required with "command"`,
+		`harbor.conf:16:17: expected a list, got "lint"`,
+	}, messages)
+
+	assert.Empty(validateConfig([]byte(`
+workspace_name: ws
+dependencies: ["plugins/*"]
+cache:
+  - provider: local_cache
+    settings:
+      read_only: true
+commands:
+  harbor: {}
+  build:
+    type: shell
+    command: go build
+    depends_on: [^build, "plugins:protoc", {pkg: ".", command: lint}]
+    inputs:
+      respect_gitignore: false
+`), "harbor.conf"))
+}
+
+func TestStrictLoadingFailsOnProblems(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "harbor.conf")
+	assert.NoError(os.WriteFile(path, []byte("workspace_name: ws\non_install: []\ncache:\n  provider: local_cache\n  Settings: {}\n"), 0644))
+
+	_, err := loadConfig(path)
+	assert.NoError(err, "the loader ignores unknown fields by default")
+
+	Strict = true
+	defer func() { Strict = false }()
+	_, err = loadConfig(path)
+	assert.IsType(ConfigErrors{}, err)
+	assert.Len(err, 2)
+}
+
+func TestPublishedSchemaIsUpToDate(t *testing.T) {
+	assert := assert.New(t)
+	schema, err := JSONSchema()
+	assert.NoError(err)
+	published, err := os.ReadFile("../../schema/harbor.schema.json")
+	assert.NoError(err)
+	assert.Equal(string(schema), string(published), "regenerate schema/harbor.schema.json with harbor workspace schema")
+}
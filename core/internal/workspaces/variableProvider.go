@@ -3,25 +3,54 @@ package workspaces
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/radding/harbor-plugins/proto"
 	mathparser "github.com/radding/harbor/internal/MathParser"
+	"github.com/radding/harbor/internal/config"
+	"github.com/rs/zerolog/log"
 )
 
 type Provider interface {
 	Resolve(variableName string) (*mathparser.Value, error)
 }
 
+// ArgumentProvider is implemented by providers with variables that take an argument, like file.exists("go.sum")
+type ArgumentProvider interface {
+	ResolveArgument(variableName, argument string) (*mathparser.Value, error)
+}
+
 type variableResolver struct {
 	providers map[string]Provider
+	// discover registers more providers the first time a provider isn't found
+	discover func(*variableResolver)
 }
 
-func (e *variableResolver) GetValue(providerName, variableName string) (*mathparser.Value, error) {
+func (e *variableResolver) provider(providerName string) (Provider, error) {
 	provider, ok := e.providers[providerName]
+	if !ok && e.discover != nil {
+		discover := e.discover
+		e.discover = nil
+		discover(e)
+		provider, ok = e.providers[providerName]
+	}
 	if !ok {
 		return nil, fmt.Errorf("can't find povider with name %s", providerName)
 	}
+	return provider, nil
+}
+
+func (e *variableResolver) GetValue(providerName, variableName string) (*mathparser.Value, error) {
+	provider, err := e.provider(providerName)
+	if err != nil {
+		return nil, err
+	}
 	val, err := provider.Resolve(variableName)
 	if err != nil {
 		return nil, errors.Wrapf(err, "error resolving value with provider %s", providerName)
@@ -29,6 +58,22 @@ func (e *variableResolver) GetValue(providerName, variableName string) (*mathpar
 	return val, nil
 }
 
+func (e *variableResolver) GetValueOf(providerName, variableName, argument string) (*mathparser.Value, error) {
+	provider, err := e.provider(providerName)
+	if err != nil {
+		return nil, err
+	}
+	argProvider, ok := provider.(ArgumentProvider)
+	if !ok {
+		return nil, fmt.Errorf("the variables of provider %s don't take arguments", providerName)
+	}
+	val, err := argProvider.ResolveArgument(variableName, argument)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error resolving value with provider %s", providerName)
+	}
+	return val, nil
+}
+
 func newVariableResolver() *variableResolver {
 	return &variableResolver{
 		providers: map[string]Provider{},
@@ -39,6 +84,11 @@ func (e *variableResolver) registerProvider(name string, provider Provider) {
 	e.providers[name] = provider
 }
 
+func (e *variableResolver) hasProvider(name string) bool {
+	_, ok := e.providers[name]
+	return ok
+}
+
 type ProviderFunc func(variableName string) (*mathparser.Value, error)
 
 func (p ProviderFunc) Resolve(variableName string) (*mathparser.Value, error) {
@@ -50,19 +100,277 @@ func getEnvVariable(variableName string) (*mathparser.Value, error) {
 	if !present {
 		return nil, fmt.Errorf("%s not present in environment", variableName)
 	}
+	return parseValue(value), nil
+}
+
+// parseValue is the number or bool written as value, or value itself as a string
+func parseValue(value string) *mathparser.Value {
 	floatVal, err := strconv.ParseFloat(value, 64)
 	if err == nil {
 		return &mathparser.Value{
 			Number: &floatVal,
-		}, nil
+		}
 	}
 	boolVal, err := strconv.ParseBool(value)
 	if err == nil {
 		return &mathparser.Value{
 			BoolVal: (*mathparser.Boolean)(&boolVal),
-		}, nil
+		}
 	}
 	return &mathparser.Value{
 		StringValue: &value,
-	}, nil
+	}
+}
+
+func stringValue(s string) *mathparser.Value {
+	return &mathparser.Value{StringValue: &s}
+}
+
+func numberValue(n float64) *mathparser.Value {
+	return &mathparser.Value{Number: &n}
+}
+
+func boolValue(b bool) *mathparser.Value {
+	return &mathparser.Value{BoolVal: (*mathparser.Boolean)(&b)}
+}
+
+// variables is a provider of a fixed set of variables, they are only computed when they are used
+type variables map[string]func() (*mathparser.Value, error)
+
+func (v variables) Resolve(variableName string) (*mathparser.Value, error) {
+	resolve, ok := v[variableName]
+	if !ok {
+		return nil, fmt.Errorf("%s is not defined", variableName)
+	}
+	return resolve()
+}
+
+// fileVariables resolves file.exists("path"), the path is relative to the package
+type fileVariables struct {
+	dir string
+}
+
+func (f fileVariables) Resolve(variableName string) (*mathparser.Value, error) {
+	if variableName != "exists" {
+		return nil, fmt.Errorf("%s is not defined", variableName)
+	}
+	return nil, fmt.Errorf("%s takes the path of a file, like file.%s(\"go.sum\")", variableName, variableName)
+}
+
+func (f fileVariables) ResolveArgument(variableName, argument string) (*mathparser.Value, error) {
+	if variableName != "exists" {
+		return nil, fmt.Errorf("%s is not defined", variableName)
+	}
+	path := filepath.FromSlash(argument)
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(f.dir, path)
+	}
+	_, err := os.Stat(path)
+	return boolValue(err == nil), nil
+}
+
+// gitValue is the first line git prints
+func gitValue(dir string, args ...string) (*mathparser.Value, error) {
+	lines, err := git(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("git %s printed nothing", strings.Join(args, " "))
+	}
+	return stringValue(lines[0]), nil
+}
+
+// root is the workspace the package belongs to
+func (w *WorkspaceConfig) root() *WorkspaceConfig {
+	if w.workspace == nil {
+		return w
+	}
+	return w.workspace
+}
+
+// vars are the vars of the workspace with the ones of the package over them
+func (w *WorkspaceConfig) vars() map[string]string {
+	vars := map[string]string{}
+	for name, value := range w.root().Vars {
+		vars[name] = value
+	}
+	for name, value := range w.Vars {
+		vars[name] = value
+	}
+	return vars
+}
+
+// builtinVariables registers the providers harbor comes with: env, os, git, pkg, workspace, args, vars and file
+func (w *WorkspaceConfig) builtinVariables(args []string) *variableResolver {
+	dir := w.WorkspaceRoot()
+	workspaceName, workspaceRoot := w.root().Name, w.root().WorkspaceRoot()
+	vars := w.vars()
+	n := newVariableResolver()
+	n.registerProvider("env", ProviderFunc(getEnvVariable))
+	n.registerProvider("os", variables{
+		"name": func() (*mathparser.Value, error) { return stringValue(runtime.GOOS), nil },
+		"arch": func() (*mathparser.Value, error) { return stringValue(runtime.GOARCH), nil },
+	})
+	n.registerProvider("git", variables{
+		"branch": func() (*mathparser.Value, error) {
+			return gitValue(dir, "rev-parse", "--abbrev-ref", "HEAD")
+		},
+		"commit": func() (*mathparser.Value, error) {
+			return gitValue(dir, "rev-parse", "HEAD")
+		},
+		"sha": func() (*mathparser.Value, error) {
+			return gitValue(dir, "rev-parse", "HEAD")
+		},
+		"short_sha": func() (*mathparser.Value, error) {
+			return gitValue(dir, "rev-parse", "--short", "HEAD")
+		},
+		// dirty is whether the package has uncommitted or untracked changes
+		"dirty": func() (*mathparser.Value, error) {
+			lines, err := git(dir, "status", "--porcelain", "--", ".")
+			if err != nil {
+				return nil, errors.Wrap(err, "can't get the status of the package")
+			}
+			return boolValue(len(lines) > 0), nil
+		},
+	})
+	n.registerProvider("pkg", variables{
+		"name": func() (*mathparser.Value, error) { return stringValue(w.Name), nil },
+		// path is slash separated and relative to the workspace root, . for the workspace itself
+		"path": func() (*mathparser.Value, error) {
+			rel, err := filepath.Rel(workspaceRoot, dir)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't find the package in the workspace")
+			}
+			return stringValue(filepath.ToSlash(rel)), nil
+		},
+	})
+	n.registerProvider("workspace", variables{
+		"name": func() (*mathparser.Value, error) { return stringValue(workspaceName), nil },
+		"root": func() (*mathparser.Value, error) { return stringValue(workspaceRoot), nil },
+	})
+	n.registerProvider("args", variables{
+		"count": func() (*mathparser.Value, error) { return numberValue(float64(len(args))), nil },
+		"all":   func() (*mathparser.Value, error) { return stringValue(strings.Join(args, " ")), nil },
+	})
+	n.registerProvider("vars", ProviderFunc(func(variableName string) (*mathparser.Value, error) {
+		value, ok := vars[variableName]
+		if !ok {
+			return nil, fmt.Errorf("%s is not in vars", variableName)
+		}
+		return parseValue(value), nil
+	}))
+	n.registerProvider("file", fileVariables{dir: dir})
+	return n
+}
+
+// pluginVariables resolves the variables of a namespace a plugin provides
+type pluginVariables struct {
+	client    plugins.PluginClient
+	namespace string
+	dir       string
+}
+
+func (p pluginVariables) resolve(variableName string, argument *string) (*mathparser.Value, error) {
+	req := &plugins.ResolveVariableRequest{
+		Namespace:        p.namespace,
+		Name:             variableName,
+		PackageDirectory: p.dir,
+	}
+	if argument != nil {
+		req.Arg, req.HasArg = *argument, true
+	}
+	value, defined, err := p.client.ResolveVariable(req)
+	if err != nil {
+		return nil, err
+	}
+	if !defined {
+		return nil, fmt.Errorf("%s is not defined", variableName)
+	}
+	switch val := value.(type) {
+	case string:
+		return stringValue(val), nil
+	case float64:
+		return numberValue(val), nil
+	case bool:
+		return boolValue(val), nil
+	}
+	return nil, fmt.Errorf("%s is a %T", variableName, value)
+}
+
+func (p pluginVariables) Resolve(variableName string) (*mathparser.Value, error) {
+	return p.resolve(variableName, nil)
+}
+
+func (p pluginVariables) ResolveArgument(variableName, argument string) (*mathparser.Value, error) {
+	return p.resolve(variableName, &argument)
+}
+
+var (
+	pluginNamespacesLock sync.Mutex
+	// pluginNamespaces are the plugins providing every namespace, the first plugin by name wins. They are only
+	// kept once every plugin answered and one of them provides a namespace.
+	pluginNamespaces map[string]string
+	// discoverPluginNamespaces asks the installed plugins for their namespaces, it fails when one of them can't
+	// be asked
+	discoverPluginNamespaces = askPluginNamespaces
+)
+
+func askPluginNamespaces() (map[string]string, error) {
+	res := map[string]string{}
+	var discoverErr error
+	for _, name := range config.Get().ProvidersOf(proto.PluginCapabilities_VARIABLE_PROVIDER) {
+		client, err := config.Get().GetPlugin(name)
+		if err != nil {
+			discoverErr = errors.Wrapf(err, "can't load variable provider %s", name)
+			log.Warn().Err(err).Msgf("can't load variable provider %s", name)
+			continue
+		}
+		namespaces, err := client.Namespaces()
+		if err != nil {
+			discoverErr = errors.Wrapf(err, "can't get the namespaces of %s", name)
+			log.Warn().Err(err).Msgf("can't get the namespaces of %s", name)
+			continue
+		}
+		for _, namespace := range namespaces {
+			if owner, ok := res[namespace]; ok {
+				log.Warn().Msgf("%s and %s both provide %s, using %s", owner, name, namespace, owner)
+				continue
+			}
+			res[namespace] = name
+		}
+	}
+	return res, discoverErr
+}
+
+// loadPluginNamespaces returns the namespaces of the installed variable provider plugins. Starting plugins is
+// slow, so it is only called once something uses a namespace that isn't built in. A failed or empty discovery
+// is asked again the next time, a plugin that failed once may answer then.
+func loadPluginNamespaces() map[string]string {
+	pluginNamespacesLock.Lock()
+	defer pluginNamespacesLock.Unlock()
+	if pluginNamespaces != nil {
+		return pluginNamespaces
+	}
+	namespaces, err := discoverPluginNamespaces()
+	if err == nil && len(namespaces) > 0 {
+		pluginNamespaces = namespaces
+	}
+	return namespaces
+}
+
+// registerPluginVariables registers the namespaces of the installed variable provider plugins for the package in
+// dir, the built in providers can't be replaced by them
+func registerPluginVariables(n *variableResolver, dir string) {
+	for namespace, name := range loadPluginNamespaces() {
+		if n.hasProvider(namespace) {
+			continue
+		}
+		client, err := config.Get().GetPlugin(name)
+		if err != nil {
+			log.Warn().Err(err).Msgf("can't load variable provider %s", name)
+			continue
+		}
+		n.registerProvider(namespace, pluginVariables{client: client, namespace: namespace, dir: dir})
+	}
 }
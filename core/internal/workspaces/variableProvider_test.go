@@ -0,0 +1,144 @@
+package workspaces
+
+import (
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	mathparser "github.com/radding/harbor/internal/MathParser"
+	"github.com/stretchr/testify/assert"
+)
+
+func evaluate(t *testing.T, lookup mathparser.VariableLookUp, source string) (bool, error) {
+	expr, err := mathparser.Parse(source)
+	assert.NoError(t, err, source)
+	return expr.Evaluate(lookup)
+}
+
+func TestBuiltinVariables(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, affectedWorkspace)
+	writeFiles(t, root, map[string]string{"libs/util/go.sum": ""})
+	conf := loadTestWorkspace(t, root)
+	util, err := conf.GetPackageConfig("util")
+	assert.NoError(t, err)
+
+	lookup := util.builtinVariables([]string{"--verbose", "./..."})
+	for _, source := range []string{
+		`os.name == "` + runtime.GOOS + `" && os.arch == "` + runtime.GOARCH + `"`,
+		`pkg.name == "util" && pkg.path == "libs/util"`,
+		`workspace.name == "ws" && workspace.root == "` + root + `"`,
+		`args.count == 2 && contains(args.all, "--verbose")`,
+		`file.exists("go.sum") && !file.exists("go.mod") && file.exists("../core/harbor.conf")`,
+	} {
+		res, err := evaluate(t, lookup, source)
+		assert.NoError(t, err, source)
+		assert.True(t, res, source)
+	}
+
+	res, err := evaluate(t, conf.builtinVariables(nil), `pkg.path == "." && workspace.name == pkg.name && args.count == 0`)
+	assert.NoError(t, err)
+	assert.True(t, res)
+
+	for _, source := range []string{`os.kernel == "linux"`, `file.exists`, `pkg.name("util")`, `nope.name == "x"`} {
+		_, err := evaluate(t, lookup, source)
+		assert.Error(t, err, source)
+	}
+}
+
+func TestGitVariables(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	assert := assert.New(t)
+	root := t.TempDir()
+	writeFiles(t, root, affectedWorkspace)
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "harbor@example.com")
+	}
+	_, err := git(root, "init", "-q", "-b", "main")
+	assert.NoError(err)
+	_, err = git(root, "add", ".")
+	assert.NoError(err)
+	_, err = git(root, "commit", "-qm", "initial")
+	assert.NoError(err)
+	writeFiles(t, root, map[string]string{"app/main.go": "package main\n"})
+	conf := loadTestWorkspace(t, root)
+
+	app, _ := conf.GetPackageConfig("app")
+	core, _ := conf.GetPackageConfig("core")
+	res, err := evaluate(t, app.builtinVariables(nil), `git.branch == "main" && git.dirty && git.commit =~ "^[0-9a-f]{40}$" && git.sha == git.commit && startsWith(git.sha, git.short_sha)`)
+	assert.NoError(err)
+	assert.True(res)
+	res, err = evaluate(t, core.builtinVariables(nil), `git.dirty`)
+	assert.NoError(err)
+	assert.False(res, "only changes in the package make it dirty")
+}
+
+// fakeVariables is a plugin namespace resolving every variable to its name
+type fakeVariables struct{}
+
+func (fakeVariables) Resolve(variableName string) (*mathparser.Value, error) {
+	return stringValue(variableName), nil
+}
+
+func TestPluginNamespacesAreDiscoveredOnce(t *testing.T) {
+	assert := assert.New(t)
+	conf := WorkspaceConfig{Name: "ws"}
+	lookup := conf.builtinVariables(nil)
+	discovered := 0
+	lookup.discover = func(n *variableResolver) {
+		discovered++
+		for _, namespace := range []string{"docker", "pkg"} {
+			if !n.hasProvider(namespace) {
+				n.registerProvider(namespace, fakeVariables{})
+			}
+		}
+	}
+
+	res, err := evaluate(t, lookup, `docker.running == "running" && pkg.name == "ws"`)
+	assert.NoError(err)
+	assert.True(res, "built in providers win over plugins")
+	_, err = evaluate(t, lookup, `missing.name == "name"`)
+	assert.Error(err)
+	assert.Equal(1, discovered)
+}
+
+func TestPluginNamespacesAreOnlyDiscoveredWhenNeeded(t *testing.T) {
+	assert := assert.New(t)
+	discovered := 0
+	var discoverErr error
+	discoverPluginNamespaces = func() (map[string]string, error) {
+		discovered++
+		if discoverErr != nil {
+			return map[string]string{}, discoverErr
+		}
+		return map[string]string{"docker": "docker_plugin"}, nil
+	}
+	t.Cleanup(func() {
+		discoverPluginNamespaces = askPluginNamespaces
+		pluginNamespaces = nil
+	})
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"builtin.conf": "workspace_name: builtin\ncommands:\n  build:\n    conditions:\n      - os.name == \"linux\" && env.CI\n",
+		"plugin.conf":  "workspace_name: plugin\ncommands:\n  build:\n    conditions:\n      - docker.running\n",
+	})
+
+	_, err := loadConfig(filepath.Join(root, "builtin.conf"))
+	assert.NoError(err)
+	assert.Equal(0, discovered, "built in namespaces don't need plugins")
+
+	discoverErr = errors.New("plugin crashed")
+	_, err = loadConfig(filepath.Join(root, "plugin.conf"))
+	assert.NoError(err)
+	assert.Equal(1, discovered)
+
+	discoverErr = nil
+	assert.Equal(map[string]string{"docker": "docker_plugin"}, loadPluginNamespaces(), "failures are asked again")
+	_, err = loadConfig(filepath.Join(root, "plugin.conf"))
+	assert.NoError(err)
+	assert.Equal(2, discovered)
+}
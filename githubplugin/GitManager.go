@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+)
+
+var commitPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+// GitManager clones git repositories with the git command line, so it uses the same credentials and
+// configuration as the user's git does
+type GitManager struct{}
+
+func getLogger(ctx context.Context) hclog.Logger {
+	logger, ok := ctx.Value("Logger").(hclog.Logger)
+	if !ok {
+		return hclog.NewNullLogger()
+	}
+	return logger
+}
+
+// isLocal reports whether source is a local repository rather than a url
+func isLocal(source string) bool {
+	return strings.HasPrefix(source, "file://") || !strings.Contains(source, "://") && !isScpLike(source)
+}
+
+// isScpLike reports whether source is written like git@github.com:radding/harbor.git
+func isScpLike(source string) bool {
+	colon := strings.Index(source, ":")
+	slash := strings.Index(source, "/")
+	return colon > 0 && (slash < 0 || colon < slash) && !filepath.IsAbs(source)
+}
+
+func (g *GitManager) CanHandle(ctx context.Context, req *plugins.CanHandleRequest) (bool, error) {
+	source := req.Url
+	switch {
+	case strings.HasPrefix(source, "git@"),
+		strings.HasPrefix(source, "https://"),
+		strings.HasPrefix(source, "http://"),
+		strings.HasPrefix(source, "ssh://"),
+		strings.HasPrefix(source, "git://"):
+		return true, nil
+	case strings.HasPrefix(source, "file://") || isLocal(source):
+		path := strings.TrimPrefix(source, "file://")
+		if _, err := os.Stat(path); err != nil {
+			return false, nil
+		}
+		// works for both bare repositories and working trees
+		_, err := git(ctx, "", "-C", path, "rev-parse", "--git-dir")
+		return err == nil, nil
+	}
+	return false, nil
+}
+
+func (g *GitManager) Clone(ctx context.Context, req *plugins.CloneRequest) (*plugins.CloneResponse, error) {
+	logger := getLogger(ctx)
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, &plugins.CloneError{Code: plugins.CloneErrUnknown, Message: "git is not installed"}
+	}
+	remote, err := resolveRemote(req.Source)
+	if err != nil {
+		return nil, &plugins.CloneError{Code: plugins.CloneErrNotFound, Message: err.Error()}
+	}
+
+	// git refuses to clone local submodules unless the file transport is allowed
+	config := []string{}
+	if isLocal(req.Source) {
+		config = append(config, "-c", "protocol.file.allow=always")
+	}
+	depth := []string{}
+	if req.Depth > 0 {
+		depth = append(depth, "--depth", strconv.FormatInt(req.Depth, 10))
+	}
+
+	if req.Update && isCheckout(ctx, req.Destination) {
+		return g.update(ctx, req, remote, config, depth)
+	}
+	if err := ensureEmpty(req.Destination); err != nil {
+		return nil, err
+	}
+
+	ref := req.Ref
+	isCommit := false
+	if ref != "" {
+		found, err := remoteHasRef(ctx, remote, ref)
+		if err != nil {
+			return nil, classify(err, req.Source, ref)
+		}
+		isCommit = !found
+		if isCommit && !commitPattern.MatchString(ref) {
+			return nil, &plugins.CloneError{
+				Code:    plugins.CloneErrRefNotFound,
+				Message: fmt.Sprintf("%s has no branch or tag named %s", req.Source, ref),
+			}
+		}
+	}
+
+	args := append(append([]string{}, config...), "clone")
+	switch {
+	case isCommit:
+		// a commit can't be cloned directly, clone everything and check it out afterwards
+		if req.Depth > 0 {
+			logger.Warn(fmt.Sprintf("%s is a commit, cloning the full history instead of %d commits", ref, req.Depth))
+		}
+		args = append(args, "--no-checkout")
+	case ref != "":
+		args = append(args, "--branch", ref)
+		args = append(args, depth...)
+	default:
+		args = append(args, depth...)
+	}
+	cloneURL := remote
+	if isLocal(req.Source) && req.Depth > 0 && !isCommit {
+		// git ignores --depth for plain local paths
+		cloneURL = "file://" + remote
+	}
+	args = append(args, "--", cloneURL, req.Destination)
+	logger.Info(fmt.Sprintf("cloning %s into %s", req.Source, req.Destination))
+	if _, err := git(ctx, "", args...); err != nil {
+		os.RemoveAll(req.Destination)
+		return nil, classify(err, req.Source, ref)
+	}
+
+	if isCommit {
+		if _, err := git(ctx, req.Destination, "rev-parse", "--verify", "--quiet", ref+"^{commit}"); err != nil {
+			os.RemoveAll(req.Destination)
+			return nil, &plugins.CloneError{
+				Code:    plugins.CloneErrRefNotFound,
+				Message: fmt.Sprintf("%s has no branch, tag or commit named %s", req.Source, ref),
+			}
+		}
+		if _, err := git(ctx, req.Destination, "checkout", "--detach", ref); err != nil {
+			os.RemoveAll(req.Destination)
+			return nil, classify(err, req.Source, ref)
+		}
+	}
+	if req.Submodules {
+		if err := updateSubmodules(ctx, req.Destination, config, depth); err != nil {
+			os.RemoveAll(req.Destination)
+			return nil, classify(err, req.Source, ref)
+		}
+	}
+	return checkedOut(ctx, req, remote)
+}
+
+// update moves an existing checkout to req.Ref, without a ref it keeps what is checked out
+func (g *GitManager) update(ctx context.Context, req *plugins.CloneRequest, remote string, config []string, depth []string) (*plugins.CloneResponse, error) {
+	dest := req.Destination
+	ref := req.Ref
+	changes, err := git(ctx, dest, "status", "--porcelain")
+	if err != nil {
+		return nil, classify(err, req.Source, ref)
+	}
+	if changes != "" {
+		return nil, &plugins.CloneError{
+			Code:    plugins.CloneErrDirty,
+			Message: fmt.Sprintf("%s has uncommitted changes, commit or discard them first", dest),
+		}
+	}
+	if ref == "" {
+		return checkedOut(ctx, req, remote)
+	}
+
+	head, err := git(ctx, dest, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, classify(err, req.Source, ref)
+	}
+	target, err := git(ctx, dest, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err == nil && target == head {
+		// already there, which also keeps syncing offline when nothing changed
+		return checkedOut(ctx, req, remote)
+	}
+
+	isBranchOrTag, err := remoteHasRef(ctx, remote, ref)
+	if err != nil {
+		return nil, classify(err, req.Source, ref)
+	}
+	if isBranchOrTag || target == "" {
+		getLogger(ctx).Info(fmt.Sprintf("fetching %s of %s", ref, req.Source))
+		args := append(append(append([]string{}, config...), "fetch"), depth...)
+		args = append(args, "origin", ref)
+		if _, err := git(ctx, dest, args...); err != nil {
+			return nil, &plugins.CloneError{
+				Code:    plugins.CloneErrRefNotFound,
+				Message: fmt.Sprintf("can't fetch %s of %s: %s", ref, req.Source, err),
+			}
+		}
+		target = "FETCH_HEAD"
+	}
+	if _, err := git(ctx, dest, "checkout", "--detach", target); err != nil {
+		return nil, classify(err, req.Source, ref)
+	}
+	if req.Submodules {
+		if err := updateSubmodules(ctx, dest, config, depth); err != nil {
+			return nil, classify(err, req.Source, ref)
+		}
+	}
+	return checkedOut(ctx, req, remote)
+}
+
+func updateSubmodules(ctx context.Context, dir string, config []string, depth []string) error {
+	args := append(append([]string{}, config...), "submodule", "update", "--init", "--recursive")
+	_, err := git(ctx, dir, append(args, depth...)...)
+	return err
+}
+
+// checkedOut describes what is checked out at the destination of req
+func checkedOut(ctx context.Context, req *plugins.CloneRequest, remote string) (*plugins.CloneResponse, error) {
+	commit, err := git(ctx, req.Destination, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, classify(err, req.Source, req.Ref)
+	}
+	return &plugins.CloneResponse{
+		Destination:    req.Destination,
+		ResolvedRemote: remote,
+		Commit:         commit,
+	}, nil
+}
+
+// isCheckout reports whether dir is the top of a git working tree
+func isCheckout(ctx context.Context, dir string) bool {
+	top, err := git(ctx, dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return false
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	return err == nil && filepath.Clean(top) == resolved
+}
+
+// resolveRemote makes local paths absolute, so the recorded remote doesn't depend on where harbor ran
+func resolveRemote(source string) (string, error) {
+	if !isLocal(source) {
+		return source, nil
+	}
+	path, err := filepath.Abs(strings.TrimPrefix(source, "file://"))
+	if err != nil {
+		return "", errors.Wrapf(err, "can't get the absolute path of %s", source)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return "", fmt.Errorf("%s does not exist", path)
+	}
+	return path, nil
+}
+
+func ensureEmpty(dir string) error {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return &plugins.CloneError{Code: plugins.CloneErrDestinationExists, Message: err.Error()}
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != io.EOF {
+		return &plugins.CloneError{
+			Code:    plugins.CloneErrDestinationExists,
+			Message: fmt.Sprintf("%s already exists and is not an empty directory", dir),
+		}
+	}
+	return nil
+}
+
+// remoteHasRef reports whether ref is a branch or tag of remote
+func remoteHasRef(ctx context.Context, remote, ref string) (bool, error) {
+	out, err := git(ctx, "", "ls-remote", "--heads", "--tags", "--", remote, ref)
+	if err != nil {
+		return false, err
+	}
+	return out != "", nil
+}
+
+type gitError struct {
+	args   []string
+	stderr string
+	err    error
+}
+
+func (g *gitError) Error() string {
+	return fmt.Sprintf("git %s: %s: %s", strings.Join(g.args, " "), g.err, g.stderr)
+}
+
+func git(ctx context.Context, dir string, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	// never wait on a credential prompt nobody can see
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	getLogger(ctx).Debug(fmt.Sprintf("running git %s", strings.Join(args, " ")))
+	if err := cmd.Run(); err != nil {
+		return "", &gitError{args: args, stderr: strings.TrimSpace(stderr.String()), err: err}
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// classify turns a failed git command into a CloneError with the code that best describes it
+func classify(err error, source, ref string) error {
+	gitErr := &gitError{}
+	if !errors.As(err, &gitErr) {
+		return &plugins.CloneError{Code: plugins.CloneErrUnknown, Message: err.Error()}
+	}
+	stderr := strings.ToLower(gitErr.stderr)
+	code := plugins.CloneErrUnknown
+	switch {
+	case strings.Contains(stderr, "authentication failed"),
+		strings.Contains(stderr, "permission denied"),
+		strings.Contains(stderr, "could not read username"):
+		code = plugins.CloneErrAuthentication
+	case strings.Contains(stderr, "remote branch") && strings.Contains(stderr, "not found"),
+		strings.Contains(stderr, "did not match any"),
+		strings.Contains(stderr, "reference is not a tree"):
+		code = plugins.CloneErrRefNotFound
+	case strings.Contains(stderr, "not found"),
+		strings.Contains(stderr, "does not exist"),
+		strings.Contains(stderr, "does not appear to be a git repository"),
+		// the remote can't be reached at all
+		strings.Contains(stderr, "could not resolve host"),
+		strings.Contains(stderr, "failed to connect"),
+		strings.Contains(stderr, "connection refused"):
+		code = plugins.CloneErrNotFound
+	}
+	message := fmt.Sprintf("can't clone %s: %s", source, gitErr.stderr)
+	if ref != "" {
+		message = fmt.Sprintf("can't clone %s at %s: %s", source, ref, gitErr.stderr)
+	}
+	return &plugins.CloneError{Code: code, Message: message}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/stretchr/testify/assert"
+)
+
+// upstream is a bare repository with a main branch of two commits, the first tagged v1, and a feature branch
+// with a third commit
+type upstream struct {
+	bare    string
+	first   string
+	second  string
+	feature string
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := git(context.Background(), dir, append([]string{"-c", "protocol.file.allow=always"}, args...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func commitFile(t *testing.T, dir, name, contents string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	runGit(t, dir, "add", ".")
+	runGit(t, dir, "commit", "-qm", "change "+name)
+	return runGit(t, dir, "rev-parse", "HEAD")
+}
+
+// isolateGit keeps the configuration of whoever runs the tests, like credential helpers, out of them
+func isolateGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	for _, env := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(env, "harbor@example.com")
+	}
+}
+
+func newBare(t *testing.T, name string) (string, string) {
+	root := t.TempDir()
+	bare := filepath.Join(root, name+".git")
+	runGit(t, root, "init", "-q", "--bare", "-b", "main", bare)
+	work := filepath.Join(root, "work")
+	runGit(t, root, "clone", "-q", bare, work)
+	return bare, work
+}
+
+func newUpstream(t *testing.T) upstream {
+	isolateGit(t)
+	bare, work := newBare(t, "upstream")
+	u := upstream{bare: bare}
+	u.first = commitFile(t, work, "README", "one")
+	runGit(t, work, "tag", "v1")
+	u.second = commitFile(t, work, "README", "two")
+	runGit(t, work, "checkout", "-qb", "feature")
+	u.feature = commitFile(t, work, "FEATURE", "feature")
+	runGit(t, work, "push", "-q", "origin", "main", "feature", "v1")
+	return u
+}
+
+func clone(req *plugins.CloneRequest) (*plugins.CloneResponse, error) {
+	return (&GitManager{}).Clone(context.Background(), req)
+}
+
+func assertCloneError(t *testing.T, err error, code int64) {
+	t.Helper()
+	cloneErr := &plugins.CloneError{}
+	if assert.ErrorAs(t, err, &cloneErr) {
+		assert.Equal(t, code, cloneErr.Code, cloneErr.Message)
+	}
+}
+
+func TestCloneDefaultBranch(t *testing.T) {
+	assert := assert.New(t)
+	u := newUpstream(t)
+	dest := filepath.Join(t.TempDir(), "pkg")
+
+	resp, err := clone(&plugins.CloneRequest{Source: u.bare, Destination: dest})
+	assert.NoError(err)
+	assert.Equal(u.bare, resp.ResolvedRemote)
+	assert.Equal(u.second, resp.Commit)
+	assert.Equal(dest, resp.Destination)
+	contents, err := os.ReadFile(filepath.Join(dest, "README"))
+	assert.NoError(err)
+	assert.Equal("two", string(contents))
+}
+
+func TestClonePinnedRefs(t *testing.T) {
+	u := newUpstream(t)
+	relative, err := filepath.Rel(mustGetwd(t), u.bare)
+	assert.NoError(t, err)
+	for _, tc := range []struct {
+		name   string
+		source string
+		ref    string
+		commit string
+	}{
+		{"branch", u.bare, "feature", u.feature},
+		{"tag", u.bare, "v1", u.first},
+		{"commit", u.bare, u.second, u.second},
+		{"short commit", u.bare, u.first[:8], u.first},
+		{"file url", "file://" + u.bare, "v1", u.first},
+		{"relative path", relative, "feature", u.feature},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			dest := filepath.Join(t.TempDir(), "pkg")
+			resp, err := clone(&plugins.CloneRequest{Source: tc.source, Destination: dest, Ref: tc.ref})
+			assert.NoError(err)
+			assert.Equal(tc.commit, resp.Commit)
+			assert.Equal(u.bare, resp.ResolvedRemote, "local remotes are recorded as absolute paths")
+			assert.Equal(tc.commit, runGit(t, dest, "rev-parse", "HEAD"))
+		})
+	}
+}
+
+func mustGetwd(t *testing.T) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wd
+}
+
+func TestShallowClones(t *testing.T) {
+	assert := assert.New(t)
+	u := newUpstream(t)
+
+	dest := filepath.Join(t.TempDir(), "pkg")
+	resp, err := clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Depth: 1})
+	assert.NoError(err)
+	assert.Equal(u.second, resp.Commit)
+	assert.Equal("1", runGit(t, dest, "rev-list", "--count", "HEAD"))
+	assert.Equal("true", runGit(t, dest, "rev-parse", "--is-shallow-repository"))
+
+	dest = filepath.Join(t.TempDir(), "pkg")
+	resp, err = clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Depth: 1, Ref: "feature"})
+	assert.NoError(err)
+	assert.Equal(u.feature, resp.Commit)
+	assert.Equal("1", runGit(t, dest, "rev-list", "--count", "HEAD"))
+
+	// Commits can't be cloned shallowly, the whole history is cloned instead
+	dest = filepath.Join(t.TempDir(), "pkg")
+	resp, err = clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Depth: 1, Ref: u.first})
+	assert.NoError(err)
+	assert.Equal(u.first, resp.Commit)
+	assert.Equal("false", runGit(t, dest, "rev-parse", "--is-shallow-repository"))
+}
+
+func TestCloneSubmodules(t *testing.T) {
+	assert := assert.New(t)
+	u := newUpstream(t)
+	lib, libWork := newBare(t, "lib")
+	commitFile(t, libWork, "lib.go", "package lib")
+	runGit(t, libWork, "push", "-q", "origin", "main")
+	_, work := newBare(t, "app")
+	runGit(t, work, "remote", "set-url", "origin", u.bare)
+	runGit(t, work, "fetch", "-q", "origin")
+	runGit(t, work, "checkout", "-qb", "with-lib", "origin/main")
+	runGit(t, work, "submodule", "add", "-q", lib, "lib")
+	runGit(t, work, "commit", "-qm", "add lib")
+	runGit(t, work, "push", "-q", "origin", "with-lib")
+
+	dest := filepath.Join(t.TempDir(), "pkg")
+	_, err := clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Ref: "with-lib", Submodules: true})
+	assert.NoError(err)
+	assert.FileExists(filepath.Join(dest, "lib", "lib.go"))
+
+	dest = filepath.Join(t.TempDir(), "pkg")
+	_, err = clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Ref: "with-lib"})
+	assert.NoError(err)
+	assert.NoFileExists(filepath.Join(dest, "lib", "lib.go"), "submodules are only initialized when asked for")
+}
+
+func TestCloneErrors(t *testing.T) {
+	u := newUpstream(t)
+	auth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer auth.Close()
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	notEmpty := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(notEmpty, "file"), []byte{}, 0644))
+
+	for _, tc := range []struct {
+		name string
+		req  *plugins.CloneRequest
+		code int64
+	}{
+		{"missing branch", &plugins.CloneRequest{Source: u.bare, Ref: "nope"}, plugins.CloneErrRefNotFound},
+		{"missing commit", &plugins.CloneRequest{Source: u.bare, Ref: "deadbeef"}, plugins.CloneErrRefNotFound},
+		{"missing repository", &plugins.CloneRequest{Source: filepath.Join(t.TempDir(), "nope.git")}, plugins.CloneErrNotFound},
+		{"not a repository", &plugins.CloneRequest{Source: t.TempDir()}, plugins.CloneErrNotFound},
+		{"authentication", &plugins.CloneRequest{Source: auth.URL + "/repo.git"}, plugins.CloneErrAuthentication},
+		{"unreachable remote", &plugins.CloneRequest{Source: unreachable.URL + "/repo.git"}, plugins.CloneErrNotFound},
+		{"destination exists", &plugins.CloneRequest{Source: u.bare, Destination: notEmpty}, plugins.CloneErrDestinationExists},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.req.Destination == "" {
+				tc.req.Destination = filepath.Join(t.TempDir(), "pkg")
+			}
+			_, err := clone(tc.req)
+			assertCloneError(t, err, tc.code)
+			if tc.code != plugins.CloneErrDestinationExists {
+				assert.NoDirExists(t, tc.req.Destination, "failed clones are cleaned up")
+			}
+		})
+	}
+}
+
+func TestUpdateExistingCheckouts(t *testing.T) {
+	assert := assert.New(t)
+	u := newUpstream(t)
+	dest := filepath.Join(t.TempDir(), "pkg")
+	_, err := clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Ref: "v1"})
+	assert.NoError(err)
+
+	resp, err := clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Ref: "feature", Update: true})
+	assert.NoError(err)
+	assert.Equal(u.feature, resp.Commit)
+	resp, err = clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Update: true})
+	assert.NoError(err)
+	assert.Equal(u.feature, resp.Commit, "without a ref the checkout is kept")
+
+	assert.NoError(os.WriteFile(filepath.Join(dest, "README"), []byte("local change"), 0644))
+	_, err = clone(&plugins.CloneRequest{Source: u.bare, Destination: dest, Ref: "v1", Update: true})
+	assertCloneError(t, err, plugins.CloneErrDirty)
+}
+
+func TestCanHandle(t *testing.T) {
+	u := newUpstream(t)
+	manager := &GitManager{}
+	for source, expected := range map[string]bool{
+		"git@github.com:radding/harbor.git":   true,
+		"https://github.com/radding/harbor":   true,
+		"ssh://git@github.com/radding/harbor": true,
+		u.bare:                                true,
+		"file://" + u.bare:                    true,
+		t.TempDir():                           false,
+		"s3://bucket/harbor":                  false,
+	} {
+		handled, err := manager.CanHandle(context.Background(), &plugins.CanHandleRequest{Url: source})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, handled, source)
+	}
+}
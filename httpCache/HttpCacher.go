@@ -0,0 +1,399 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/pkg/errors"
+	plugins "github.com/radding/harbor-plugins"
+)
+
+const defaultTimeout = 30 * time.Second
+
+// httpSettings are read from the settings of the cache section of workspace.conf:
+//
+//	url: base URL entries are stored under, <url>/<cacheKey>/...
+//	auth_header: header the token is sent in, defaults to Authorization
+//	auth_token: value of the auth header, environment variables are expanded
+//	timeout: timeout of a single request, defaults to 30s
+//	read_only: only read from the cache, never write to it
+type httpSettings struct {
+	baseURL    string
+	authHeader string
+	authToken  string
+	timeout    time.Duration
+	readOnly   bool
+}
+
+// cachedArtifact is an entry of the artifact manifest of a cache entry, the contents of the artifact are
+// stored at <cacheKey>/artifacts/<Sha256>
+type cachedArtifact struct {
+	Name   string      `json:"name"`
+	Sha256 string      `json:"sha256"`
+	Mode   os.FileMode `json:"mode"`
+}
+
+// manifestName is written last, an entry only exists once its manifest does
+const manifestName = "artifacts.json"
+
+type httpCacher struct {
+	settings httpSettings
+	client   *http.Client
+	// dirToHashKey memoizes the hash of the inputs, keys are calculated concurrently so it is guarded by lock
+	dirToHashKey map[string]string
+	// downloads are the directories artifacts of a replay were downloaded to until the replay is released
+	downloads map[string][]string
+	lock      *sync.Mutex
+}
+
+func newCacher() plugins.CacheProvider {
+	return &httpCacher{
+		settings: httpSettings{
+			authHeader: "Authorization",
+			timeout:    defaultTimeout,
+		},
+		client:       &http.Client{Timeout: defaultTimeout},
+		dirToHashKey: map[string]string{},
+		downloads:    map[string][]string{},
+		lock:         &sync.Mutex{},
+	}
+}
+
+func (c *httpCacher) Configure(ctx context.Context, settings map[string]interface{}) error {
+	logger := ctx.Value("Logger").(hclog.Logger)
+	baseURL, _ := settings["url"].(string)
+	if baseURL == "" {
+		return fmt.Errorf("http cache needs a url setting")
+	}
+	parsed, err := url.Parse(baseURL)
+	if err != nil {
+		return errors.Wrapf(err, "invalid url %s", baseURL)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return fmt.Errorf("url %s must be http or https", baseURL)
+	}
+	c.settings.baseURL = strings.TrimRight(baseURL, "/")
+	if header, ok := settings["auth_header"].(string); ok && header != "" {
+		c.settings.authHeader = header
+	}
+	if token, ok := settings["auth_token"].(string); ok {
+		c.settings.authToken = os.ExpandEnv(token)
+	}
+	if timeout, ok := settings["timeout"].(string); ok && timeout != "" {
+		c.settings.timeout, err = time.ParseDuration(timeout)
+		if err != nil {
+			return errors.Wrapf(err, "invalid timeout %s", timeout)
+		}
+	}
+	if readOnly, ok := settings["read_only"].(bool); ok {
+		c.settings.readOnly = readOnly
+	}
+	c.client = &http.Client{Timeout: c.settings.timeout}
+	logger.Debug(fmt.Sprintf("Using http cache at %s (read only = %t)", c.settings.baseURL, c.settings.readOnly))
+	return nil
+}
+
+func (c *httpCacher) object(cacheKey string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", c.settings.baseURL, url.PathEscape(cacheKey), name)
+}
+
+func (c *httpCacher) do(ctx context.Context, method string, objectURL string, body io.Reader, size int64) (*http.Response, error) {
+	if c.settings.baseURL == "" {
+		return nil, fmt.Errorf("http cache is not configured, set url in the cache settings")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, objectURL, body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't create %s request for %s", method, objectURL)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if c.settings.authToken != "" {
+		req.Header.Set(c.settings.authHeader, c.settings.authToken)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s %s failed", method, objectURL)
+	}
+	return resp, nil
+}
+
+// get returns the body of the object, false if it doesn't exist
+func (c *httpCacher) get(ctx context.Context, objectURL string) ([]byte, bool, error) {
+	resp, err := c.do(ctx, http.MethodGet, objectURL, nil, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, false, fmt.Errorf("GET %s returned %s", objectURL, resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "can't read %s", objectURL)
+	}
+	return body, true, nil
+}
+
+func (c *httpCacher) exists(ctx context.Context, objectURL string) (bool, error) {
+	resp, err := c.do(ctx, http.MethodHead, objectURL, nil, 0)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return false, fmt.Errorf("HEAD %s returned %s", objectURL, resp.Status)
+	}
+	return true, nil
+}
+
+func (c *httpCacher) put(ctx context.Context, objectURL string, body io.Reader, size int64) error {
+	resp, err := c.do(ctx, http.MethodPut, objectURL, body, size)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("PUT %s returned %s", objectURL, resp.Status)
+	}
+	return nil
+}
+
+func (c *httpCacher) CreateCacheKey(ctx context.Context, req *plugins.CacheKeyRequest) (string, error) {
+	logger := ctx.Value("Logger").(hclog.Logger)
+	logger.Trace(fmt.Sprintf("Calculating cache key for %s", req.LocalDirectory))
+	memoKey := fmt.Sprintf("%s|%s|%s|%t", req.LocalDirectory, strings.Join(req.Includes, ","), strings.Join(req.Excludes, ","), req.RespectGitignore)
+	c.lock.Lock()
+	dirHash, ok := c.dirToHashKey[memoKey]
+	c.lock.Unlock()
+	if !ok {
+		var err error
+		dirHash, err = plugins.HashInputs(req)
+		if err != nil {
+			return "", errors.Wrap(err, "can't hash inputs")
+		}
+		c.lock.Lock()
+		c.dirToHashKey[memoKey] = dirHash
+		c.lock.Unlock()
+	}
+	return plugins.CacheKey(dirHash, req), nil
+}
+
+func (c *httpCacher) Cache(ctx context.Context, cacheKey, localCacheDir string, ch chan plugins.CacheItem) error {
+	logger := ctx.Value("Logger").(hclog.Logger)
+	if c.settings.readOnly {
+		logger.Debug("Cache is read only, not caching")
+		for range ch {
+		}
+		return nil
+	}
+	logs := &bytes.Buffer{}
+	manifest := []cachedArtifact{}
+	for item := range ch {
+		if item.LogItem != "" {
+			logs.WriteString(item.LogItem + "\n")
+		}
+		if item.ArtifactPath != "" {
+			artifact, err := c.uploadArtifact(ctx, cacheKey, item)
+			if err != nil {
+				return errors.Wrapf(err, "can't cache artifact %s", item.ArtifactPath)
+			}
+			manifest = append(manifest, artifact)
+		}
+	}
+	err := c.put(ctx, c.object(cacheKey, "cached.log"), bytes.NewReader(logs.Bytes()), int64(logs.Len()))
+	if err != nil {
+		return errors.Wrap(err, "can't upload logs")
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "can't encode artifact manifest")
+	}
+	err = c.put(ctx, c.object(cacheKey, manifestName), bytes.NewReader(manifestBytes), int64(len(manifestBytes)))
+	return errors.Wrap(err, "can't upload artifact manifest")
+}
+
+// uploadArtifact uploads the artifact named after the sha256 of its contents, unless it is already there
+func (c *httpCacher) uploadArtifact(ctx context.Context, cacheKey string, item plugins.CacheItem) (cachedArtifact, error) {
+	file, err := os.Open(item.ArtifactPath)
+	if err != nil {
+		return cachedArtifact{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return cachedArtifact{}, err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return cachedArtifact{}, err
+	}
+	artifact := cachedArtifact{
+		Name:   item.ArtifactName,
+		Sha256: fmt.Sprintf("%x", hasher.Sum([]byte{})),
+		Mode:   info.Mode().Perm(),
+	}
+	objectURL := c.object(cacheKey, "artifacts/"+artifact.Sha256)
+	exists, err := c.exists(ctx, objectURL)
+	if err != nil || exists {
+		return artifact, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return cachedArtifact{}, err
+	}
+	return artifact, c.put(ctx, objectURL, file, info.Size())
+}
+
+// downloadArtifact downloads the artifact into dir, reusing an earlier download of the same contents
+// downloadArtifacts downloads the artifacts of an entry into a new directory, named after their sha256
+func (c *httpCacher) downloadArtifacts(ctx context.Context, cacheKey string, localCache string, manifest []cachedArtifact) ([]plugins.CacheItem, error) {
+	parent := filepath.Join(localCache, ".http-cache")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, errors.Wrap(err, "can't create download directory")
+	}
+	downloadDir, err := os.MkdirTemp(parent, cacheKey+"-")
+	if err != nil {
+		return nil, errors.Wrap(err, "can't create download directory")
+	}
+	items := []plugins.CacheItem{}
+	for _, artifact := range manifest {
+		path, err := c.downloadArtifact(ctx, cacheKey, downloadDir, artifact)
+		if err != nil {
+			os.RemoveAll(downloadDir)
+			return nil, errors.Wrapf(err, "can't download artifact %s", artifact.Name)
+		}
+		items = append(items, plugins.CacheItem{
+			ArtifactPath: path,
+			ArtifactName: artifact.Name,
+		})
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.downloads[cacheKey] = append(c.downloads[cacheKey], downloadDir)
+	return items, nil
+}
+
+// ReleaseReplay removes the artifacts downloaded by the oldest replay of cacheKey
+func (c *httpCacher) ReleaseReplay(ctx context.Context, cacheKey string, localCache string) error {
+	c.lock.Lock()
+	dirs := c.downloads[cacheKey]
+	if len(dirs) == 0 {
+		c.lock.Unlock()
+		return nil
+	}
+	if len(dirs) == 1 {
+		delete(c.downloads, cacheKey)
+	} else {
+		c.downloads[cacheKey] = dirs[1:]
+	}
+	c.lock.Unlock()
+	return errors.Wrap(os.RemoveAll(dirs[0]), "can't remove downloaded artifacts")
+}
+
+func (c *httpCacher) downloadArtifact(ctx context.Context, cacheKey string, dir string, artifact cachedArtifact) (string, error) {
+	dest := filepath.Join(dir, artifact.Sha256)
+	if _, err := os.Stat(dest); err == nil {
+		return dest, os.Chmod(dest, artifact.Mode)
+	}
+	objectURL := c.object(cacheKey, "artifacts/"+artifact.Sha256)
+	resp, err := c.do(ctx, http.MethodGet, objectURL, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("GET %s returned %s", objectURL, resp.Status)
+	}
+	tmp, err := os.CreateTemp(dir, "download-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hasher), resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "can't download %s", objectURL)
+	}
+	if sum := fmt.Sprintf("%x", hasher.Sum([]byte{})); sum != artifact.Sha256 {
+		return "", fmt.Errorf("%s is corrupt, expected sha256 %s but got %s", objectURL, artifact.Sha256, sum)
+	}
+	if err := os.Chmod(tmp.Name(), artifact.Mode); err != nil {
+		return "", err
+	}
+	return dest, os.Rename(tmp.Name(), dest)
+}
+
+// Has only asks the server for the manifest, nothing is downloaded
+func (c *httpCacher) Has(ctx context.Context, cacheKey string, localCache string) (bool, error) {
+	return c.exists(ctx, c.object(cacheKey, manifestName))
+}
+
+func (c *httpCacher) ReplayCache(ctx context.Context, cacheKey string, localCache string) (chan plugins.CacheItem, bool, error) {
+	logger := ctx.Value("Logger").(hclog.Logger)
+	ch := make(chan plugins.CacheItem)
+	manifestBytes, found, err := c.get(ctx, c.object(cacheKey, manifestName))
+	if err != nil || !found {
+		logger.Debug(fmt.Sprintf("Cache key %s not found (err = %v)", cacheKey, err))
+		close(ch)
+		return ch, false, err
+	}
+	manifest := []cachedArtifact{}
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		close(ch)
+		return ch, false, errors.Wrap(err, "can't decode artifact manifest")
+	}
+	logs, found, err := c.get(ctx, c.object(cacheKey, "cached.log"))
+	if err != nil || !found {
+		close(ch)
+		return ch, false, err
+	}
+	// Artifacts are downloaded up front so a failed download is a miss instead of a partial restore. They
+	// only have to live until harbor restored them, ReleaseReplay removes them. A peek only needs the names.
+	items := []plugins.CacheItem{}
+	if plugins.IsPeek(ctx) {
+		for _, artifact := range manifest {
+			items = append(items, plugins.CacheItem{ArtifactName: artifact.Name})
+		}
+	} else if len(manifest) > 0 {
+		items, err = c.downloadArtifacts(ctx, cacheKey, localCache, manifest)
+		if err != nil {
+			close(ch)
+			return ch, false, err
+		}
+	}
+	go func() {
+		defer close(ch)
+		lineReader := bufio.NewScanner(bytes.NewReader(logs))
+		for lineReader.Scan() {
+			ch <- plugins.CacheItem{
+				LogItem: lineReader.Text(),
+			}
+		}
+		for _, item := range items {
+			ch <- item
+		}
+	}()
+	return ch, true, nil
+}
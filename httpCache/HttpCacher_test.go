@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStore is an object store like the servers the cache talks to, it answers with status for every request
+// when set
+type fakeStore struct {
+	lock     sync.Mutex
+	objects  map[string][]byte
+	requests []string
+	headers  []http.Header
+	status   int
+}
+
+func newFakeStore(t *testing.T) (*fakeStore, *httptest.Server) {
+	store := &fakeStore{objects: map[string][]byte{}}
+	server := httptest.NewServer(store)
+	t.Cleanup(server.Close)
+	return store, server
+}
+
+func (f *fakeStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	f.headers = append(f.headers, r.Header.Clone())
+	if f.status != 0 {
+		w.WriteHeader(f.status)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		f.objects[r.URL.Path] = body
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodGet, http.MethodHead:
+		body, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(body)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeStore) methods(method string) []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	res := []string{}
+	for _, req := range f.requests {
+		if strings.HasPrefix(req, method+" ") {
+			res = append(res, req)
+		}
+	}
+	return res
+}
+
+func testContext() context.Context {
+	return context.WithValue(context.Background(), "Logger", hclog.NewNullLogger())
+}
+
+func configuredCacher(t *testing.T, settings map[string]interface{}) *httpCacher {
+	c := newCacher().(*httpCacher)
+	assert.NoError(t, c.Configure(testContext(), settings))
+	return c
+}
+
+func cache(c *httpCacher, cacheKey string, items ...plugins.CacheItem) error {
+	ch := make(chan plugins.CacheItem, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	return c.Cache(testContext(), cacheKey, "", ch)
+}
+
+func replay(t *testing.T, c *httpCacher, cacheKey string, localCache string) ([]plugins.CacheItem, bool, error) {
+	ch, hit, err := c.ReplayCache(testContext(), cacheKey, localCache)
+	items := []plugins.CacheItem{}
+	for item := range ch {
+		items = append(items, item)
+	}
+	return items, hit, err
+}
+
+func TestConfigure(t *testing.T) {
+	c := newCacher().(*httpCacher)
+	assert.ErrorContains(t, c.Configure(testContext(), map[string]interface{}{}), "needs a url")
+	assert.ErrorContains(t, c.Configure(testContext(), map[string]interface{}{"url": "ftp://cache"}), "must be http or https")
+	assert.ErrorContains(t, c.Configure(testContext(), map[string]interface{}{"url": "http://cache", "timeout": "soon"}), "invalid timeout")
+
+	_, _, err := newCacher().(*httpCacher).ReplayCache(testContext(), "key", "")
+	assert.ErrorContains(t, err, "not configured")
+}
+
+func TestEntriesRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	store, server := newFakeStore(t)
+	c := configuredCacher(t, map[string]interface{}{"url": server.URL + "/cache/"})
+
+	_, hit, err := replay(t, c, "key", t.TempDir())
+	assert.NoError(err)
+	assert.False(hit)
+	has, err := c.Has(testContext(), "key", "")
+	assert.NoError(err)
+	assert.False(has)
+
+	pkgDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(pkgDir, "plugin"), []byte("binary"), 0750))
+	assert.NoError(cache(c, "key",
+		plugins.CacheItem{LogItem: "line one"},
+		plugins.CacheItem{LogItem: "line two"},
+		plugins.CacheItem{ArtifactPath: filepath.Join(pkgDir, "plugin"), ArtifactName: "bin/plugin"},
+	))
+	assert.Equal("line one\nline two\n", string(store.objects["/cache/key/cached.log"]))
+	assert.Contains(store.objects, "/cache/key/"+manifestName)
+	assert.Len(store.methods(http.MethodPut), 3)
+
+	has, err = c.Has(testContext(), "key", "")
+	assert.NoError(err)
+	assert.True(has)
+	assert.Equal([]string{"HEAD /cache/key/" + manifestName}, store.methods(http.MethodHead)[2:],
+		"Has only asks for the manifest")
+
+	localCache := t.TempDir()
+	items, hit, err := replay(t, c, "key", localCache)
+	assert.NoError(err)
+	assert.True(hit)
+	assert.Len(items, 3)
+	assert.Equal("line one", items[0].LogItem)
+	assert.Equal("line two", items[1].LogItem)
+	assert.Equal("bin/plugin", items[2].ArtifactName)
+	assert.True(strings.HasPrefix(items[2].ArtifactPath, filepath.Join(localCache, ".http-cache", "key-")))
+	contents, err := os.ReadFile(items[2].ArtifactPath)
+	assert.NoError(err)
+	assert.Equal("binary", string(contents))
+	info, err := os.Stat(items[2].ArtifactPath)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0750), info.Mode().Perm())
+
+	// Peeking doesn't download anything
+	gets := len(store.methods(http.MethodGet))
+	ch, hit, err := c.ReplayCache(plugins.WithPeek(testContext()), "key", localCache)
+	assert.NoError(err)
+	assert.True(hit)
+	peeked := []plugins.CacheItem{}
+	for item := range ch {
+		peeked = append(peeked, item)
+	}
+	assert.Equal(plugins.CacheItem{ArtifactName: "bin/plugin"}, peeked[2])
+	assert.Len(store.methods(http.MethodGet), gets+2, "only the manifest and logs are read")
+
+	// Downloads only live until harbor restored them
+	assert.NoError(c.ReleaseReplay(testContext(), "key", localCache))
+	assert.NoFileExists(items[2].ArtifactPath)
+	downloads, err := os.ReadDir(filepath.Join(localCache, ".http-cache"))
+	assert.NoError(err)
+	assert.Empty(downloads)
+	assert.NoError(c.ReleaseReplay(testContext(), "key", localCache), "releasing twice is harmless")
+
+	// Artifacts that are already uploaded aren't uploaded again
+	assert.NoError(cache(c, "other", plugins.CacheItem{ArtifactPath: filepath.Join(pkgDir, "plugin"), ArtifactName: "plugin"}))
+	assert.Len(store.methods(http.MethodPut), 6)
+	assert.NoError(cache(c, "other", plugins.CacheItem{ArtifactPath: filepath.Join(pkgDir, "plugin"), ArtifactName: "plugin"}))
+	assert.Len(store.methods(http.MethodPut), 8)
+}
+
+func TestCorruptArtifactsAreAMiss(t *testing.T) {
+	assert := assert.New(t)
+	store, server := newFakeStore(t)
+	c := configuredCacher(t, map[string]interface{}{"url": server.URL})
+	pkgDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(pkgDir, "out"), []byte("built"), 0644))
+	assert.NoError(cache(c, "key", plugins.CacheItem{ArtifactPath: filepath.Join(pkgDir, "out"), ArtifactName: "out"}))
+	for path := range store.objects {
+		if strings.Contains(path, "/artifacts/") {
+			store.objects[path] = []byte("tampered")
+		}
+	}
+
+	localCache := t.TempDir()
+	_, hit, err := replay(t, c, "key", localCache)
+	assert.ErrorContains(err, "is corrupt")
+	assert.False(hit)
+	downloads, err := os.ReadDir(filepath.Join(localCache, ".http-cache"))
+	assert.NoError(err)
+	assert.Empty(downloads, "failed downloads are removed")
+}
+
+func TestAuthHeaders(t *testing.T) {
+	basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("harbor:secret"))
+	for _, tc := range []struct {
+		name     string
+		settings map[string]interface{}
+		header   string
+		value    string
+	}{
+		{"bearer", map[string]interface{}{"auth_token": "Bearer $HARBOR_CACHE_TOKEN"}, "Authorization", "Bearer token"},
+		{"basic", map[string]interface{}{"auth_token": basic}, "Authorization", basic},
+		{"custom header", map[string]interface{}{"auth_header": "X-Cache-Token", "auth_token": "token"}, "X-Cache-Token", "token"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			assert := assert.New(t)
+			t.Setenv("HARBOR_CACHE_TOKEN", "token")
+			store, server := newFakeStore(t)
+			tc.settings["url"] = server.URL
+			c := configuredCacher(t, tc.settings)
+
+			assert.NoError(cache(c, "key", plugins.CacheItem{LogItem: "line"}))
+			_, hit, err := replay(t, c, "key", t.TempDir())
+			assert.NoError(err)
+			assert.True(hit)
+			_, err = c.Has(testContext(), "key", "")
+			assert.NoError(err)
+			assert.NotEmpty(store.headers)
+			for i, headers := range store.headers {
+				assert.Equal(tc.value, headers.Get(tc.header), store.requests[i])
+			}
+		})
+	}
+}
+
+func TestReadOnlyCachesNeverWrite(t *testing.T) {
+	assert := assert.New(t)
+	store, server := newFakeStore(t)
+	c := configuredCacher(t, map[string]interface{}{"url": server.URL, "read_only": true})
+	pkgDir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(pkgDir, "out"), []byte("built"), 0644))
+
+	assert.NoError(cache(c, "key",
+		plugins.CacheItem{LogItem: "line"},
+		plugins.CacheItem{ArtifactPath: filepath.Join(pkgDir, "out"), ArtifactName: "out"},
+	))
+	assert.Empty(store.requests)
+}
+
+func TestErrorResponsesAreErrors(t *testing.T) {
+	assert := assert.New(t)
+	store, server := newFakeStore(t)
+	c := configuredCacher(t, map[string]interface{}{"url": server.URL})
+	store.status = http.StatusInternalServerError
+
+	_, hit, err := replay(t, c, "key", t.TempDir())
+	assert.ErrorContains(err, "500")
+	assert.False(hit)
+	_, err = c.Has(testContext(), "key", "")
+	assert.ErrorContains(err, "500")
+	assert.ErrorContains(cache(c, "key", plugins.CacheItem{LogItem: "line"}), "500")
+
+	store.status = http.StatusForbidden
+	assert.ErrorContains(cache(c, "key", plugins.CacheItem{LogItem: "line"}), "403")
+}
+
+func TestCacheKeysAreCalculatedConcurrently(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.NoError(os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main"), 0644))
+	c := newCacher()
+	keys := make([]string, 8)
+	wg := sync.WaitGroup{}
+	for i := range keys {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key, err := c.CreateCacheKey(testContext(), &plugins.CacheKeyRequest{LocalDirectory: dir})
+			assert.NoError(err)
+			keys[i] = key
+		}(i)
+	}
+	wg.Wait()
+	for _, key := range keys {
+		assert.Equal(keys[0], key)
+	}
+}
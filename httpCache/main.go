@@ -0,0 +1,28 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	plugins "github.com/radding/harbor-plugins"
+)
+
+func main() {
+	logOut, err := os.Create("./plugin.log")
+	if err != nil {
+		panic(err)
+	}
+	log.SetOutput(logOut)
+	log.Println("Starting plugin")
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("plugin panicked: %s\n", err)
+		}
+		log.Println("plugin is exiting!")
+		logOut.Close()
+	}()
+	plugins.NewPlugin("http_cache").
+		WithCacheProvider(newCacher()).
+		ServePlugin()
+	log.Println("Done serving, exiting")
+}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/pkg/errors"
@@ -17,7 +21,9 @@ import (
 )
 
 type localCacher struct {
+	// dirToHashKey memoizes the hash of the inputs, keys are calculated concurrently so it is guarded by lock
 	dirToHashKey map[string]string
+	lock         *sync.Mutex
 	fileOpener   opener
 }
 
@@ -26,80 +32,177 @@ type opener func(fileName string) (io.ReadCloser, error)
 func newCacher(f opener) plugins.CacheProvider {
 	return &localCacher{
 		dirToHashKey: map[string]string{},
+		lock:         &sync.Mutex{},
 		fileOpener:   f,
 	}
 }
 
-func (c *localCacher) CreateCacheKey(ctx context.Context, dir string, dependencyKeys []string, additionalData []string) (string, error) {
+// inputsKey identifies the set of files selected by a request, so the hash of that set can be reused
+func inputsKey(req *plugins.CacheKeyRequest) string {
+	return fmt.Sprintf("%s|%s|%s|%t", req.LocalDirectory, strings.Join(req.Includes, ","), strings.Join(req.Excludes, ","), req.RespectGitignore)
+}
+
+func (c *localCacher) CreateCacheKey(ctx context.Context, req *plugins.CacheKeyRequest) (string, error) {
 	logger := ctx.Value("Logger").(hclog.Logger)
+	dir := req.LocalDirectory
 	logger.Trace(fmt.Sprintf("Calculating cache key for %s", dir))
-	dirHash, ok := c.dirToHashKey[dir]
+	c.lock.Lock()
+	dirHash, ok := c.dirToHashKey[inputsKey(req)]
+	c.lock.Unlock()
 	if !ok {
-		hasher := md5.New()
-		files := []string{}
-		err := filepath.Walk(dir, func(path string, info fs.FileInfo, err error) error {
-			if info.IsDir() {
-				return nil
-			}
-			files = append(files, path)
-			return nil
-		})
+		var err error
+		dirHash, err = plugins.HashInputs(req)
 		if err != nil {
-			return "", errors.Wrap(err, "can't walk directory")
-		}
-		sort.Strings(files)
-		for _, i := range files {
-			file, err := c.fileOpener(i)
-			if err != nil {
-				return "", errors.Wrapf(err, "can't open file %s", i)
-			}
-			defer file.Close()
-			io.Copy(hasher, file)
+			return "", errors.Wrap(err, "can't hash inputs")
 		}
-		dirHash = fmt.Sprintf("%x", hasher.Sum([]byte{}))
-		c.dirToHashKey[dir] = dirHash
-	}
-	hasher := md5.New()
-	hasher.Write([]byte(dirHash))
-	for _, key := range dependencyKeys {
-		hasher.Write([]byte(key))
-	}
-	for _, key := range additionalData {
-		hasher.Write([]byte(key))
+		c.lock.Lock()
+		c.dirToHashKey[inputsKey(req)] = dirHash
+		c.lock.Unlock()
 	}
-	// get the cache key of all children
-	hashKey := fmt.Sprintf("%x", hasher.Sum([]byte{}))
-	return hashKey, nil
+	return plugins.CacheKey(dirHash, req), nil
+}
+
+// cachedArtifact is an entry of the artifact manifest of a cache entry, the contents of the artifact are
+// stored under artifacts/<Sha256> in the entry
+type cachedArtifact struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256"`
+}
+
+const manifestName = "artifacts.json"
+
+// entryMetadata describes the step an entry was cached for
+type entryMetadata struct {
+	PackageName string    `json:"package"`
+	CommandName string    `json:"command"`
+	CreatedAt   time.Time `json:"created_at"`
 }
 
+const metadataName = "metadata.json"
+
 func (c *localCacher) Cache(ctx context.Context, cacheKey, localCacheDir string, ch chan plugins.CacheItem) error {
 	logger := ctx.Value("Logger").(hclog.Logger)
 	logger.Trace("Beginning caching")
-	os.MkdirAll(filepath.Join(localCacheDir, cacheKey), 0755)
-	logPath := filepath.Join(localCacheDir, cacheKey, "cached.log")
+	err := os.MkdirAll(localCacheDir, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "can't create cache directory %s", localCacheDir)
+	}
+	// Build the entry next to the real one and move it in place when it is complete, so a failed or
+	// concurrent write never leaves a half cached entry behind
+	tmpDir, err := os.MkdirTemp(localCacheDir, fmt.Sprintf(".%s-", cacheKey))
+	if err != nil {
+		return errors.Wrap(err, "can't create temporary cache entry")
+	}
+	defer os.RemoveAll(tmpDir)
+	artifactDir := filepath.Join(tmpDir, "artifacts")
+	if err := os.MkdirAll(artifactDir, 0755); err != nil {
+		return errors.Wrap(err, "can't create artifact directory")
+	}
+	logPath := filepath.Join(tmpDir, "cached.log")
 	logger.Debug(fmt.Sprintf("Adding cache file at %s", logPath))
 	logFi, err := os.OpenFile(logPath, os.O_TRUNC|os.O_WRONLY|os.O_CREATE, 0755)
 	if err != nil {
 		return errors.Wrapf(err, "umable to get log file at %s", logPath)
 	}
+	defer logFi.Close()
+	manifest := []cachedArtifact{}
 	for item := range ch {
 		if item.LogItem != "" {
-			_, err := logFi.WriteString(item.LogItem)
+			_, err := logFi.WriteString(item.LogItem + "\n")
 			if err != nil {
 				return errors.Wrap(err, "can't save log item")
 			}
 		}
 		if item.ArtifactPath != "" {
-			logger.Debug(fmt.Sprintf("Copying artifact to local cache"))
+			logger.Debug(fmt.Sprintf("Copying artifact %s to local cache", item.ArtifactPath))
+			sum, err := c.storeArtifact(artifactDir, item.ArtifactPath)
+			if err != nil {
+				return errors.Wrapf(err, "can't cache artifact %s", item.ArtifactPath)
+			}
+			manifest = append(manifest, cachedArtifact{
+				Name:   item.ArtifactName,
+				Sha256: sum,
+			})
 		}
 	}
-	return nil
+	if err := logFi.Close(); err != nil {
+		return errors.Wrap(err, "can't save log file")
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "can't encode artifact manifest")
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, manifestName), manifestBytes, 0644); err != nil {
+		return errors.Wrap(err, "can't write artifact manifest")
+	}
+	metadata := plugins.GetCacheMetadata(ctx)
+	metadataBytes, err := json.Marshal(entryMetadata{
+		PackageName: metadata.PackageName,
+		CommandName: metadata.CommandName,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't encode entry metadata")
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, metadataName), metadataBytes, 0644); err != nil {
+		return errors.Wrap(err, "can't write entry metadata")
+	}
+	entryDir := filepath.Join(localCacheDir, cacheKey)
+	if err := os.RemoveAll(entryDir); err != nil {
+		return errors.Wrapf(err, "can't replace cache entry %s", entryDir)
+	}
+	return errors.Wrap(os.Rename(tmpDir, entryDir), "can't save cache entry")
+}
+
+// storeArtifact copies the file at path into dir, named after the sha256 of its contents and keeping its
+// permissions. Returns the sha256.
+func (c *localCacher) storeArtifact(dir string, path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	src, err := c.fileOpener(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(dir, "blob-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(dst.Name())
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, hasher), src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(dst.Name(), info.Mode().Perm()); err != nil {
+		return "", err
+	}
+	sum := fmt.Sprintf("%x", hasher.Sum([]byte{}))
+	return sum, os.Rename(dst.Name(), filepath.Join(dir, sum))
+}
+
+func readManifest(entryDir string) ([]cachedArtifact, error) {
+	manifestBytes, err := os.ReadFile(filepath.Join(entryDir, manifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		// Entries cached before artifacts were supported only have logs
+		return []cachedArtifact{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	manifest := []cachedArtifact{}
+	return manifest, json.Unmarshal(manifestBytes, &manifest)
 }
 
 func (c *localCacher) ReplayCache(ctx context.Context, cacheKey string, localCache string) (chan plugins.CacheItem, bool, error) {
 	logger := ctx.Value("Logger").(hclog.Logger)
 	ch := make(chan plugins.CacheItem)
-	fiPath := filepath.Join(localCache, cacheKey, "cached.log")
+	entryDir := filepath.Join(localCache, cacheKey)
+	fiPath := filepath.Join(entryDir, "cached.log")
 	openFile, err := os.Open(fiPath)
 	logger.Debug(fmt.Sprintf("Got Path for cache key %s: %s", cacheKey, fiPath))
 	if errors.Is(err, os.ErrNotExist) {
@@ -111,8 +214,22 @@ func (c *localCacher) ReplayCache(ctx context.Context, cacheKey string, localCac
 		logger.Debug(fmt.Sprintf("Failed to read cache: %s", err))
 		return ch, false, errors.Wrap(err, "failed to open cache file")
 	}
+	manifest, err := readManifest(entryDir)
+	if err != nil {
+		openFile.Close()
+		close(ch)
+		return ch, false, errors.Wrap(err, "failed to read artifact manifest")
+	}
+	// The modification time of the log is when the entry was last used, prune evicts by it
+	if !plugins.IsPeek(ctx) {
+		now := time.Now()
+		if err := os.Chtimes(fiPath, now, now); err != nil {
+			logger.Debug(fmt.Sprintf("Failed to mark %s as used: %s", cacheKey, err))
+		}
+	}
 	go func() {
 		defer close(ch)
+		defer openFile.Close()
 		lineReader := bufio.NewScanner(openFile)
 		for lineReader.Scan() {
 			logLine := lineReader.Text()
@@ -120,6 +237,131 @@ func (c *localCacher) ReplayCache(ctx context.Context, cacheKey string, localCac
 				LogItem: logLine,
 			}
 		}
+		for _, artifact := range manifest {
+			ch <- plugins.CacheItem{
+				ArtifactPath: filepath.Join(entryDir, "artifacts", artifact.Sha256),
+				ArtifactName: artifact.Name,
+			}
+		}
 	}()
 	return ch, true, nil
 }
+
+// Has only looks for the entry, unlike ReplayCache it doesn't mark it as used
+func (c *localCacher) Has(ctx context.Context, cacheKey string, localCache string) (bool, error) {
+	_, err := os.Stat(filepath.Join(localCache, cacheKey, "cached.log"))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, errors.Wrap(err, "can't check cache entry")
+}
+
+// entrySize is the size of every file in the entry
+func entrySize(entryDir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(entryDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+func (c *localCacher) describe(localCacheDir string, cacheKey string) (*plugins.CacheEntry, error) {
+	entryDir := filepath.Join(localCacheDir, cacheKey)
+	logInfo, err := os.Stat(filepath.Join(entryDir, "cached.log"))
+	if err != nil {
+		return nil, err
+	}
+	entry := &plugins.CacheEntry{
+		CacheKey:   cacheKey,
+		CreatedAt:  logInfo.ModTime().Unix(),
+		LastUsedAt: logInfo.ModTime().Unix(),
+	}
+	metadataBytes, err := os.ReadFile(filepath.Join(entryDir, metadataName))
+	if err == nil {
+		metadata := entryMetadata{}
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			return nil, errors.Wrap(err, "can't decode entry metadata")
+		}
+		entry.PackageName = metadata.PackageName
+		entry.CommandName = metadata.CommandName
+		entry.CreatedAt = metadata.CreatedAt.Unix()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, errors.Wrap(err, "can't read entry metadata")
+	}
+	manifest, err := readManifest(entryDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't read artifact manifest")
+	}
+	for _, artifact := range manifest {
+		entry.ArtifactNames = append(entry.ArtifactNames, artifact.Name)
+	}
+	entry.SizeBytes, err = entrySize(entryDir)
+	return entry, err
+}
+
+func (c *localCacher) List(ctx context.Context, localCacheDir string) ([]*plugins.CacheEntry, error) {
+	logger := ctx.Value("Logger").(hclog.Logger)
+	dirs, err := os.ReadDir(localCacheDir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []*plugins.CacheEntry{}, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "can't read cache directory %s", localCacheDir)
+	}
+	entries := []*plugins.CacheEntry{}
+	for _, dir := range dirs {
+		// Hidden directories are entries still being written
+		if !dir.IsDir() || strings.HasPrefix(dir.Name(), ".") {
+			continue
+		}
+		entry, err := c.describe(localCacheDir, dir.Name())
+		if err != nil {
+			logger.Debug(fmt.Sprintf("Skipping %s, it is not a cache entry: %s", dir.Name(), err))
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (c *localCacher) Prune(ctx context.Context, req *plugins.PruneRequest) (*plugins.PruneResponse, error) {
+	entries, err := c.List(ctx, req.LocalCacheDirectory)
+	if err != nil {
+		return nil, err
+	}
+	// Least recently used first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsedAt < entries[j].LastUsedAt
+	})
+	var total int64
+	for _, entry := range entries {
+		total += entry.SizeBytes
+	}
+	resp := &plugins.PruneResponse{RemovedKeys: []string{}}
+	cutoff := time.Now().Unix() - req.OlderThanSeconds
+	for _, entry := range entries {
+		remove := req.All ||
+			(req.OlderThanSeconds > 0 && entry.LastUsedAt < cutoff) ||
+			(req.MaxSizeBytes > 0 && total > req.MaxSizeBytes)
+		if !remove {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(req.LocalCacheDirectory, entry.CacheKey)); err != nil {
+			return resp, errors.Wrapf(err, "can't remove %s", entry.CacheKey)
+		}
+		total -= entry.SizeBytes
+		resp.FreedBytes += entry.SizeBytes
+		resp.RemovedKeys = append(resp.RemovedKeys, entry.CacheKey)
+	}
+	return resp, nil
+}
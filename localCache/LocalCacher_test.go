@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	plugins "github.com/radding/harbor-plugins"
+	"github.com/stretchr/testify/assert"
+)
+
+func testContext() context.Context {
+	return context.WithValue(context.Background(), "Logger", hclog.NewNullLogger())
+}
+
+func cache(c plugins.CacheProvider, cacheDir, cacheKey string, items ...plugins.CacheItem) error {
+	ch := make(chan plugins.CacheItem, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	return c.Cache(testContext(), cacheKey, cacheDir, ch)
+}
+
+func replay(c plugins.CacheProvider, cacheDir, cacheKey string) ([]plugins.CacheItem, bool, error) {
+	ch, hit, err := c.ReplayCache(testContext(), cacheKey, cacheDir)
+	items := []plugins.CacheItem{}
+	for item := range ch {
+		items = append(items, item)
+	}
+	return items, hit, err
+}
+
+// lastUsed is when the entry was last replayed, prune goes by it
+func lastUsed(t *testing.T, cacheDir, cacheKey string) time.Time {
+	info, err := os.Stat(filepath.Join(cacheDir, cacheKey, "cached.log"))
+	assert.NoError(t, err)
+	return info.ModTime()
+}
+
+func setLastUsed(t *testing.T, cacheDir, cacheKey string, when time.Time) {
+	assert.NoError(t, os.Chtimes(filepath.Join(cacheDir, cacheKey, "cached.log"), when, when))
+}
+
+func TestArtifactsRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	cacheDir, pkgDir := t.TempDir(), t.TempDir()
+	assert.NoError(os.MkdirAll(filepath.Join(pkgDir, "bin"), 0755))
+	assert.NoError(os.WriteFile(filepath.Join(pkgDir, "bin", "tool"), []byte("binary"), 0750))
+	assert.NoError(os.WriteFile(filepath.Join(pkgDir, "copy"), []byte("binary"), 0750))
+	c := newCacher(openFile)
+
+	assert.NoError(cache(c, cacheDir, "key",
+		plugins.CacheItem{LogItem: "line one"},
+		plugins.CacheItem{LogItem: "line two"},
+		plugins.CacheItem{ArtifactPath: filepath.Join(pkgDir, "bin", "tool"), ArtifactName: "bin/tool"},
+		plugins.CacheItem{ArtifactPath: filepath.Join(pkgDir, "copy"), ArtifactName: "copy"},
+	))
+	blobs, err := os.ReadDir(filepath.Join(cacheDir, "key", "artifacts"))
+	assert.NoError(err)
+	assert.Len(blobs, 1, "artifacts with the same contents are stored once")
+	assert.FileExists(filepath.Join(cacheDir, "key", manifestName))
+	hidden, err := filepath.Glob(filepath.Join(cacheDir, ".*"))
+	assert.NoError(err)
+	assert.Empty(hidden, "the temporary entry is moved in place")
+
+	// Restore into a clean package, like a fresh checkout would be
+	assert.NoError(os.RemoveAll(pkgDir))
+	items, hit, err := replay(c, cacheDir, "key")
+	assert.NoError(err)
+	assert.True(hit)
+	assert.Len(items, 4)
+	assert.Equal("line one", items[0].LogItem)
+	assert.Equal("line two", items[1].LogItem)
+	restoreDir := t.TempDir()
+	for _, item := range items[2:] {
+		contents, err := os.ReadFile(item.ArtifactPath)
+		assert.NoError(err)
+		dest := filepath.Join(restoreDir, filepath.FromSlash(item.ArtifactName))
+		assert.NoError(os.MkdirAll(filepath.Dir(dest), 0755))
+		assert.NoError(os.WriteFile(dest, contents, 0644))
+	}
+	contents, err := os.ReadFile(filepath.Join(restoreDir, "bin", "tool"))
+	assert.NoError(err)
+	assert.Equal("binary", string(contents))
+	assert.FileExists(filepath.Join(restoreDir, "copy"))
+	info, err := os.Stat(items[2].ArtifactPath)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0750), info.Mode().Perm(), "artifacts keep their permissions")
+
+	_, hit, err = replay(c, cacheDir, "missing")
+	assert.NoError(err)
+	assert.False(hit)
+}
+
+func TestFailedWritesLeaveNoEntry(t *testing.T) {
+	assert := assert.New(t)
+	cacheDir := t.TempDir()
+	c := newCacher(openFile)
+
+	err := cache(c, cacheDir, "key",
+		plugins.CacheItem{LogItem: "line"},
+		plugins.CacheItem{ArtifactPath: filepath.Join(t.TempDir(), "missing"), ArtifactName: "missing"},
+	)
+	assert.Error(err)
+	entries, err := os.ReadDir(cacheDir)
+	assert.NoError(err)
+	assert.Empty(entries)
+}
+
+func TestManifests(t *testing.T) {
+	assert := assert.New(t)
+	cacheDir := t.TempDir()
+	c := newCacher(openFile)
+	assert.NoError(cache(c, cacheDir, "legacy", plugins.CacheItem{LogItem: "line"}))
+	assert.NoError(cache(c, cacheDir, "corrupt", plugins.CacheItem{LogItem: "line"}))
+
+	// Entries cached before artifacts were supported have no manifest, they only replay logs
+	assert.NoError(os.Remove(filepath.Join(cacheDir, "legacy", manifestName)))
+	items, hit, err := replay(c, cacheDir, "legacy")
+	assert.NoError(err)
+	assert.True(hit)
+	assert.Equal([]plugins.CacheItem{{LogItem: "line"}}, items)
+
+	assert.NoError(os.WriteFile(filepath.Join(cacheDir, "corrupt", manifestName), []byte("{not json"), 0644))
+	_, hit, err = replay(c, cacheDir, "corrupt")
+	assert.ErrorContains(err, "artifact manifest")
+	assert.False(hit)
+
+	entries, err := c.(plugins.CacheManager).List(testContext(), cacheDir)
+	assert.NoError(err)
+	assert.Len(entries, 1, "corrupt entries aren't listed")
+	assert.Equal("legacy", entries[0].CacheKey)
+}
+
+func TestHasAndPeekDoNotMarkEntriesAsUsed(t *testing.T) {
+	assert := assert.New(t)
+	cacheDir := t.TempDir()
+	c := newCacher(openFile)
+	assert.NoError(cache(c, cacheDir, "key", plugins.CacheItem{LogItem: "line"}))
+	long := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	setLastUsed(t, cacheDir, "key", long)
+
+	has, err := c.(plugins.CacheProber).Has(testContext(), "key", cacheDir)
+	assert.NoError(err)
+	assert.True(has)
+	assert.Equal(long, lastUsed(t, cacheDir, "key"))
+	has, err = c.(plugins.CacheProber).Has(testContext(), "missing", cacheDir)
+	assert.NoError(err)
+	assert.False(has)
+
+	ch, hit, err := c.ReplayCache(plugins.WithPeek(testContext()), "key", cacheDir)
+	assert.NoError(err)
+	assert.True(hit)
+	for range ch {
+	}
+	assert.Equal(long, lastUsed(t, cacheDir, "key"), "peeking doesn't mark the entry as used")
+
+	_, _, err = replay(c, cacheDir, "key")
+	assert.NoError(err)
+	assert.True(lastUsed(t, cacheDir, "key").After(long), "replaying marks the entry as used")
+}
+
+func TestPruneRemovesLeastRecentlyUsedFirst(t *testing.T) {
+	assert := assert.New(t)
+	cacheDir := t.TempDir()
+	c := newCacher(openFile)
+	now := time.Now()
+	for key, age := range map[string]time.Duration{"newest": time.Hour, "middle": 2 * time.Hour, "oldest": 3 * time.Hour} {
+		assert.NoError(cache(c, cacheDir, key, plugins.CacheItem{LogItem: strings.Repeat("x", 99)}))
+		setLastUsed(t, cacheDir, key, now.Add(-age))
+	}
+	assert.NoError(os.MkdirAll(filepath.Join(cacheDir, ".being-written"), 0755))
+	manager := c.(plugins.CacheManager)
+	entries, err := manager.List(testContext(), cacheDir)
+	assert.NoError(err)
+	assert.Len(entries, 3, "entries still being written aren't listed")
+	sizes := map[string]int64{}
+	for _, entry := range entries {
+		sizes[entry.CacheKey] = entry.SizeBytes
+	}
+
+	resp, err := manager.Prune(testContext(), &plugins.PruneRequest{LocalCacheDirectory: cacheDir, MaxSizeBytes: sizes["newest"] + sizes["middle"]})
+	assert.NoError(err)
+	assert.Equal([]string{"oldest"}, resp.RemovedKeys)
+	assert.Equal(sizes["oldest"], resp.FreedBytes)
+
+	resp, err = manager.Prune(testContext(), &plugins.PruneRequest{LocalCacheDirectory: cacheDir, OlderThanSeconds: int64((90 * time.Minute).Seconds())})
+	assert.NoError(err)
+	assert.Equal([]string{"middle"}, resp.RemovedKeys)
+
+	resp, err = manager.Prune(testContext(), &plugins.PruneRequest{LocalCacheDirectory: cacheDir, All: true})
+	assert.NoError(err)
+	assert.Equal([]string{"newest"}, resp.RemovedKeys)
+	assert.NoDirExists(filepath.Join(cacheDir, "newest"))
+}
@@ -2,36 +2,189 @@ package plugins
 
 import (
 	"context"
+	"crypto/md5"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
 
 	"github.com/pkg/errors"
 	"github.com/radding/harbor-plugins/proto"
 	"github.com/rs/zerolog/log"
 )
 
+// CacheKeyRequest describes what a cache key is calculated from. Providers should hash the files
+// returned by CollectInputFiles so every provider agrees on the inputs of a step.
+type CacheKeyRequest proto.CacheKeyRequest
+
 // CacheProvider provides the ability to cache logs and artifacts for harbor
 type CacheProvider interface {
-	// CreateCacheKey Provides the ability to calculate the cache key
-	CreateCacheKey(context.Context, string, []string, []string) (string, error)
+	// CreateCacheKey Provides the ability to calculate the cache key. Keys must be plugins.CacheKey of
+	// plugins.HashInputs of the request: when several caches are configured only the first one calculates
+	// the key, and it is used to look up and store entries in all of them.
+	CreateCacheKey(context.Context, *CacheKeyRequest) (string, error)
 	Cache(context.Context, string, string, chan CacheItem) error
 	ReplayCache(context.Context, string, string) (chan CacheItem, bool, error)
 }
 
-func (p *pluginClient) GetCacheKey(path string, dependencyKeys []string, additionalData []string) (string, error) {
-	req := proto.CacheKeyRequest{
-		LocalDirectory:     path,
-		DependantCacheKeys: dependencyKeys,
-		AdditionalData:     additionalData,
+// CacheMetadata describes the step a cache entry belongs to
+type CacheMetadata struct {
+	PackageName string
+	CommandName string
+}
+
+type cacheMetadataKey struct{}
+
+// GetCacheMetadata returns the metadata of the entry being cached from the context passed to
+// CacheProvider.Cache
+func GetCacheMetadata(ctx context.Context) CacheMetadata {
+	metadata, _ := ctx.Value(cacheMetadataKey{}).(CacheMetadata)
+	return metadata
+}
+
+type replayPeekKey struct{}
+
+// IsPeek tells CacheProvider.ReplayCache that the entry is only being looked at, like by harbor cache show.
+// A peek must not mark the entry as used, and its artifacts only need a name, not a path.
+func IsPeek(ctx context.Context) bool {
+	peek, _ := ctx.Value(replayPeekKey{}).(bool)
+	return peek
+}
+
+// WithPeek marks a replay as a peek, see IsPeek
+func WithPeek(ctx context.Context) context.Context {
+	return context.WithValue(ctx, replayPeekKey{}, true)
+}
+
+type CacheEntry proto.CacheEntry
+type PruneRequest proto.PruneRequest
+type PruneResponse proto.PruneResponse
+
+// CacheManager is implemented by cache providers that can list and remove their entries
+type CacheManager interface {
+	List(ctx context.Context, localCacheDir string) ([]*CacheEntry, error)
+	Prune(ctx context.Context, req *PruneRequest) (*PruneResponse, error)
+}
+
+// CacheProber is implemented by cache providers that can tell whether they have an entry without replaying it.
+// Has must not change the entry, not even when it was last used. Providers that only implement CacheManager
+// are probed by listing their entries.
+type CacheProber interface {
+	Has(ctx context.Context, cacheKey string, localCacheDir string) (bool, error)
+}
+
+// ReplayReleaser is implemented by cache providers that replay artifacts from somewhere they don't keep,
+// like a download. ReleaseReplay is called once the artifacts of a hit were restored, so they can be removed.
+type ReplayReleaser interface {
+	ReleaseReplay(ctx context.Context, cacheKey string, localCacheDir string) error
+}
+
+// CacheConfigurer is implemented by cache providers that take settings from the cache section of
+// workspace.conf, Configure is called before anything else
+type CacheConfigurer interface {
+	Configure(context.Context, map[string]interface{}) error
+}
+
+// HashInputs hashes the names and contents of the files returned by CollectInputFiles
+func HashInputs(req *CacheKeyRequest) (string, error) {
+	files, err := CollectInputFiles(req)
+	if err != nil {
+		return "", errors.Wrap(err, "can't collect inputs")
+	}
+	hasher := md5.New()
+	for _, name := range files {
+		// Hash the name too, so renaming an input changes the key
+		hasher.Write([]byte(name))
+		file, err := os.Open(filepath.Join(req.LocalDirectory, filepath.FromSlash(name)))
+		if err != nil {
+			return "", errors.Wrapf(err, "can't open file %s", name)
+		}
+		_, err = io.Copy(hasher, file)
+		file.Close()
+		if err != nil {
+			return "", errors.Wrapf(err, "can't read file %s", name)
+		}
+	}
+	return fmt.Sprintf("%x", hasher.Sum([]byte{})), nil
+}
+
+// CacheKey combines the hash of the inputs of a step with the keys of its dependencies and its additional
+// data. Providers sharing entries must agree on keys, so they should all use this.
+func CacheKey(inputsHash string, req *CacheKeyRequest) string {
+	hasher := md5.New()
+	hasher.Write([]byte(inputsHash))
+	for _, key := range req.DependantCacheKeys {
+		hasher.Write([]byte(key))
 	}
-	resp, err := p.cacheClient.CreateCacheKey(context.Background(), &req)
+	for _, data := range req.AdditionalData {
+		hasher.Write([]byte(data))
+	}
+	return fmt.Sprintf("%x", hasher.Sum([]byte{}))
+}
+
+func (p *pluginClient) ConfigureCache(settings map[string]interface{}) error {
+	resp, err := p.cacheClient.Configure(context.Background(), &proto.CacheConfigRequest{
+		Settings: YamlToStruct(settings),
+	})
+	if err != nil {
+		return errors.Wrap(err, "can't configure cache")
+	}
+	if !resp.Success {
+		return fmt.Errorf("cache plugin rejected its settings: %s", resp.Error)
+	}
+	return nil
+}
+
+func (p *pluginClient) GetCacheKey(req CacheKeyRequest) (string, error) {
+	resp, err := p.cacheClient.CreateCacheKey(context.Background(), (*proto.CacheKeyRequest)(&req))
 	if err != nil {
 		return "", err
 	}
 	return resp.CacheKey, nil
 }
 
-func (p *pluginClient) Cache(cacheKey string, LocalCacheDirectory string, itemsToCache chan CacheItem) error {
+func (p *pluginClient) ListCache(localCacheDir string) ([]*CacheEntry, error) {
+	resp, err := p.cacheClient.List(context.Background(), &proto.ListRequest{
+		LocalCacheDirectory: localCacheDir,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list cache")
+	}
+	entries := []*CacheEntry{}
+	for _, entry := range resp.Entries {
+		entries = append(entries, (*CacheEntry)(entry))
+	}
+	return entries, nil
+}
+
+func (p *pluginClient) HasCache(cacheKey string, localCacheDir string) (bool, error) {
+	resp, err := p.cacheClient.Has(context.Background(), &proto.ReplayRequest{
+		CacheKey:            cacheKey,
+		LocalCacheDirectory: localCacheDir,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "can't check cache")
+	}
+	return resp.Hit, nil
+}
+
+func (p *pluginClient) ReleaseReplay(cacheKey string, localCacheDir string) error {
+	_, err := p.cacheClient.ReleaseReplay(context.Background(), &proto.ReplayRequest{
+		CacheKey:            cacheKey,
+		LocalCacheDirectory: localCacheDir,
+	})
+	return errors.Wrap(err, "can't release replayed cache")
+}
+
+func (p *pluginClient) PruneCache(req *PruneRequest) (*PruneResponse, error) {
+	resp, err := p.cacheClient.Prune(context.Background(), (*proto.PruneRequest)(req))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't prune cache")
+	}
+	return (*PruneResponse)(resp), nil
+}
+
+func (p *pluginClient) Cache(cacheKey string, LocalCacheDirectory string, metadata CacheMetadata, itemsToCache chan CacheItem) error {
 
 	srv, err := p.cacheClient.Cache(context.Background())
 	if err != nil {
@@ -43,22 +196,58 @@ func (p *pluginClient) Cache(cacheKey string, LocalCacheDirectory string, itemsT
 			LocalCacheDirectory: LocalCacheDirectory,
 			LogLine:             item.LogItem,
 			ArtifactToStore:     item.ArtifactPath,
+			ArtifactName:        item.ArtifactName,
+			PackageName:         metadata.PackageName,
+			CommandName:         metadata.CommandName,
 		}
 		err := srv.Send(&req)
 		if err != nil {
 			return errors.Wrapf(err, "can't cache item {cacheKey = %s, Artifact = %s, LogLine = %s}", cacheKey, item.ArtifactPath, item.LogItem)
 		}
 	}
-	return srv.CloseSend()
+	// Wait for the plugin to finish storing everything, otherwise a replay could see a partial entry
+	resp, err := srv.CloseAndRecv()
+	if err != nil {
+		return errors.Wrap(err, "can't finish caching")
+	}
+	if !resp.Success {
+		return fmt.Errorf("cache plugin failed to cache %s: %s", cacheKey, resp.Error)
+	}
+	return nil
+}
+
+func cacheItemFromReplay(msg *proto.ReplayResponse) CacheItem {
+	item := CacheItem{
+		LogItem: msg.GetLogs(),
+	}
+	if len(msg.GetArtifactLocations()) > 0 {
+		item.ArtifactPath = msg.GetArtifactLocations()[0]
+	}
+	if len(msg.GetArtifactNames()) > 0 {
+		item.ArtifactName = msg.GetArtifactNames()[0]
+	}
+	return item
 }
 
 func (p *pluginClient) ReplayCache(cacheKey string, localCache string) (chan CacheItem, bool, error) {
-	ch := make(chan CacheItem, 10)
-	req := proto.ReplayRequest{
+	return p.replay(&proto.ReplayRequest{
 		CacheKey:            cacheKey,
 		LocalCacheDirectory: localCache,
-	}
-	srv, err := p.cacheClient.ReplayCache(context.Background(), &req)
+	})
+}
+
+// PeekCache replays the logs and names of the artifacts of an entry without marking it as used
+func (p *pluginClient) PeekCache(cacheKey string, localCache string) (chan CacheItem, bool, error) {
+	return p.replay(&proto.ReplayRequest{
+		CacheKey:            cacheKey,
+		LocalCacheDirectory: localCache,
+		Peek:                true,
+	})
+}
+
+func (p *pluginClient) replay(req *proto.ReplayRequest) (chan CacheItem, bool, error) {
+	ch := make(chan CacheItem, 10)
+	srv, err := p.cacheClient.ReplayCache(context.Background(), req)
 	if err != nil {
 		close(ch)
 		return ch, false, errors.Wrap(err, "failed to get first cache message")
@@ -74,11 +263,8 @@ func (p *pluginClient) ReplayCache(cacheKey string, localCache string) (chan Cac
 		return ch, false, nil
 	}
 	go func() {
-		ch <- CacheItem{
-			LogItem:      first.Logs,
-			ArtifactPath: first.ArtifactLocations[0],
-		}
-		fmt.Println("got first item to replay")
+		ch <- cacheItemFromReplay(first)
+		log.Trace().Msg("got first item to replay")
 		defer close(ch)
 		for {
 			select {
@@ -94,10 +280,7 @@ func (p *pluginClient) ReplayCache(cacheKey string, localCache string) (chan Cac
 				if msg.Err != "" {
 					panic(msg.Err)
 				}
-				ch <- CacheItem{
-					LogItem:      msg.GetLogs(),
-					ArtifactPath: msg.GetArtifactLocations()[0],
-				}
+				ch <- cacheItemFromReplay(msg)
 			}
 		}
 
@@ -106,13 +289,92 @@ func (p *pluginClient) ReplayCache(cacheKey string, localCache string) (chan Cac
 
 }
 
+func (p *pluginProvider) Configure(ctx context.Context, req *proto.CacheConfigRequest) (*proto.CacheResponse, error) {
+	if p.cachProvider == nil {
+		return nil, newNotSupportedError(p.name, "Cache Provider")
+	}
+	configurer, ok := p.cachProvider.(CacheConfigurer)
+	if !ok {
+		return &proto.CacheResponse{Success: true}, nil
+	}
+	err := configurer.Configure(p.wrapContext(ctx, "INTERNAL:CACHER"), req.GetSettings().AsMap())
+	if err != nil {
+		return &proto.CacheResponse{Success: false, Error: err.Error()}, nil
+	}
+	return &proto.CacheResponse{Success: true}, nil
+}
+
+func (p *pluginProvider) List(ctx context.Context, req *proto.ListRequest) (*proto.ListResponse, error) {
+	manager, ok := p.cachProvider.(CacheManager)
+	if !ok {
+		return nil, newNotSupportedError(p.name, "listing the cache")
+	}
+	entries, err := manager.List(p.wrapContext(ctx, "INTERNAL:CACHER"), req.LocalCacheDirectory)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list cache")
+	}
+	resp := &proto.ListResponse{}
+	for _, entry := range entries {
+		resp.Entries = append(resp.Entries, (*proto.CacheEntry)(entry))
+	}
+	return resp, nil
+}
+
+func (p *pluginProvider) Has(ctx context.Context, req *proto.ReplayRequest) (*proto.HasResponse, error) {
+	newCtx := p.wrapContext(ctx, "INTERNAL:CACHER")
+	if prober, ok := p.cachProvider.(CacheProber); ok {
+		hit, err := prober.Has(newCtx, req.CacheKey, req.LocalCacheDirectory)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't check cache")
+		}
+		return &proto.HasResponse{Hit: hit}, nil
+	}
+	manager, ok := p.cachProvider.(CacheManager)
+	if !ok {
+		return nil, newNotSupportedError(p.name, "checking the cache")
+	}
+	entries, err := manager.List(newCtx, req.LocalCacheDirectory)
+	if err != nil {
+		return nil, errors.Wrap(err, "can't list cache")
+	}
+	for _, entry := range entries {
+		if entry.CacheKey == req.CacheKey {
+			return &proto.HasResponse{Hit: true}, nil
+		}
+	}
+	return &proto.HasResponse{Hit: false}, nil
+}
+
+func (p *pluginProvider) ReleaseReplay(ctx context.Context, req *proto.ReplayRequest) (*proto.CacheResponse, error) {
+	releaser, ok := p.cachProvider.(ReplayReleaser)
+	if !ok {
+		return &proto.CacheResponse{CacheKey: req.CacheKey, Success: true}, nil
+	}
+	if err := releaser.ReleaseReplay(p.wrapContext(ctx, "INTERNAL:CACHER"), req.CacheKey, req.LocalCacheDirectory); err != nil {
+		return nil, errors.Wrap(err, "can't release replayed cache")
+	}
+	return &proto.CacheResponse{CacheKey: req.CacheKey, Success: true}, nil
+}
+
+func (p *pluginProvider) Prune(ctx context.Context, req *proto.PruneRequest) (*proto.PruneResponse, error) {
+	manager, ok := p.cachProvider.(CacheManager)
+	if !ok {
+		return nil, newNotSupportedError(p.name, "pruning the cache")
+	}
+	resp, err := manager.Prune(p.wrapContext(ctx, "INTERNAL:CACHER"), (*PruneRequest)(req))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't prune cache")
+	}
+	return (*proto.PruneResponse)(resp), nil
+}
+
 func (p *pluginProvider) CreateCacheKey(ctx context.Context, cacheRequest *proto.CacheKeyRequest) (*proto.CacheKeyResponse, error) {
 	if p.cachProvider == nil {
 		return nil, newNotSupportedError(p.name, "Cache Provider")
 
 	}
 	newCtx := p.wrapContext(ctx, "INTERNAL:CACHER")
-	req, err := p.cachProvider.CreateCacheKey(newCtx, cacheRequest.LocalDirectory, cacheRequest.DependantCacheKeys, cacheRequest.AdditionalData)
+	req, err := p.cachProvider.CreateCacheKey(newCtx, (*CacheKeyRequest)(cacheRequest))
 	if err != nil {
 		return nil, err
 	}
@@ -121,49 +383,79 @@ func (p *pluginProvider) CreateCacheKey(ctx context.Context, cacheRequest *proto
 	}, nil
 }
 
+func cacheItemFromRequest(req *proto.CacheRequest) CacheItem {
+	return CacheItem{
+		LogItem:      req.LogLine,
+		ArtifactPath: req.ArtifactToStore,
+		ArtifactName: req.ArtifactName,
+	}
+}
+
 func (p *pluginProvider) Cache(cacheSrv proto.Cacher_CacheServer) error {
 	if p.cachProvider == nil {
 		return newNotSupportedError(p.name, "Cache Provider")
 	}
-	cacheChan := make(chan CacheItem, 10)
-	errChan := make(chan error)
 	firstReq, err := cacheSrv.Recv()
-	if err != nil {
+	if errors.Is(err, io.EOF) {
+		// Nothing to cache
+		return cacheSrv.SendAndClose(&proto.CacheResponse{Success: true})
+	} else if err != nil {
 		return errors.Wrap(err, "error getting first request")
 	}
+	cacheChan := make(chan CacheItem, 10)
+	errChan := make(chan error, 1)
 	go func() {
-		newCtx := p.wrapContext(cacheSrv.Context(), "INTERNAL:CACHER")
+		newCtx := context.WithValue(p.wrapContext(cacheSrv.Context(), "INTERNAL:CACHER"), cacheMetadataKey{}, CacheMetadata{
+			PackageName: firstReq.PackageName,
+			CommandName: firstReq.CommandName,
+		})
 		errChan <- p.cachProvider.Cache(newCtx, firstReq.CacheKey, firstReq.LocalCacheDirectory, cacheChan)
 	}()
-	cacheChan <- CacheItem{
-		LogItem:      firstReq.LogLine,
-		ArtifactPath: firstReq.ArtifactToStore,
-	}
-	for {
-		select {
-		case err := <-errChan:
-			return errors.Wrap(err, "can't cache")
-		case <-cacheSrv.Context().Done():
-			return nil
-		default:
-			req, err := cacheSrv.Recv()
-			if err != nil {
-				errChan <- err
-			}
-			cacheChan <- CacheItem{
-				LogItem:      req.LogLine,
-				ArtifactPath: req.ArtifactToStore,
-			}
 
+	var cacheErr error
+	providerDone := false
+	for req := firstReq; req != nil && !providerDone; {
+		select {
+		case cacheChan <- cacheItemFromRequest(req):
+		case cacheErr = <-errChan:
+			// The provider gave up before reading everything
+			providerDone = true
+			continue
+		}
+		req, err = cacheSrv.Recv()
+		if errors.Is(err, io.EOF) {
+			req = nil
+		} else if err != nil {
+			close(cacheChan)
+			return errors.Wrap(err, "can't receive cache request")
 		}
 	}
+	close(cacheChan)
+	if !providerDone {
+		cacheErr = <-errChan
+	}
+	if cacheErr != nil {
+		return cacheSrv.SendAndClose(&proto.CacheResponse{
+			CacheKey: firstReq.CacheKey,
+			Success:  false,
+			Error:    cacheErr.Error(),
+		})
+	}
+	return cacheSrv.SendAndClose(&proto.CacheResponse{
+		CacheKey: firstReq.CacheKey,
+		Success:  true,
+	})
 }
 
 func (p *pluginProvider) ReplayCache(req *proto.ReplayRequest, srv proto.Cacher_ReplayCacheServer) error {
 	if p.cachProvider == nil {
 		return newNotSupportedError(p.name, "Cache Provider")
 	}
-	replayChan, hit, err := p.cachProvider.ReplayCache(p.wrapContext(srv.Context(), "INTERNAL:CACHER"), req.CacheKey, req.LocalCacheDirectory)
+	ctx := p.wrapContext(srv.Context(), "INTERNAL:CACHER")
+	if req.Peek {
+		ctx = WithPeek(ctx)
+	}
+	replayChan, hit, err := p.cachProvider.ReplayCache(ctx, req.CacheKey, req.LocalCacheDirectory)
 	if err != nil {
 		return errors.Wrap(err, "replay cache failed")
 	}
@@ -175,11 +467,15 @@ func (p *pluginProvider) ReplayCache(req *proto.ReplayRequest, srv proto.Cacher_
 	}
 
 	for replay := range replayChan {
-		srv.Send(&proto.ReplayResponse{
-			Logs:              replay.LogItem,
-			ArtifactLocations: []string{replay.ArtifactPath},
-			Hit:               true,
-		})
+		resp := &proto.ReplayResponse{
+			Logs: replay.LogItem,
+			Hit:  true,
+		}
+		if replay.ArtifactPath != "" || replay.ArtifactName != "" {
+			resp.ArtifactLocations = []string{replay.ArtifactPath}
+			resp.ArtifactNames = []string{replay.ArtifactName}
+		}
+		srv.Send(resp)
 	}
 	return nil
 }
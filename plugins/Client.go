@@ -19,24 +19,40 @@ type PluginDefinition proto.PluginDefinition
 type CacheItem struct {
 	LogItem      string
 	ArtifactPath string
+	// ArtifactName is the slash separated path of the artifact relative to its package
+	ArtifactName string
 }
 
 type PluginClient interface {
 	Run(RunRequest, ...CallOption) (ClientTask, error)
 	Install() (*PluginDefinition, error)
-	GetCacheKey(string, []string, []string) (string, error)
-	Cache(string, string, chan CacheItem) error
+	CanHandle(CanHandleRequest) (bool, error)
+	Clone(CloneRequest) (*CloneResponse, error)
+	GetCacheKey(CacheKeyRequest) (string, error)
+	ConfigureCache(map[string]interface{}) error
+	Cache(string, string, CacheMetadata, chan CacheItem) error
+	ListCache(string) ([]*CacheEntry, error)
+	HasCache(string, string) (bool, error)
+	PruneCache(*PruneRequest) (*PruneResponse, error)
 	ReplayCache(string, string) (chan CacheItem, bool, error)
+	PeekCache(string, string) (chan CacheItem, bool, error)
+	ReleaseReplay(string, string) error
+	RegisterCommand() (*RegisterCommandResponse, error)
+	RunCommand(*HandleCommandRequest, CommandHandler) error
+	Namespaces() ([]string, error)
+	ResolveVariable(*ResolveVariableRequest) (interface{}, bool, error)
 	Kill()
 }
 
 type pluginClient struct {
 	plugin.Plugin
-	managerClient proto.ManagerClient
-	runnerClient  proto.RunnerClient
-	installClient proto.InstallerClient
-	cacheClient   proto.CacherClient
-	clientImpl    *plugin.Client
+	managerClient   proto.ManagerClient
+	runnerClient    proto.RunnerClient
+	installClient   proto.InstallerClient
+	cacheClient     proto.CacherClient
+	commandClient   proto.CommandClient
+	variablesClient proto.VariablesClient
+	clientImpl      *plugin.Client
 
 	logger *LogBroker
 }
@@ -91,10 +107,12 @@ func (p *pluginClient) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) err
 
 func (p *pluginClient) GRPCClient(ctx context.Context, broker *plugin.GRPCBroker, c *grpc.ClientConn) (interface{}, error) {
 	return &pluginClient{
-		managerClient: proto.NewManagerClient(c),
-		runnerClient:  proto.NewRunnerClient(c),
-		installClient: proto.NewInstallerClient(c),
-		cacheClient:   proto.NewCacherClient(c),
+		managerClient:   proto.NewManagerClient(c),
+		runnerClient:    proto.NewRunnerClient(c),
+		installClient:   proto.NewInstallerClient(c),
+		cacheClient:     proto.NewCacherClient(c),
+		commandClient:   proto.NewCommandClient(c),
+		variablesClient: proto.NewVariablesClient(c),
 	}, nil
 }
 
@@ -112,12 +130,15 @@ func (p *pluginClient) CanHandle(req CanHandleRequest) (bool, error) {
 	return resp.CanHandle, err
 }
 
-func (p *pluginClient) Clone(req CloneRequest) (string, error) {
+func (p *pluginClient) Clone(req CloneRequest) (*CloneResponse, error) {
 	_req := proto.CloneMessage(req)
 
 	resp, err := p.managerClient.Clone(context.Background(), &_req)
-	if resp == nil {
-		return "", err
+	if err != nil {
+		return nil, errors.Wrap(err, "can't clone")
+	}
+	if !resp.WasSuccess {
+		return (*CloneResponse)(resp), &CloneError{Code: resp.ErrorCode, Message: resp.ErrorMessage}
 	}
-	return resp.Destination, err
+	return (*CloneResponse)(resp), nil
 }
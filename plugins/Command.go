@@ -1,10 +1,174 @@
 package plugins
 
-import "github.com/radding/harbor-plugins/proto"
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-plugins/proto"
+)
 
 type RegisterCommandRequest proto.RegisterCommandRequest
 type RegisterCommandResponse proto.RegisterCommandResponse
+type CLICommand proto.CLICommand
+type Flag proto.Flag
+type HandleCommandRequest proto.HandleCommandRequest
+type LogLevel proto.LogLevel
+
+const (
+	LogTrace LogLevel = LogLevel(proto.LogLevel_TRACE)
+	LogDebug LogLevel = LogLevel(proto.LogLevel_DEBUG)
+	LogInfo  LogLevel = LogLevel(proto.LogLevel_INFO)
+	LogWarn  LogLevel = LogLevel(proto.LogLevel_WARN)
+	LogError LogLevel = LogLevel(proto.LogLevel_ERROR)
+	LogFatal LogLevel = LogLevel(proto.LogLevel_FATAL)
+)
+
+// CommandIO is how a running command talks to the user of the CLI
+type CommandIO interface {
+	Log(level LogLevel, message string) error
+	// Prompt shows question to the user and returns the line they answered with
+	Prompt(question string) (string, error)
+	// Help shows the help of the command being run
+	Help() error
+}
+
+// CommandProvider adds a tree of subcommands to the harbor CLI
+type CommandProvider interface {
+	RegisterCommand(ctx context.Context) (*RegisterCommandResponse, error)
+	// RunCommand runs the command at req.CommandPath, the first element of it is the main command
+	RunCommand(ctx context.Context, req *HandleCommandRequest, cmdIO CommandIO) error
+}
+
+// CommandHandler handles what a running plugin command sends back to the CLI
+type CommandHandler interface {
+	Log(level LogLevel, message string)
+	Input(prompt string) (string, error)
+	Help()
+}
+
+// Client implementation
+func (p *pluginClient) RegisterCommand() (*RegisterCommandResponse, error) {
+	resp, err := p.commandClient.RegisterCommand(context.Background(), &proto.RegisterCommandRequest{})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't register command")
+	}
+	return (*RegisterCommandResponse)(resp), nil
+}
+
+func (p *pluginClient) RunCommand(req *HandleCommandRequest, handler CommandHandler) error {
+	stream, err := p.commandClient.Run(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "can't start streaming server")
+	}
+	if err := stream.Send((*proto.HandleCommandRequest)(req)); err != nil {
+		return errors.Wrap(err, "can't send command request")
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return errors.New("plugin stopped before the command was done")
+		} else if err != nil {
+			return errors.Wrap(err, "error running command")
+		}
+		switch resp.Type {
+		case proto.HandleCommandResponseType_LOG:
+			handler.Log(LogLevel(resp.Level), resp.Message)
+		case proto.HandleCommandResponseType_HANDLEHELP:
+			handler.Help()
+		case proto.HandleCommandResponseType_INPUT:
+			answer, err := handler.Input(resp.Message)
+			if err != nil {
+				stream.CloseSend()
+				return errors.Wrap(err, "can't read input")
+			}
+			if err := stream.Send(&proto.HandleCommandRequest{Input: answer}); err != nil {
+				return errors.Wrap(err, "can't send input")
+			}
+		case proto.HandleCommandResponseType_COMMAND_ERROR:
+			stream.CloseSend()
+			return errors.New(resp.Message)
+		case proto.HandleCommandResponseType_DONE:
+			return stream.CloseSend()
+		}
+	}
+}
+
+// Server implementation, the Command service gets its own server since its Run collides with the Runner's
+type commandServer struct {
+	proto.UnimplementedCommandServer
+	p *pluginProvider
+}
+
+func (c *commandServer) RegisterCommand(ctx context.Context, req *proto.RegisterCommandRequest) (*proto.RegisterCommandResponse, error) {
+	if c.p.commandImpl == nil {
+		return nil, newNotSupportedError(c.p.name, "commands")
+	}
+	resp, err := c.p.commandImpl.RegisterCommand(c.p.wrapContext(ctx, "register-command"))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't register command")
+	}
+	return (*proto.RegisterCommandResponse)(resp), nil
+}
+
+func (c *commandServer) Run(srv proto.Command_RunServer) error {
+	if c.p.commandImpl == nil {
+		return newNotSupportedError(c.p.name, "commands")
+	}
+	first, err := srv.Recv()
+	if err != nil {
+		return errors.Wrap(err, "error getting command request")
+	}
+	ctx := c.p.wrapContext(srv.Context(), strings.Join(first.CommandPath, " "))
+	cmdIO := &commandIO{srv: srv, lock: &sync.Mutex{}}
+	err = c.p.commandImpl.RunCommand(ctx, (*HandleCommandRequest)(first), cmdIO)
+	if err != nil {
+		return cmdIO.send(&proto.HandleCommandResponse{
+			Type:    proto.HandleCommandResponseType_COMMAND_ERROR,
+			Message: err.Error(),
+		})
+	}
+	return cmdIO.send(&proto.HandleCommandResponse{Type: proto.HandleCommandResponseType_DONE})
+}
+
+type commandIO struct {
+	srv  proto.Command_RunServer
+	lock *sync.Mutex
+}
+
+func (c *commandIO) send(resp *proto.HandleCommandResponse) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.srv.Send(resp)
+}
+
+func (c *commandIO) Log(level LogLevel, message string) error {
+	return c.send(&proto.HandleCommandResponse{
+		Type:    proto.HandleCommandResponseType_LOG,
+		Message: message,
+		Level:   proto.LogLevel(level),
+	})
+}
+
+func (c *commandIO) Prompt(question string) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	err := c.srv.Send(&proto.HandleCommandResponse{
+		Type:    proto.HandleCommandResponseType_INPUT,
+		Message: question,
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "can't ask for input")
+	}
+	answer, err := c.srv.Recv()
+	if err != nil {
+		return "", errors.Wrap(err, "can't get input")
+	}
+	return answer.Input, nil
+}
 
-type Command interface {
-	RegisterCommand(RegisterCommandRequest) (RegisterCommandResponse, error)
+func (c *commandIO) Help() error {
+	return c.send(&proto.HandleCommandResponse{Type: proto.HandleCommandResponseType_HANDLEHELP})
 }
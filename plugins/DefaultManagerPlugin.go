@@ -1,12 +1,14 @@
 package plugins
 
+import "context"
+
 type DefaulManagerServer struct {
 }
 
-func (d *DefaulManagerServer) CanHandle(req CanHandleRequest) (bool, error) {
+func (d *DefaulManagerServer) CanHandle(ctx context.Context, req *CanHandleRequest) (bool, error) {
 	return false, nil
 }
 
-func (d *DefaulManagerServer) Clone(req CloneRequest) (string, error) {
-	return "", nil
+func (d *DefaulManagerServer) Clone(ctx context.Context, req *CloneRequest) (*CloneResponse, error) {
+	return nil, &CloneError{Code: CloneErrUnknown, Message: "the default manager can't clone anything"}
 }
@@ -0,0 +1,203 @@
+package plugins
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MatchPath reports whether the slash separated path name matches pattern. Patterns are matched a
+// path segment at a time with the rules of path.Match, except that a "**" segment matches any number
+// of segments, including none.
+func MatchPath(pattern, name string) bool {
+	return matchSegments(splitPath(pattern), splitPath(name))
+}
+
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean(filepath.ToSlash(p)), "/")
+	if p == "" || p == "." {
+		return []string{}
+	}
+	return strings.Split(p, "/")
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		ok, err := path.Match(pattern[0], name[0])
+		if err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchesAny reports whether name, or any directory containing it, matches one of the patterns
+func matchesAny(patterns []string, name string) bool {
+	segments := splitPath(name)
+	for _, pattern := range patterns {
+		patternSegments := splitPath(pattern)
+		for i := len(segments); i > 0; i-- {
+			if matchSegments(patternSegments, segments[:i]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CollectFiles walks root and returns the sorted, slash separated paths relative to root of every
+// file matching one of include and none of exclude. A pattern that matches a directory matches
+// everything inside of it.
+func CollectFiles(root string, include []string, exclude []string) ([]string, error) {
+	return collectFiles(root, include, exclude, nil)
+}
+
+// DefaultInputExcludes are never part of the inputs of a command, they hold harbor's own state and
+// version control metadata
+var DefaultInputExcludes = []string{".git", ".harbor"}
+
+// CollectInputFiles returns the files a cache key is calculated from, every cache provider should hash
+// exactly this set so they agree on what invalidates a key. Without includes everything in the
+// directory is included.
+func CollectInputFiles(req *CacheKeyRequest) ([]string, error) {
+	include := req.Includes
+	if len(include) == 0 {
+		include = []string{"**"}
+	}
+	exclude := append(append([]string{}, DefaultInputExcludes...), req.Excludes...)
+	var ignore *gitignore
+	if req.RespectGitignore {
+		ignore = &gitignore{rules: map[string][]ignoreRule{}}
+	}
+	return collectFiles(req.LocalDirectory, include, exclude, ignore)
+}
+
+func collectFiles(root string, include []string, exclude []string, ignore *gitignore) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			rel = ""
+		}
+		if rel != "" && (matchesAny(exclude, rel) || ignore.ignored(rel, d.IsDir())) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return ignore.load(root, rel)
+		}
+		if matchesAny(include, rel) {
+			files = append(files, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't walk %s", root)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+type ignoreRule struct {
+	pattern []string
+	negate  bool
+	dirOnly bool
+	// anchored rules match relative to the directory of their .gitignore, the rest match at any depth
+	anchored bool
+}
+
+// gitignore holds the rules of every .gitignore found so far, keyed by the directory they were found in
+type gitignore struct {
+	rules map[string][]ignoreRule
+}
+
+func (g *gitignore) load(root string, dir string) error {
+	if g == nil {
+		return nil
+	}
+	contents, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(dir), ".gitignore"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "can't read .gitignore in %s", dir)
+	}
+	rules := []ignoreRule{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimRight(line, " \r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		line = strings.TrimPrefix(line, "\\")
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = splitPath(line)
+		if len(rule.pattern) > 0 {
+			rules = append(rules, rule)
+		}
+	}
+	g.rules[dir] = rules
+	return nil
+}
+
+// ignored reports whether the path is ignored, later rules and deeper .gitignore files win
+func (g *gitignore) ignored(rel string, isDir bool) bool {
+	if g == nil {
+		return false
+	}
+	segments := splitPath(rel)
+	ignored := false
+	for depth := 0; depth < len(segments); depth++ {
+		dir := strings.Join(segments[:depth], "/")
+		local := segments[depth:]
+		for _, rule := range g.rules[dir] {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			matched := false
+			if rule.anchored {
+				matched = matchSegments(rule.pattern, local)
+			} else {
+				matched = matchSegments(rule.pattern, local[len(local)-1:])
+			}
+			if matched {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -1,11 +1,13 @@
 package plugins
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 	"sync"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/radding/harbor-plugins/proto"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -17,10 +19,32 @@ type Plugin interface {
 
 type CanHandleRequest proto.CanHandleMessage
 type CloneRequest proto.CloneMessage
+type CloneResponse proto.CloneResponse
+
+// The error codes of a failed clone
+const (
+	CloneErrUnknown int64 = iota + 1
+	CloneErrNotFound
+	CloneErrRefNotFound
+	CloneErrDestinationExists
+	CloneErrAuthentication
+	// CloneErrDirty is an existing checkout with changes that updating it would lose
+	CloneErrDirty
+)
+
+// CloneError is a failed clone, managers return it to tell harbor why cloning failed
+type CloneError struct {
+	Code    int64
+	Message string
+}
+
+func (c *CloneError) Error() string {
+	return c.Message
+}
 
 type ManagerPlugin interface {
-	CanHandle(CanHandleRequest) (bool, error)
-	Clone(CloneRequest) (string, error)
+	CanHandle(ctx context.Context, req *CanHandleRequest) (bool, error)
+	Clone(ctx context.Context, req *CloneRequest) (*CloneResponse, error)
 }
 
 type LogEntry struct {
@@ -96,3 +120,34 @@ func (d *LogBroker) AddCapturer(capt LogEventCapturer) string {
 func (d *LogBroker) RemoveCapturer(uid string) {
 	d.logCapturers.Delete(uid)
 }
+
+// Server implementation of Manager
+func (p *pluginProvider) CanHandle(ctx context.Context, req *proto.CanHandleMessage) (*proto.CanHandleResponse, error) {
+	if p.managerImpl == nil {
+		return &proto.CanHandleResponse{CanHandle: false}, nil
+	}
+	canHandle, err := p.managerImpl.CanHandle(p.wrapContext(ctx, "can-handle"), (*CanHandleRequest)(req))
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't check if %s can be handled", req.Url)
+	}
+	return &proto.CanHandleResponse{CanHandle: canHandle}, nil
+}
+
+func (p *pluginProvider) Clone(ctx context.Context, req *proto.CloneMessage) (*proto.CloneResponse, error) {
+	if p.managerImpl == nil {
+		return nil, newNotSupportedError(p.name, "cloning")
+	}
+	resp, err := p.managerImpl.Clone(p.wrapContext(ctx, "clone"), (*CloneRequest)(req))
+	if err != nil {
+		cloneErr := &CloneError{Code: CloneErrUnknown, Message: err.Error()}
+		errors.As(err, &cloneErr)
+		return &proto.CloneResponse{
+			Destination:  req.Destination,
+			WasSuccess:   false,
+			ErrorCode:    cloneErr.Code,
+			ErrorMessage: cloneErr.Message,
+		}, nil
+	}
+	resp.WasSuccess = true
+	return (*proto.CloneResponse)(resp), nil
+}
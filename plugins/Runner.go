@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -123,6 +124,9 @@ func newClientTask(srv proto.Runner_RunClient, runRequest RunRequest, cleanUp fu
 	return task
 }
 
+// statusInterval is how often a running task reports its status back to harbor
+const statusInterval = 100 * time.Millisecond
+
 type RunnerCancelFunc func(signalCode int64, timeoutMS int64) error
 
 type TaskRunner interface {
@@ -135,6 +139,20 @@ func (t TaskRunnerFunc) Run(r RunRequest, ctx context.Context) (Task, error) {
 	return t(r, ctx)
 }
 
+// Environ is the environment of the command in the KEY=value form exec.Cmd takes, sorted by key. It is nil when
+// harbor sent no environment, so the command inherits the one of the plugin.
+func (r *RunRequest) Environ() []string {
+	if len(r.Env) == 0 {
+		return nil
+	}
+	env := make([]string, 0, len(r.Env))
+	for key, value := range r.Env {
+		env = append(env, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(env)
+	return env
+}
+
 func runRequestPtr(r RunRequest) *proto.StartRequest {
 	v := proto.StartRequest(r)
 	return &v
@@ -178,37 +196,43 @@ func (p *pluginProvider) Run(serv proto.Runner_RunServer) error {
 		p.logger.With("@Identifier", startReq.StepIdentifier),
 	)
 	t, err := p.runnerImpl.Run(RunRequest(*startReq), ctx2)
+	if err != nil {
+		serv.Send(&proto.RunResponse{
+			Status:   proto.RunStatus_CRASHED,
+			ExitCode: -1,
+		})
+		return errors.Wrap(err, "can't start task")
+	}
 	serv.Send(&proto.RunResponse{
 		Status:      proto.RunStatus_STARTING,
 		ExitCode:    0,
 		TimeElapsed: 0,
 	})
 
-	runChan := make(chan struct {
+	type runRequest struct {
 		req *proto.RunRequest
 		err error
-	})
+	}
+	runChan := make(chan runRequest)
 
+	// Keep listening for requests, a cancel request can be followed by another one that escalates
+	// the signal
 	go func() {
-		d, err := serv.Recv()
-		if err != nil {
-			runChan <- struct {
-				req *proto.RunRequest
-				err error
-			}{
-				req: nil,
-				err: err,
+		for {
+			d, err := serv.Recv()
+			select {
+			case runChan <- runRequest{req: d, err: err}:
+			case <-ctx.Done():
+				return
+			}
+			if err != nil {
+				return
 			}
-		}
-		runChan <- struct {
-			req *proto.RunRequest
-			err error
-		}{
-			req: d,
-			err: nil,
 		}
 	}()
 
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case <-ctx.Done():
@@ -224,21 +248,20 @@ func (p *pluginProvider) Run(serv proto.Runner_RunServer) error {
 				return fmt.Errorf("unexpected start request")
 			}
 			cancel := d.GetCancelRequest()
-			timeoutCtx, cancelFunc := context.WithTimeout(ctx, time.Duration(cancel.TimeoutMS+10))
+			p.logger.Debug(fmt.Sprintf("canceling task with signal %d and a timeout of %dms", cancel.Signal, cancel.TimeoutMS))
 			go func() {
-				defer cancelFunc()
-				t.Stop(cancel.Signal, cancel.TimeoutMS)
+				if err := t.Stop(cancel.Signal, cancel.TimeoutMS); err != nil {
+					p.logger.Error(fmt.Sprintf("error canceling: %s", err.Error()))
+				}
 			}()
-			<-timeoutCtx.Done()
-			err = timeoutCtx.Err()
-			if err != nil {
-				p.logger.Error(fmt.Sprintf("error canceling: %s", err.Error()))
-			}
-		default:
+		case <-ticker.C:
 			status := t.Status()
 			resp := proto.RunResponse(status)
 			serv.Send(&resp)
+			switch resp.Status {
+			case proto.RunStatus_FINISHED, proto.RunStatus_CRASHED, proto.RunStatus_CANCELED:
+				return nil
+			}
 		}
 	}
-	// resp := proto.RunResponse(_resp)
 }
@@ -0,0 +1,90 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/radding/harbor-plugins/proto"
+)
+
+type ResolveVariableRequest proto.ResolveVariableRequest
+
+// VariableProvider adds namespaces of variables, like ${{ docker.running }}, to the conditions of commands
+type VariableProvider interface {
+	// Namespaces are the names before the dot this provider resolves variables of
+	Namespaces(ctx context.Context) ([]string, error)
+	// Resolve returns a string, a number or a bool, and false when the variable is not defined
+	Resolve(ctx context.Context, req *ResolveVariableRequest) (interface{}, bool, error)
+}
+
+// Client implementation
+func (p *pluginClient) Namespaces() ([]string, error) {
+	resp, err := p.variablesClient.Namespaces(context.Background(), &proto.NamespacesRequest{})
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get variable namespaces")
+	}
+	return resp.Namespaces, nil
+}
+
+func (p *pluginClient) ResolveVariable(req *ResolveVariableRequest) (interface{}, bool, error) {
+	resp, err := p.variablesClient.Resolve(context.Background(), (*proto.ResolveVariableRequest)(req))
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "can't resolve %s.%s", req.Namespace, req.Name)
+	}
+	if !resp.Defined {
+		return nil, false, nil
+	}
+	switch value := resp.Value.(type) {
+	case *proto.VariableValue_StringValue:
+		return value.StringValue, true, nil
+	case *proto.VariableValue_NumberValue:
+		return value.NumberValue, true, nil
+	case *proto.VariableValue_BoolValue:
+		return value.BoolValue, true, nil
+	}
+	return nil, false, fmt.Errorf("plugin returned no value for %s.%s", req.Namespace, req.Name)
+}
+
+// Server implementation
+type variablesServer struct {
+	proto.UnimplementedVariablesServer
+	p *pluginProvider
+}
+
+func (v *variablesServer) Namespaces(ctx context.Context, req *proto.NamespacesRequest) (*proto.NamespacesResponse, error) {
+	if v.p.variableImpl == nil {
+		return nil, newNotSupportedError(v.p.name, "variables")
+	}
+	namespaces, err := v.p.variableImpl.Namespaces(v.p.wrapContext(ctx, "namespaces"))
+	if err != nil {
+		return nil, errors.Wrap(err, "can't get namespaces")
+	}
+	return &proto.NamespacesResponse{Namespaces: namespaces}, nil
+}
+
+func (v *variablesServer) Resolve(ctx context.Context, req *proto.ResolveVariableRequest) (*proto.VariableValue, error) {
+	if v.p.variableImpl == nil {
+		return nil, newNotSupportedError(v.p.name, "variables")
+	}
+	value, defined, err := v.p.variableImpl.Resolve(v.p.wrapContext(ctx, fmt.Sprintf("%s.%s", req.Namespace, req.Name)), (*ResolveVariableRequest)(req))
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't resolve %s.%s", req.Namespace, req.Name)
+	}
+	if !defined {
+		return &proto.VariableValue{Defined: false}, nil
+	}
+	switch val := value.(type) {
+	case string:
+		return &proto.VariableValue{Defined: true, Value: &proto.VariableValue_StringValue{StringValue: val}}, nil
+	case bool:
+		return &proto.VariableValue{Defined: true, Value: &proto.VariableValue_BoolValue{BoolValue: val}}, nil
+	case int:
+		return &proto.VariableValue{Defined: true, Value: &proto.VariableValue_NumberValue{NumberValue: float64(val)}}, nil
+	case int64:
+		return &proto.VariableValue{Defined: true, Value: &proto.VariableValue_NumberValue{NumberValue: float64(val)}}, nil
+	case float64:
+		return &proto.VariableValue{Defined: true, Value: &proto.VariableValue_NumberValue{NumberValue: val}}, nil
+	}
+	return nil, fmt.Errorf("%s.%s is a %T, variables can only be strings, numbers or bools", req.Namespace, req.Name, value)
+}
@@ -32,6 +32,8 @@ type PluginProvider interface {
 	WithTaskRunner(string, TaskRunner) PluginProvider
 	WithLogger(logger hclog.Logger) PluginProvider
 	WithCacheProvider(CacheProvider) PluginProvider
+	WithCommand(CommandProvider) PluginProvider
+	WithVariableProvider(VariableProvider) PluginProvider
 	ServePlugin()
 }
 
@@ -40,9 +42,12 @@ type pluginProvider struct {
 	proto.UnimplementedRunnerServer
 	proto.UnimplementedInstallerServer
 	proto.UnimplementedCacherServer
+	proto.UnimplementedManagerServer
 	runnerImpl     TaskRunner
 	managerImpl    ManagerPlugin
 	cachProvider   CacheProvider
+	commandImpl    CommandProvider
+	variableImpl   VariableProvider
 	name           string
 	logger         hclog.Logger
 	runnerSettings struct {
@@ -73,6 +78,16 @@ func (p *pluginProvider) WithCacheProvider(cacheProvider CacheProvider) PluginPr
 	return p
 }
 
+func (p *pluginProvider) WithCommand(c CommandProvider) PluginProvider {
+	p.commandImpl = c
+	return p
+}
+
+func (p *pluginProvider) WithVariableProvider(v VariableProvider) PluginProvider {
+	p.variableImpl = v
+	return p
+}
+
 func (p *pluginProvider) WithManager(m ManagerPlugin) PluginProvider {
 	p.managerImpl = m
 	return p
@@ -103,10 +118,12 @@ func (p *pluginProvider) ServePlugin() {
 }
 
 func (p *pluginProvider) GRPCServer(broker *plugin.GRPCBroker, s *grpc.Server) error {
-	// proto.RegisterManagerServer(s, p)
+	proto.RegisterManagerServer(s, p)
 	proto.RegisterRunnerServer(s, p)
 	proto.RegisterInstallerServer(s, p)
 	proto.RegisterCacherServer(s, p)
+	proto.RegisterCommandServer(s, &commandServer{p: p})
+	proto.RegisterVariablesServer(s, &variablesServer{p: p})
 	// proto.Register
 	return nil
 }
@@ -123,6 +140,12 @@ func (p *pluginProvider) InstallPlugin(ctx context.Context, in *proto.InstallReq
 	if p.runnerImpl != nil {
 		caps = append(caps, proto.PluginCapabilities_TASK_RUNNER)
 	}
+	if p.commandImpl != nil {
+		caps = append(caps, proto.PluginCapabilities_COMMAND_PROVIDER)
+	}
+	if p.variableImpl != nil {
+		caps = append(caps, proto.PluginCapabilities_VARIABLE_PROVIDER)
+	}
 	return &proto.PluginDefinition{
 		Name:         p.name,
 		Capabilities: caps,